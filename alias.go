@@ -0,0 +1,134 @@
+package dnsclient
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// AliasKind is the kind of record that an alias hop comes from.
+type AliasKind int
+
+const (
+	AliasCNAME AliasKind = iota
+	// AliasDNAME is a hop that is synthesized from a DNAME record, which
+	// redirects a whole subtree (RFC 6672).
+	AliasDNAME
+)
+
+var AliasKindToString = map[AliasKind]string{
+	AliasCNAME: "CNAME",
+	AliasDNAME: "DNAME",
+}
+
+func (k AliasKind) String() string {
+	s, ok := AliasKindToString[k]
+	if !ok {
+		return fmt.Sprintf("AliasKind(%d)", int(k))
+	}
+	return s
+}
+
+// Alias is one hop of an alias chain: Name is an alias for Target.
+type Alias struct {
+	Kind   AliasKind
+	Name   string
+	Target string
+	// Owner is the owner name of the record the hop comes from: Name, for
+	// a CNAME, or the ancestor of Name that owns the DNAME.
+	Owner string
+	TTL   uint32
+}
+
+func (a *Alias) String() string {
+	if a.Kind == AliasDNAME {
+		return fmt.Sprintf("%s -> %s (DNAME %s)", a.Name, a.Target, a.Owner)
+	}
+	return fmt.Sprintf("%s -> %s (CNAME)", a.Name, a.Target)
+}
+
+// dnameTarget substitutes the target of dname for its owner name in name,
+// which must be below the owner (RFC 6672, section 2.2).  It fails if the
+// result isn't a valid domain name (e.g., it is too long).
+func dnameTarget(name string, dname *dns.DNAME) (string, bool) {
+	owner := dns.Fqdn(dname.Hdr.Name)
+	name = dns.Fqdn(name)
+	prefix := name[:len(name)-len(owner)]
+	target := prefix + dns.Fqdn(dname.Target)
+	if dname.Target == "." {
+		target = prefix
+	}
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+		return "", false
+	}
+	return target, true
+}
+
+// followAliases follows the aliases in answer, starting from name, up to the
+// records of type qtype.  It returns the name that it stops at, the hops on
+// the way, and whether answer has the qtype records for that name.  A DNAME
+// takes precedence over the CNAME that was synthesized from it, which must
+// agree with it.
+func followAliases(answer []dns.RR, name string, qtype uint16) (string, []*Alias, bool, *DNSErr) {
+	var aliases []*Alias
+	seen := make(map[string]bool)
+	fail := func(reason DNSErr) (string, []*Alias, bool, *DNSErr) {
+		return name, aliases, false, &reason
+	}
+
+	for {
+		key := strings.ToLower(name)
+		if seen[key] {
+			return fail(DNSErrInvalidCNAMEChain)
+		}
+		seen[key] = true
+
+		var cname *dns.CNAME
+		var dname *dns.DNAME
+		for _, rr := range answer {
+			h := rr.Header()
+			if h.Rrtype == qtype && equalNames(h.Name, name) {
+				return name, aliases, true, nil
+			}
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if equalNames(h.Name, name) {
+					cname = rr
+				}
+			case *dns.DNAME:
+				if !equalNames(h.Name, name) && dns.IsSubDomain(h.Name, name) &&
+					(dname == nil || dns.CountLabel(h.Name) > dns.CountLabel(dname.Hdr.Name)) {
+					dname = rr
+				}
+			}
+		}
+
+		switch {
+		case dname != nil:
+			target, ok := dnameTarget(name, dname)
+			if !ok || (cname != nil && !equalNames(cname.Target, target)) {
+				return fail(DNSErrInvalidDNAME)
+			}
+			aliases = append(aliases, &Alias{
+				Kind:   AliasDNAME,
+				Name:   name,
+				Target: target,
+				Owner:  dname.Hdr.Name,
+				TTL:    dname.Hdr.Ttl,
+			})
+			name = target
+		case cname != nil:
+			aliases = append(aliases, &Alias{
+				Kind:   AliasCNAME,
+				Name:   name,
+				Target: dns.Fqdn(cname.Target),
+				Owner:  cname.Hdr.Name,
+				TTL:    cname.Hdr.Ttl,
+			})
+			name = dns.Fqdn(cname.Target)
+		default:
+			return name, aliases, false, nil
+		}
+	}
+}
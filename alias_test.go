@@ -0,0 +1,132 @@
+package dnsclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRRs(t *testing.T, lines ...string) []dns.RR {
+	t.Helper()
+	var rrs []dns.RR
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestFollowAliases(t *testing.T) {
+	// a name of 194 octets below x., whose substitution with a target of
+	// 66 octets overflows
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 3)
+	longTarget := strings.Repeat("b", 63) + ".y."
+
+	tests := []struct {
+		name     string
+		answer   []string
+		qname    string
+		stop     string
+		aliases  []string
+		answered bool
+		reason   DNSErr // if the chain is invalid
+		invalid  bool
+	}{
+		{name: "answer", qname: "www.example.",
+			answer:   []string{"www.example. 300 IN A 192.0.2.1"},
+			stop:     "www.example.",
+			answered: true},
+		{name: "cname", qname: "www.example.",
+			answer: []string{
+				"www.example. 300 IN CNAME cdn.example.net.",
+				"cdn.example.net. 300 IN A 192.0.2.1",
+			},
+			stop:     "cdn.example.net.",
+			aliases:  []string{"www.example. -> cdn.example.net. (CNAME)"},
+			answered: true},
+		{name: "cname to dname", qname: "www.example.",
+			answer: []string{
+				"www.example. 300 IN CNAME www.old.example.",
+				"old.example. 300 IN DNAME new.example.",
+				"www.old.example. 300 IN CNAME www.new.example.",
+				"www.new.example. 300 IN A 192.0.2.1",
+			},
+			stop: "www.new.example.",
+			aliases: []string{
+				"www.example. -> www.old.example. (CNAME)",
+				"www.old.example. -> www.new.example. (DNAME old.example.)",
+			},
+			answered: true},
+		{name: "dname without a synthesized cname", qname: "a.b.old.example.",
+			answer: []string{
+				"old.example. 300 IN DNAME new.example.",
+				"a.b.new.example. 300 IN A 192.0.2.1",
+			},
+			stop:     "a.b.new.example.",
+			aliases:  []string{"a.b.old.example. -> a.b.new.example. (DNAME old.example.)"},
+			answered: true},
+		{name: "chain without an answer", qname: "www.example.",
+			answer: []string{"www.example. 300 IN CNAME cdn.example.net."},
+			stop:   "cdn.example.net.",
+			aliases: []string{
+				"www.example. -> cdn.example.net. (CNAME)",
+			}},
+
+		{name: "mismatched synthesized cname", qname: "www.old.example.",
+			answer: []string{
+				"old.example. 300 IN DNAME new.example.",
+				"www.old.example. 300 IN CNAME evil.example.",
+				"evil.example. 300 IN A 192.0.2.1",
+			},
+			stop:    "www.old.example.",
+			reason:  DNSErrInvalidDNAME,
+			invalid: true},
+		{name: "dname substitution overflow", qname: long + "x.",
+			answer:  []string{"x. 300 IN DNAME " + longTarget},
+			stop:    long + "x.",
+			reason:  DNSErrInvalidDNAME,
+			invalid: true},
+		{name: "cname loop", qname: "a.example.",
+			answer: []string{
+				"a.example. 300 IN CNAME b.example.",
+				"b.example. 300 IN CNAME a.example.",
+			},
+			stop: "a.example.",
+			aliases: []string{
+				"a.example. -> b.example. (CNAME)",
+				"b.example. -> a.example. (CNAME)",
+			},
+			reason:  DNSErrInvalidCNAMEChain,
+			invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop, aliases, answered, reason := followAliases(mustRRs(t, tt.answer...), tt.qname, dns.TypeA)
+			if stop != tt.stop {
+				t.Errorf("stopped at %s, want %s", stop, tt.stop)
+			}
+			var hops []string
+			for _, a := range aliases {
+				hops = append(hops, a.String())
+			}
+			if strings.Join(hops, "\n") != strings.Join(tt.aliases, "\n") {
+				t.Errorf("got aliases\n%s\nwant\n%s", strings.Join(hops, "\n"), strings.Join(tt.aliases, "\n"))
+			}
+			if answered != tt.answered {
+				t.Errorf("answered: got %v, want %v", answered, tt.answered)
+			}
+			switch {
+			case reason == nil && tt.invalid:
+				t.Errorf("got no error, want %q", DNSErrToString[tt.reason])
+			case reason != nil && !tt.invalid:
+				t.Errorf("got error %q", DNSErrToString[*reason])
+			case reason != nil && *reason != tt.reason:
+				t.Errorf("got error %q, want %q", DNSErrToString[*reason], DNSErrToString[tt.reason])
+			}
+		})
+	}
+}
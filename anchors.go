@@ -0,0 +1,607 @@
+package dnsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// TrustAnchorState is the state of a key in a TrustAnchorStore, as defined in
+// RFC 5011, section 4.
+type TrustAnchorState int
+
+const (
+	// AnchorStart is the state of a key that the store doesn't know of
+	// (it appears only in events).
+	AnchorStart TrustAnchorState = iota
+	// AnchorAddPend is a new key whose add hold-down timer is running.
+	AnchorAddPend
+	// AnchorValid is a trusted key.
+	AnchorValid
+	// AnchorMissing is a trusted key that is no longer in the zone's
+	// DNSKEY RRset, but hasn't been revoked.  It is still trusted.
+	AnchorMissing
+	// AnchorRevoked is a key that the zone revoked; it is not trusted,
+	// and is kept until its remove hold-down timer expires.
+	AnchorRevoked
+	// AnchorRemoved is the state of a revoked key that the store has
+	// forgotten (it appears only in events).
+	AnchorRemoved
+)
+
+var TrustAnchorStateToString = map[TrustAnchorState]string{
+	AnchorStart:   "start",
+	AnchorAddPend: "addpend",
+	AnchorValid:   "valid",
+	AnchorMissing: "missing",
+	AnchorRevoked: "revoked",
+	AnchorRemoved: "removed",
+}
+
+func (s TrustAnchorState) String() string {
+	str, ok := TrustAnchorStateToString[s]
+	if !ok {
+		return fmt.Sprintf("TrustAnchorState(%d)", int(s))
+	}
+	return str
+}
+
+func parseTrustAnchorState(s string) (TrustAnchorState, error) {
+	for state, str := range TrustAnchorStateToString {
+		if str == s {
+			return state, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown trust anchor state %q", s)
+}
+
+const (
+	// DefaultAddHoldDown and DefaultRemoveHoldDown are the hold-down times
+	// of RFC 5011, section 2.4.1.
+	DefaultAddHoldDown    = 30 * 24 * time.Hour
+	DefaultRemoveHoldDown = 30 * 24 * time.Hour
+
+	// bounds on the active refresh interval (RFC 5011, section 2.3)
+	minAnchorRefresh = time.Hour
+	maxAnchorRefresh = 15 * 24 * time.Hour
+	maxAnchorRetry   = 24 * time.Hour
+)
+
+// TrustAnchorKey is a key that a TrustAnchorStore tracks.
+type TrustAnchorKey struct {
+	Zone      string
+	Key       *dns.DNSKEY
+	State     TrustAnchorState
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// HoldDownEnd is when an AnchorAddPend key becomes valid, or when an
+	// AnchorRevoked key is removed.
+	HoldDownEnd time.Time
+}
+
+// TrustAnchorEvent reports a key's change of state.
+type TrustAnchorEvent struct {
+	Zone   string
+	KeyTag uint16 // the key's tag, without the REVOKE flag
+	From   TrustAnchorState
+	To     TrustAnchorState
+	Time   time.Time
+}
+
+func (e *TrustAnchorEvent) String() string {
+	return fmt.Sprintf("%s key %d: %s -> %s", e.Zone, e.KeyTag, e.From, e.To)
+}
+
+type TrustAnchorConfig struct {
+	// Path is the file that the store's state is kept in.  If the file
+	// doesn't exist, it is created on the first Update.  If "", the state
+	// is only kept in memory.
+	Path string
+	// Anchors are the initial trust anchors, used for a zone that the
+	// file has no keys for.  If nil, DefaultTrustAnchors is used.
+	Anchors []*dns.DS
+	// If 0, DefaultAddHoldDown and DefaultRemoveHoldDown are used.
+	AddHoldDown    time.Duration
+	RemoveHoldDown time.Duration
+	// OnEvent, if set, is called for each change of a key's state, after
+	// the change is saved.
+	OnEvent func(*TrustAnchorEvent)
+	// Now returns the current time.  If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// TrustAnchorStore tracks the keys of the zones that have trust anchors, and
+// follows their rollovers as described in RFC 5011: a new key becomes
+// trusted once it has been seen, signed by a trusted key, throughout the add
+// hold-down time, and a key stops being trusted once the zone publishes it
+// revoked.  Update must be called periodically (or Run used) for the store
+// to see the rollovers.
+//
+// A TrustAnchorStore is safe for concurrent use.  To validate with its
+// anchors, set ValidatorConfig.TrustAnchorStore.
+type TrustAnchorStore struct {
+	config *TrustAnchorConfig
+
+	mu          sync.Mutex
+	seeds       map[string][]*dns.DS
+	keys        map[string][]*TrustAnchorKey
+	generation  int // incremented whenever the set of trusted keys changes
+	nextRefresh time.Time
+}
+
+// anchorRecord is how a TrustAnchorKey is saved.
+type anchorRecord struct {
+	Zone        string    `json:"zone"`
+	DNSKEY      string    `json:"dnskey"`
+	State       string    `json:"state"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	HoldDownEnd time.Time `json:"hold_down_end"`
+}
+
+// NewTrustAnchorStore returns a store with the state saved in config.Path,
+// if that file exists.
+func NewTrustAnchorStore(config *TrustAnchorConfig) (*TrustAnchorStore, error) {
+	s := &TrustAnchorStore{
+		config: config,
+		seeds:  make(map[string][]*dns.DS),
+		keys:   make(map[string][]*TrustAnchorKey),
+	}
+
+	anchors := config.Anchors
+	if anchors == nil {
+		anchors = DefaultTrustAnchors
+	}
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		s.seeds[zone] = append(s.seeds[zone], ds)
+	}
+
+	if config.Path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*anchorRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchor file %s: %w", config.Path, err)
+	}
+	for _, r := range records {
+		rr, err := dns.NewRR(r.DNSKEY)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor file %s: %w", config.Path, err)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor file %s: %q is not a DNSKEY record", config.Path, r.DNSKEY)
+		}
+		state, err := parseTrustAnchorState(r.State)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor file %s: %w", config.Path, err)
+		}
+		zone := dns.CanonicalName(r.Zone)
+		s.keys[zone] = append(s.keys[zone], &TrustAnchorKey{
+			Zone:        zone,
+			Key:         key,
+			State:       state,
+			FirstSeen:   r.FirstSeen,
+			LastSeen:    r.LastSeen,
+			HoldDownEnd: r.HoldDownEnd,
+		})
+	}
+	return s, nil
+}
+
+func (s *TrustAnchorStore) now() time.Time {
+	if s.config.Now != nil {
+		return s.config.Now()
+	}
+	return time.Now()
+}
+
+func (s *TrustAnchorStore) addHoldDown() time.Duration {
+	if s.config.AddHoldDown > 0 {
+		return s.config.AddHoldDown
+	}
+	return DefaultAddHoldDown
+}
+
+func (s *TrustAnchorStore) removeHoldDown() time.Duration {
+	if s.config.RemoveHoldDown > 0 {
+		return s.config.RemoveHoldDown
+	}
+	return DefaultRemoveHoldDown
+}
+
+// Keys returns (copies of) the keys that the store tracks for zone.
+func (s *TrustAnchorStore) Keys(zone string) []*TrustAnchorKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*TrustAnchorKey
+	for _, k := range s.keys[dns.CanonicalName(zone)] {
+		k := *k
+		keys = append(keys, &k)
+	}
+	return keys
+}
+
+// Anchors returns the current trust anchors: a DS record for each valid (or
+// missing) key, and the initial anchors of the zones that have no tracked
+// keys yet.
+func (s *TrustAnchorStore) Anchors() []*dns.DS {
+	m, _ := s.anchorMap()
+	var anchors []*dns.DS
+	for _, ds := range m {
+		anchors = append(anchors, ds...)
+	}
+	return anchors
+}
+
+// anchorMap returns the current trust anchors by zone, and the generation of
+// the set of trusted keys.
+func (s *TrustAnchorStore) anchorMap() (map[string][]*dns.DS, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string][]*dns.DS)
+	for zone, ds := range s.seeds {
+		if len(s.keys[zone]) == 0 {
+			m[zone] = ds
+		}
+	}
+	for zone, keys := range s.keys {
+		for _, k := range keys {
+			if k.State != AnchorValid && k.State != AnchorMissing {
+				continue
+			}
+			if ds := k.Key.ToDS(dns.SHA256); ds != nil {
+				m[zone] = append(m[zone], ds)
+			}
+		}
+	}
+	return m, s.generation
+}
+
+// NextRefresh returns when Update should next be called.
+func (s *TrustAnchorStore) NextRefresh() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextRefresh
+}
+
+// Run calls Update whenever a refresh is due, until ctx is done.  Update's
+// errors are logged with c's logger.
+func (s *TrustAnchorStore) Run(ctx context.Context, c Client) error {
+	for {
+		err := s.Update(ctx, c)
+		if err != nil {
+			c.GetConfig().logger().Warn("trust anchor update failed", "err", err)
+		}
+		if err := sleepContext(ctx, time.Until(s.NextRefresh())); err != nil {
+			return err
+		}
+	}
+}
+
+// Update fetches the DNSKEY RRset of each zone that has trust anchors,
+// through c, and applies the RFC 5011 state transitions to the zone's keys.
+// The new state is saved before the events are reported.
+func (s *TrustAnchorStore) Update(ctx context.Context, c Client) error {
+	s.mu.Lock()
+	zones := make(map[string]bool)
+	for zone := range s.seeds {
+		zones[zone] = true
+	}
+	for zone := range s.keys {
+		zones[zone] = true
+	}
+	s.mu.Unlock()
+
+	var names []string
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	var events []*TrustAnchorEvent
+	refresh := maxAnchorRefresh
+	for _, zone := range names {
+		zoneEvents, interval, err := s.refreshZone(ctx, c, zone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", zone, err))
+		}
+		events = append(events, zoneEvents...)
+		refresh = min(refresh, interval)
+	}
+
+	s.mu.Lock()
+	s.nextRefresh = s.now().Add(refresh)
+	if len(events) > 0 {
+		if err := s.save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.mu.Unlock()
+
+	logger := c.GetConfig().logger()
+	for _, e := range events {
+		logger.Info("trust anchor state change", "zone", e.Zone, "keytag", e.KeyTag,
+			"from", e.From.String(), "to", e.To.String())
+		if s.config.OnEvent != nil {
+			s.config.OnEvent(e)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// retryInterval is the refresh interval after a failed query (RFC 5011,
+// section 2.3).
+func retryInterval(ttl time.Duration) time.Duration {
+	return max(minAnchorRefresh, min(maxAnchorRetry, ttl/10))
+}
+
+// refreshInterval is the active refresh interval (RFC 5011, section 2.3).
+func refreshInterval(ttl time.Duration, sigs []*dns.RRSIG, now time.Time) time.Duration {
+	d := min(maxAnchorRefresh, ttl/2)
+	for _, sig := range sigs {
+		expires := time.Unix(int64(sig.Expiration), 0)
+		d = min(d, expires.Sub(now)/2)
+	}
+	return max(minAnchorRefresh, d)
+}
+
+// sameKey reports whether a and b are the same key, ignoring their flags.
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.Protocol == b.Protocol && a.PublicKey == b.PublicKey
+}
+
+// keyTag returns key's tag as it is without the REVOKE flag.
+func keyTag(key *dns.DNSKEY) uint16 {
+	k := *key
+	k.Flags &^= dns.REVOKE
+	return k.KeyTag()
+}
+
+// trustedKeys returns the keys that may sign zone's DNSKEY RRset: the valid
+// and missing keys or, if there are no tracked keys, those of keys that match
+// the initial anchors.
+func (s *TrustAnchorStore) trustedKeys(zone string, keys []*dns.DNSKEY) (trusted []*dns.DNSKEY, bootstrap bool) {
+	if len(s.keys[zone]) > 0 {
+		for _, k := range s.keys[zone] {
+			if k.State == AnchorValid || k.State == AnchorMissing {
+				trusted = append(trusted, k.Key)
+			}
+		}
+		return trusted, false
+	}
+
+	for _, key := range keys {
+		if key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		for _, ds := range s.seeds[zone] {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			digest := key.ToDS(ds.DigestType)
+			if digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	return trusted, true
+}
+
+// refreshZone applies the state transitions for zone, and returns when the
+// zone should next be refreshed.
+func (s *TrustAnchorStore) refreshZone(ctx context.Context, c Client, zone string) ([]*TrustAnchorEvent, time.Duration, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(zone, dns.TypeDNSKEY)
+	req.RecursionDesired = c.GetConfig().RecursionDesired
+	req.CheckingDisabled = true
+	req.SetEdns0(4096, true)
+
+	resp, err := queryContext(ctx, c, req)
+	if err != nil {
+		return nil, minAnchorRefresh, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, minAnchorRefresh, fmt.Errorf("DNSKEY query got rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	var rrset []dns.RR
+	var keys []*dns.DNSKEY
+	for _, key := range msgutil.CollectRRs[*dns.DNSKEY](resp.Answer) {
+		if equalNames(key.Hdr.Name, zone) {
+			rrset = append(rrset, key)
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, minAnchorRefresh, errors.New("there are no DNSKEY records")
+	}
+	ttl := time.Duration(keys[0].Hdr.Ttl) * time.Second
+	sigs := sigsFor(resp.Answer, zone, dns.TypeDNSKEY)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trusted, bootstrap := s.trustedKeys(zone, keys)
+	if len(trusted) == 0 {
+		return nil, retryInterval(ttl), errors.New("no trusted key is in the DNSKEY RRset")
+	}
+	// RFC 5011, section 2.2: only an RRset signed by a trusted key counts.
+	// An RRset signed only by revoked trusted keys is good for nothing but
+	// their revocation.
+	revokeOnly := false
+	if err := verifyRRset(rrset, sigs, trusted, now); err != nil {
+		var revoked []*dns.DNSKEY
+		for _, key := range keys {
+			if key.Flags&dns.REVOKE != 0 && containsKey(trusted, key, false) {
+				revoked = append(revoked, key)
+			}
+		}
+		if len(revoked) == 0 || verifyRRset(rrset, sigs, revoked, now) != nil {
+			return nil, retryInterval(ttl), fmt.Errorf("the DNSKEY RRset is not signed by a trusted key: %w", err)
+		}
+		revokeOnly = true
+	}
+
+	var events []*TrustAnchorEvent
+	transition := func(k *TrustAnchorKey, to TrustAnchorState) {
+		events = append(events, &TrustAnchorEvent{
+			Zone: zone, KeyTag: keyTag(k.Key), From: k.State, To: to, Time: now,
+		})
+		k.State = to
+	}
+
+	tracked := s.keys[zone]
+	find := func(key *dns.DNSKEY) *TrustAnchorKey {
+		for _, k := range tracked {
+			if sameKey(k.Key, key) {
+				return k
+			}
+		}
+		return nil
+	}
+
+	seen := make(map[*TrustAnchorKey]bool)
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		k := find(key)
+		if k != nil {
+			seen[k] = true
+			k.LastSeen = now
+		}
+
+		if key.Flags&dns.REVOKE != 0 {
+			// a revocation only counts if the revoked key signed it
+			// (RFC 5011, section 2.1)
+			if k == nil || k.State == AnchorRevoked ||
+				verifyRRset(rrset, sigs, []*dns.DNSKEY{key}, now) != nil {
+				continue
+			}
+			k.Key = key
+			k.HoldDownEnd = now.Add(s.removeHoldDown())
+			transition(k, AnchorRevoked)
+			continue
+		}
+
+		switch {
+		case revokeOnly:
+		case k == nil:
+			k = &TrustAnchorKey{Zone: zone, Key: key, State: AnchorStart, FirstSeen: now, LastSeen: now}
+			tracked = append(tracked, k)
+			seen[k] = true
+			if bootstrap && containsKey(trusted, key, true) {
+				transition(k, AnchorValid)
+			} else {
+				k.HoldDownEnd = now.Add(max(s.addHoldDown(), ttl))
+				transition(k, AnchorAddPend)
+			}
+		case k.State == AnchorAddPend && !now.Before(k.HoldDownEnd):
+			transition(k, AnchorValid)
+		case k.State == AnchorMissing:
+			transition(k, AnchorValid)
+		}
+	}
+
+	var kept []*TrustAnchorKey
+	for _, k := range tracked {
+		switch {
+		case revokeOnly:
+		case k.State == AnchorAddPend && !seen[k]:
+			// the key vanished before it became trusted
+			transition(k, AnchorStart)
+			continue
+		case k.State == AnchorValid && !seen[k]:
+			transition(k, AnchorMissing)
+		case k.State == AnchorRevoked && !now.Before(k.HoldDownEnd):
+			transition(k, AnchorRemoved)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	s.keys[zone] = kept
+
+	if len(events) > 0 {
+		s.generation++
+	}
+	return events, refreshInterval(ttl, sigs, now), nil
+}
+
+// containsKey reports whether key is in keys, optionally with the same flags.
+func containsKey(keys []*dns.DNSKEY, key *dns.DNSKEY, sameFlags bool) bool {
+	for _, k := range keys {
+		if sameKey(k, key) && (!sameFlags || k.Flags == key.Flags) {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the store's state to its file, atomically.  s.mu must be held.
+func (s *TrustAnchorStore) save() error {
+	if s.config.Path == "" {
+		return nil
+	}
+
+	var records []*anchorRecord
+	var zones []string
+	for zone := range s.keys {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		for _, k := range s.keys[zone] {
+			records = append(records, &anchorRecord{
+				Zone:        zone,
+				DNSKEY:      k.Key.String(),
+				State:       k.State.String(),
+				FirstSeen:   k.FirstSeen,
+				LastSeen:    k.LastSeen,
+				HoldDownEnd: k.HoldDownEnd,
+			})
+		}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.config.Path), filepath.Base(s.config.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save trust anchors: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.config.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save trust anchors: %w", err)
+	}
+	return nil
+}
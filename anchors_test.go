@@ -0,0 +1,302 @@
+package dnsclient
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// anchorKey is a key of the zone that an anchorZone serves.
+type anchorKey struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newAnchorKey(t *testing.T, name string) *anchorKey {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &anchorKey{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// revoked returns k with the REVOKE flag set.
+func (k *anchorKey) revoked() *anchorKey {
+	key := *k.key
+	key.Flags |= dns.REVOKE
+	return &anchorKey{name: k.name, key: &key, priv: k.priv}
+}
+
+// anchorZone is a Client that answers DNSKEY queries for example. with the
+// published keys, signed by the signers, as of the store's clock.
+type anchorZone struct {
+	t         *testing.T
+	now       time.Time
+	published []*anchorKey
+	signers   []*anchorKey
+}
+
+func (z *anchorZone) GetConfig() *Config { return &Config{} }
+func (z *anchorZone) Dial() error        { return nil }
+func (z *anchorZone) Close() error       { return nil }
+
+func (z *anchorZone) Query(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	var rrset []dns.RR
+	for _, k := range z.published {
+		rrset = append(rrset, k.key)
+	}
+	resp.Answer = rrset
+	for _, k := range z.signers {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: "example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+			KeyTag:     k.key.KeyTag(),
+			SignerName: "example.",
+			Algorithm:  k.key.Algorithm,
+			Inception:  uint32(z.now.Add(-time.Hour).Unix()),
+			Expiration: uint32(z.now.AddDate(0, 0, 60).Unix()),
+		}
+		if err := sig.Sign(k.priv, rrset); err != nil {
+			z.t.Fatal(err)
+		}
+		resp.Answer = append(resp.Answer, sig)
+	}
+	return resp, nil
+}
+
+// publish sets the keys that the zone publishes and those that sign them.
+func (z *anchorZone) publish(published, signers []*anchorKey) {
+	z.published = published
+	z.signers = signers
+}
+
+type anchorTest struct {
+	t     *testing.T
+	zone  *anchorZone
+	store *TrustAnchorStore
+	keys  []*anchorKey
+}
+
+// newAnchorTest returns a store whose initial anchor is the first of the
+// named keys.
+func newAnchorTest(t *testing.T, path string, names ...string) *anchorTest {
+	t.Helper()
+	at := &anchorTest{t: t, zone: &anchorZone{t: t, now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	for _, name := range names {
+		at.keys = append(at.keys, newAnchorKey(t, name))
+	}
+	at.store = at.newStore(path)
+	return at
+}
+
+func (at *anchorTest) newStore(path string) *TrustAnchorStore {
+	at.t.Helper()
+	s, err := NewTrustAnchorStore(&TrustAnchorConfig{
+		Path:    path,
+		Anchors: []*dns.DS{at.keys[0].key.ToDS(dns.SHA256)},
+		Now:     func() time.Time { return at.zone.now },
+	})
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	return s
+}
+
+// update runs an Update after d and returns its events, naming the keys.
+func (at *anchorTest) update(d time.Duration) []string {
+	at.t.Helper()
+	at.zone.now = at.zone.now.Add(d)
+	var events []string
+	at.store.config.OnEvent = func(e *TrustAnchorEvent) {
+		for _, k := range at.keys {
+			if keyTag(k.key) == e.KeyTag {
+				events = append(events, fmt.Sprintf("%s %s -> %s", k.name, e.From, e.To))
+			}
+		}
+	}
+	if err := at.store.Update(context.Background(), at.zone); err != nil {
+		at.t.Fatal(err)
+	}
+	return events
+}
+
+// states returns the states of the store's keys, by name.
+func (at *anchorTest) states() map[string]TrustAnchorState {
+	states := make(map[string]TrustAnchorState)
+	for _, tk := range at.store.Keys("example.") {
+		for _, k := range at.keys {
+			if sameKey(k.key, tk.Key) {
+				states[k.name] = tk.State
+			}
+		}
+	}
+	return states
+}
+
+func (at *anchorTest) expect(events []string, want ...string) {
+	at.t.Helper()
+	if strings.Join(events, ", ") != strings.Join(want, ", ") {
+		at.t.Errorf("got events %q, want %q", events, want)
+	}
+}
+
+const day = 24 * time.Hour
+
+func TestTrustAnchorStoreAddHoldDown(t *testing.T) {
+	at := newAnchorTest(t, "", "k1", "k2")
+	k1, k2 := at.keys[0], at.keys[1]
+
+	at.zone.publish([]*anchorKey{k1}, []*anchorKey{k1})
+	at.expect(at.update(0), "k1 start -> valid")
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.expect(at.update(day), "k2 start -> addpend")
+	if n := len(at.store.Anchors()); n != 1 {
+		t.Errorf("got %d anchors during the hold-down, want 1", n)
+	}
+	at.expect(at.update(DefaultAddHoldDown - time.Hour))
+	at.expect(at.update(time.Hour), "k2 addpend -> valid")
+	if n := len(at.store.Anchors()); n != 2 {
+		t.Errorf("got %d anchors after the hold-down, want 2", n)
+	}
+}
+
+func TestTrustAnchorStoreAddPendVanishes(t *testing.T) {
+	at := newAnchorTest(t, "", "k1", "k2")
+	k1, k2 := at.keys[0], at.keys[1]
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.expect(at.update(0), "k1 start -> valid", "k2 start -> addpend")
+
+	at.zone.publish([]*anchorKey{k1}, []*anchorKey{k1})
+	at.expect(at.update(day), "k2 addpend -> start")
+	if _, ok := at.states()["k2"]; ok {
+		t.Errorf("the store still tracks k2: %v", at.states())
+	}
+
+	// k2 starts over
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.expect(at.update(day), "k2 start -> addpend")
+	at.expect(at.update(DefaultAddHoldDown - time.Hour))
+}
+
+func TestTrustAnchorStoreMissing(t *testing.T) {
+	at := newAnchorTest(t, "", "k1", "k2")
+	k1, k2 := at.keys[0], at.keys[1]
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.update(0)
+	at.expect(at.update(DefaultAddHoldDown), "k2 addpend -> valid")
+
+	at.zone.publish([]*anchorKey{k2}, []*anchorKey{k2})
+	at.expect(at.update(day), "k1 valid -> missing")
+	// a missing key is still trusted
+	if n := len(at.store.Anchors()); n != 2 {
+		t.Errorf("got %d anchors, want 2", n)
+	}
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.expect(at.update(day), "k1 missing -> valid")
+}
+
+func TestTrustAnchorStoreRevoke(t *testing.T) {
+	at := newAnchorTest(t, "", "k1", "k2")
+	k1, k2 := at.keys[0], at.keys[1]
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.update(0)
+	at.expect(at.update(DefaultAddHoldDown), "k2 addpend -> valid")
+
+	// a revocation that k1 didn't sign is ignored
+	at.zone.publish([]*anchorKey{k1.revoked(), k2}, []*anchorKey{k2})
+	at.expect(at.update(day))
+	if state := at.states()["k1"]; state != AnchorValid {
+		t.Errorf("k1 is %s, want %s", state, AnchorValid)
+	}
+
+	at.zone.publish([]*anchorKey{k1.revoked(), k2}, []*anchorKey{k1.revoked(), k2})
+	at.expect(at.update(day), "k1 valid -> revoked")
+	if n := len(at.store.Anchors()); n != 1 {
+		t.Errorf("got %d anchors, want 1", n)
+	}
+
+	at.zone.publish([]*anchorKey{k2}, []*anchorKey{k2})
+	at.expect(at.update(DefaultRemoveHoldDown - time.Hour))
+	at.expect(at.update(time.Hour), "k1 revoked -> removed")
+	if _, ok := at.states()["k1"]; ok {
+		t.Errorf("the store still tracks k1: %v", at.states())
+	}
+}
+
+func TestTrustAnchorStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anchors.json")
+	at := newAnchorTest(t, path, "k1", "k2", "k3")
+	k1, k2, k3 := at.keys[0], at.keys[1], at.keys[2]
+
+	at.zone.publish([]*anchorKey{k1, k2}, []*anchorKey{k1})
+	at.update(0)
+	at.update(DefaultAddHoldDown)
+	at.zone.publish([]*anchorKey{k1.revoked(), k2, k3}, []*anchorKey{k1.revoked(), k2})
+	at.expect(at.update(day), "k1 valid -> revoked", "k3 start -> addpend")
+
+	loaded := at.newStore(path)
+	want := at.store.Keys("example.")
+	got := loaded.Keys("example.")
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d keys, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Zone != w.Zone || g.Key.String() != w.Key.String() || g.State != w.State ||
+			!g.FirstSeen.Equal(w.FirstSeen) || !g.LastSeen.Equal(w.LastSeen) ||
+			!g.HoldDownEnd.Equal(w.HoldDownEnd) {
+			t.Errorf("loaded %+v, want %+v", g, w)
+		}
+	}
+
+	// the loaded store carries on where the first left off
+	at.store = loaded
+	at.expect(at.update(DefaultAddHoldDown), "k3 addpend -> valid", "k1 revoked -> removed")
+}
+
+func TestStaleZoneTrust(t *testing.T) {
+	at := newAnchorTest(t, "", "k1")
+	at.zone.publish(at.keys, at.keys)
+	at.update(0)
+
+	c := NewValidatingClient(at.zone, &ValidatorConfig{TrustAnchorStore: at.store})
+	_, old := c.trustAnchors()
+	stale := &validator{c: c, generation: old}
+
+	// the anchors change while the stale validation is under way
+	at.store.mu.Lock()
+	at.store.generation++
+	at.store.mu.Unlock()
+	_, current := c.trustAnchors()
+	fresh := &validator{c: c, generation: current}
+
+	now := time.Now()
+	stale.storeTrust("stale.", &zoneTrust{validation: &Validation{}, expires: now.Add(time.Hour)})
+	fresh.storeTrust("fresh.", &zoneTrust{validation: &Validation{}, expires: now.Add(time.Hour)})
+	if c.cachedTrust("stale.", now) != nil {
+		t.Errorf("the zone trust of an old generation was cached")
+	}
+	if c.cachedTrust("fresh.", now) == nil {
+		t.Errorf("the zone trust of the current generation wasn't cached")
+	}
+}
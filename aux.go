@@ -11,18 +11,10 @@ import (
 	"github.com/syslab-wm/mu"
 )
 
-func lookupA(c Client, domain string) ([]*dns.A, error) {
-	resp, err := Lookup(c, domain, dns.TypeA)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.A](resp.Answer), nil
-}
-
 func getA(c Client, domain string) ([]netip.Addr, error) {
 	var addrs []netip.Addr
 
-	as, err := lookupA(c, domain)
+	as, err := LookupRRs[*dns.A](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -42,18 +34,10 @@ func getA(c Client, domain string) ([]netip.Addr, error) {
 	return addrs, nil
 }
 
-func lookupAAAA(c Client, domain string) ([]*dns.AAAA, error) {
-	resp, err := Lookup(c, domain, dns.TypeAAAA)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.AAAA](resp.Answer), nil
-}
-
 func getAAAA(c Client, domain string) ([]netip.Addr, error) {
 	var addrs []netip.Addr
 
-	as, err := lookupAAAA(c, domain)
+	as, err := LookupRRs[*dns.AAAA](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -120,18 +104,10 @@ func (ns *NameServer) String() string {
 	return fmt.Sprintf("name: %s, addrs: %v", ns.Name, ns.Addrs)
 }
 
-func lookupNS(c Client, domain string) ([]*dns.NS, error) {
-	resp, err := Lookup(c, domain, dns.TypeNS)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.NS](resp.Answer), nil
-}
-
 func getNS(c Client, domain string) ([]string, error) {
 	var nameServers []string
 
-	nses, err := lookupNS(c, domain)
+	nses, err := LookupRRs[*dns.NS](c, domain)
 	if err == nil {
 		nameServers = functools.Map[*dns.NS, string](nses, func(ns *dns.NS) string {
 			return ns.Ns
@@ -142,8 +118,8 @@ func getNS(c Client, domain string) ([]string, error) {
 	// check if the query returned RCode success, but failed because there
 	// simply wasn't an answer.  In such a case, see if the Authority section
 	// has an SOA entry, and return the nameserver in that entry
-	e, ok := err.(*DNSError)
-	if !ok {
+	var e *DNSError
+	if !errors.As(err, &e) {
 		return nil, err
 	}
 
@@ -164,6 +140,8 @@ func getNS(c Client, domain string) ([]string, error) {
 	nameServers = functools.Map[*dns.SOA, string](soas, func(soa *dns.SOA) string {
 		return soa.Ns
 	})
+	c.GetConfig().logger().Debug("no NS records; using SOA nameservers", "domain", domain,
+		"nameservers", nameServers, "authenticated", e.Authenticated())
 
 	return nameServers, nil
 }
@@ -180,6 +158,8 @@ func GetNameServers(c Client, name string) ([]*NameServer, error) {
 	for _, nameServer := range nameServers {
 		addrs, err := GetIPs(c, nameServer)
 		if err != nil {
+			c.GetConfig().logger().Debug("failed to resolve nameserver", "nameserver", nameServer,
+				"err", err)
 			addrErrs = append(addrErrs, err)
 			continue
 		}
@@ -0,0 +1,318 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin cycles through the upstreams in order.
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceWeightedRandom picks an upstream at random, in proportion to
+	// its Weight.
+	BalanceWeightedRandom
+	// BalanceLeastLatency picks the upstream with the lowest smoothed
+	// (EWMA) round-trip time.  Upstreams without an RTT sample are tried
+	// first, and an upstream that hasn't been picked for the
+	// ProbeInterval is tried again, so that one that was slow or failing
+	// can show that it has recovered.
+	BalanceLeastLatency
+)
+
+var BalanceStrategyToString = map[BalanceStrategy]string{
+	BalanceRoundRobin:     "round-robin",
+	BalanceWeightedRandom: "weighted-random",
+	BalanceLeastLatency:   "least-latency",
+}
+
+func (s BalanceStrategy) String() string {
+	str, ok := BalanceStrategyToString[s]
+	if !ok {
+		return fmt.Sprintf("BalanceStrategy(%d)", int(s))
+	}
+	return str
+}
+
+const (
+	defaultEWMAAlpha     = 0.3
+	defaultProbeInterval = 30 * time.Second
+)
+
+type BalanceUpstream struct {
+	Client Client
+	// Weight is only used by BalanceWeightedRandom.  A Weight <= 0 counts
+	// as 1.
+	Weight int
+	// MaxInFlight is the maximum number of queries that may be outstanding
+	// to this upstream at once; a MaxInFlight <= 0 counts as 1.  Clients
+	// that are not safe for concurrent use (Do53Client, DoTClient) must
+	// keep the limit at 1.
+	MaxInFlight int
+}
+
+type BalanceConfig struct {
+	Config
+	Upstreams []BalanceUpstream
+	Strategy  BalanceStrategy
+	// EWMAAlpha is the weight that BalanceLeastLatency gives to the newest
+	// RTT sample.  If zero, 0.3 is used.
+	EWMAAlpha float64
+	// ProbeInterval is how long BalanceLeastLatency goes without picking
+	// an upstream before it picks it regardless of its RTT.  If zero, 30
+	// seconds is used.
+	ProbeInterval time.Duration
+}
+
+// BalanceStats is a snapshot of the state that a BalanceClient keeps for one
+// of its upstreams.
+type BalanceStats struct {
+	InFlight int
+	RTT      time.Duration // EWMA; zero if there are no samples yet
+	Queries  int
+	Errors   int
+}
+
+type balanceUpstream struct {
+	BalanceUpstream
+	dialed     bool
+	lastPicked time.Time
+	BalanceStats
+}
+
+func (u *balanceUpstream) available() bool {
+	return u.dialed && u.InFlight < max(u.MaxInFlight, 1)
+}
+
+// BalanceClient spreads queries over a pool of upstreams.  Unlike the
+// single-upstream clients, a BalanceClient is safe for concurrent use:
+// queries block while every upstream is at its MaxInFlight limit (or until
+// their context is done).
+type BalanceClient struct {
+	config    *BalanceConfig
+	mu        sync.Mutex
+	upstreams []*balanceUpstream
+	next      int // for BalanceRoundRobin
+	rand      *rand.Rand
+	// released is closed (and replaced) whenever a slot frees up, to wake
+	// the queries that are waiting for one
+	released chan struct{}
+}
+
+func NewBalanceClient(config *BalanceConfig) *BalanceClient {
+	c := &BalanceClient{
+		config:   config,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		released: make(chan struct{}),
+	}
+	for _, upstream := range config.Upstreams {
+		c.upstreams = append(c.upstreams, &balanceUpstream{BalanceUpstream: upstream})
+	}
+	return c
+}
+
+func (c *BalanceClient) GetConfig() *Config {
+	return &c.config.Config
+}
+
+// Dial dials every upstream.  It is only an error if none of the upstreams
+// could be dialed; the upstreams that failed are left out of the pool.
+func (c *BalanceClient) Dial() error {
+	var errs []error
+	ok := false
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, u := range c.upstreams {
+		err := u.Client.Dial()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstream %d: %w", i, err))
+			continue
+		}
+		u.dialed = true
+		ok = true
+	}
+	if !ok {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (c *BalanceClient) Close() error {
+	var errs []error
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, u := range c.upstreams {
+		if !u.dialed {
+			continue
+		}
+		u.dialed = false
+		err := u.Client.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstream %d: %w", i, err))
+		}
+	}
+	// wake up any queries waiting for a slot so that they can fail
+	c.wake()
+	return errors.Join(errs...)
+}
+
+// Stats returns a snapshot of the per-upstream state, in the same order as
+// BalanceConfig.Upstreams.
+func (c *BalanceClient) Stats() []BalanceStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]BalanceStats, len(c.upstreams))
+	for i, u := range c.upstreams {
+		stats[i] = u.BalanceStats
+	}
+	return stats
+}
+
+// pick selects an available upstream according to the strategy, or returns
+// nil if every upstream is at its limit.  c.mu must be held.
+func (c *BalanceClient) pick() *balanceUpstream {
+	switch c.config.Strategy {
+	case BalanceRoundRobin:
+		n := len(c.upstreams)
+		for k := 0; k < n; k++ {
+			i := (c.next + k) % n
+			if c.upstreams[i].available() {
+				c.next = (i + 1) % n
+				return c.upstreams[i]
+			}
+		}
+	case BalanceWeightedRandom:
+		total := 0
+		for _, u := range c.upstreams {
+			if u.available() {
+				total += max(u.Weight, 1)
+			}
+		}
+		if total == 0 {
+			return nil
+		}
+		r := c.rand.Intn(total)
+		for _, u := range c.upstreams {
+			if !u.available() {
+				continue
+			}
+			r -= max(u.Weight, 1)
+			if r < 0 {
+				return u
+			}
+		}
+	case BalanceLeastLatency:
+		probeInterval := c.config.ProbeInterval
+		if probeInterval == 0 {
+			probeInterval = defaultProbeInterval
+		}
+		now := time.Now()
+		var best *balanceUpstream
+		for _, u := range c.upstreams {
+			if !u.available() {
+				continue
+			}
+			if u.RTT == 0 || now.Sub(u.lastPicked) >= probeInterval {
+				return u
+			}
+			if best == nil || u.RTT < best.RTT ||
+				(u.RTT == best.RTT && u.InFlight < best.InFlight) {
+				best = u
+			}
+		}
+		return best
+	}
+	return nil
+}
+
+// wake wakes the queries that are waiting for a slot.  c.mu must be held.
+func (c *BalanceClient) wake() {
+	close(c.released)
+	c.released = make(chan struct{})
+}
+
+func (c *BalanceClient) acquire(ctx context.Context) (*balanceUpstream, error) {
+	for {
+		c.mu.Lock()
+		anyDialed := false
+		for _, u := range c.upstreams {
+			anyDialed = anyDialed || u.dialed
+		}
+		if !anyDialed {
+			c.mu.Unlock()
+			return nil, errors.New("no upstream is available")
+		}
+
+		u := c.pick()
+		if u != nil {
+			u.InFlight++
+			u.lastPicked = time.Now()
+			c.mu.Unlock()
+			return u, nil
+		}
+		released := c.released
+		c.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *BalanceClient) release(u *balanceUpstream, rtt time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u.InFlight--
+	u.Queries++
+	if err != nil {
+		u.Errors++
+		// a failed upstream shouldn't look fast just because it failed
+		// fast, but it shouldn't look slower than a timeout either, or a
+		// few failures in a row would keep it out for good
+		rtt = max(rtt, c.config.Timeout)
+	}
+
+	alpha := c.config.EWMAAlpha
+	if alpha == 0 {
+		alpha = defaultEWMAAlpha
+	}
+	if u.RTT == 0 {
+		u.RTT = rtt
+	} else {
+		u.RTT = time.Duration(alpha*float64(rtt) + (1-alpha)*float64(u.RTT))
+	}
+
+	c.wake()
+}
+
+func (c *BalanceClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *BalanceClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	u, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := queryContext(ctx, u.Client, req)
+	c.release(u, time.Since(start), err)
+
+	return resp, err
+}
@@ -0,0 +1,231 @@
+package dnsclient_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+)
+
+func newBalanceClient(t *testing.T, config *dnsclient.BalanceConfig) *dnsclient.BalanceClient {
+	t.Helper()
+	c := dnsclient.NewBalanceClient(config)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func balanceQuery(ctx context.Context, c *dnsclient.BalanceClient) error {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, err := c.QueryContext(ctx, req)
+	return err
+}
+
+// queryCounts returns the number of queries that each server received.
+func queryCounts(servers []*dnstest.Server) []int {
+	var counts []int
+	for _, s := range servers {
+		counts = append(counts, len(s.Queries()))
+	}
+	return counts
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	var servers []*dnstest.Server
+	var upstreams []dnsclient.BalanceUpstream
+	for i := 0; i < 3; i++ {
+		s := newTestServer(t, raceZone)
+		servers = append(servers, s)
+		upstreams = append(upstreams, dnsclient.BalanceUpstream{Client: dnsclient.NewDo53Client(s.Do53Config())})
+	}
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{Upstreams: upstreams})
+
+	for i := 0; i < 6; i++ {
+		if err := balanceQuery(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+		want := i/3 + 1
+		if n := len(servers[i%3].Queries()); n != want {
+			t.Errorf("query %d: server %d has %d queries, want %d", i, i%3, n, want)
+		}
+	}
+}
+
+func TestBalanceWeightedRandom(t *testing.T) {
+	light := newTestServer(t, raceZone)
+	heavy := newTestServer(t, raceZone)
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{
+		Strategy: dnsclient.BalanceWeightedRandom,
+		Upstreams: []dnsclient.BalanceUpstream{
+			{Client: dnsclient.NewDo53Client(light.Do53Config()), Weight: 1},
+			{Client: dnsclient.NewDo53Client(heavy.Do53Config()), Weight: 9},
+		},
+	})
+
+	const n = 400
+	for i := 0; i < n; i++ {
+		if err := balanceQuery(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expect about 40 and 360
+	counts := queryCounts([]*dnstest.Server{light, heavy})
+	if counts[0] < 10 || counts[0] > 100 || counts[0]+counts[1] != n {
+		t.Errorf("got query counts %v for weights 1 and 9", counts)
+	}
+}
+
+func TestBalanceLeastLatency(t *testing.T) {
+	slow := newTestServer(t, raceZone)
+	slow.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{Delay: 50 * time.Millisecond}})
+	fast := newTestServer(t, raceZone)
+	servers := []*dnstest.Server{slow, fast}
+
+	const probeInterval = 300 * time.Millisecond
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{
+		Strategy:      dnsclient.BalanceLeastLatency,
+		ProbeInterval: probeInterval,
+		Upstreams: []dnsclient.BalanceUpstream{
+			{Client: dnsclient.NewDo53Client(slow.Do53Config())},
+			{Client: dnsclient.NewDo53Client(fast.Do53Config())},
+		},
+	})
+
+	// each upstream is tried once, and then the fast one is preferred
+	for i := 0; i < 10; i++ {
+		if err := balanceQuery(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := queryCounts(servers); counts[0] != 1 || counts[1] != 9 {
+		t.Errorf("got query counts %v, want [1 9]", counts)
+	}
+
+	// once the probe interval has passed, the slow upstream gets another
+	// chance
+	time.Sleep(probeInterval)
+	if err := balanceQuery(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if counts := queryCounts(servers); counts[0] != 2 {
+		t.Errorf("got query counts %v, want the slow upstream probed", counts)
+	}
+}
+
+func TestBalanceFailurePenalty(t *testing.T) {
+	s := newTestServer(t, raceZone)
+	s.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{Drop: true}})
+	config := s.Do53Config()
+	config.Timeout = 50 * time.Millisecond
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{
+		Config:    dnsclient.Config{Timeout: config.Timeout},
+		Strategy:  dnsclient.BalanceLeastLatency,
+		Upstreams: []dnsclient.BalanceUpstream{{Client: dnsclient.NewDo53Client(config)}},
+	})
+
+	for i := 0; i < 8; i++ {
+		if err := balanceQuery(context.Background(), c); err == nil {
+			t.Fatal("a dropped query succeeded")
+		}
+	}
+	// the penalty doesn't grow with each failure
+	stats := c.Stats()[0]
+	if stats.Errors != 8 || stats.RTT > 2*config.Timeout {
+		t.Errorf("unexpected stats after 8 failures: %+v", stats)
+	}
+}
+
+// concurrencyCounter tracks the peak number of concurrent queries through
+// it.
+type concurrencyCounter struct {
+	mu        sync.Mutex
+	current   int
+	peak      int
+	completed int
+}
+
+func (cc *concurrencyCounter) middleware() dnsclient.Middleware {
+	return dnsclient.Intercept(func(req *dns.Msg, next dnsclient.QueryFunc) (*dns.Msg, error) {
+		cc.mu.Lock()
+		cc.current++
+		cc.peak = max(cc.peak, cc.current)
+		cc.mu.Unlock()
+		defer func() {
+			cc.mu.Lock()
+			cc.current--
+			cc.completed++
+			cc.mu.Unlock()
+		}()
+		return next(req)
+	})
+}
+
+func TestBalanceMaxInFlight(t *testing.T) {
+	s := newTestServer(t, raceZone)
+	s.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{Delay: 50 * time.Millisecond}})
+
+	var cc concurrencyCounter
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{
+		Upstreams: []dnsclient.BalanceUpstream{{
+			Client:      dnsclient.Chain(dnsclient.NewDoHClient(s.DoHConfig()), cc.middleware()),
+			MaxInFlight: 2,
+		}},
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- balanceQuery(context.Background(), c)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cc.peak != 2 || cc.completed != 6 {
+		t.Errorf("got a peak of %d concurrent queries (%d completed), want 2 (6)", cc.peak, cc.completed)
+	}
+}
+
+func TestBalanceWaitRespectsContext(t *testing.T) {
+	s := newTestServer(t, raceZone)
+	s.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{Delay: 500 * time.Millisecond}})
+	c := newBalanceClient(t, &dnsclient.BalanceConfig{
+		Upstreams: []dnsclient.BalanceUpstream{{Client: dnsclient.NewDoHClient(s.DoHConfig())}},
+	})
+
+	// occupy the only slot
+	done := make(chan error)
+	go func() { done <- balanceQuery(context.Background(), c) }()
+	for c.Stats()[0].InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := balanceQuery(ctx, c)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("the query waited %v for a slot", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
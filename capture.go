@@ -0,0 +1,210 @@
+package dnsclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/pcapng"
+)
+
+// Stand-in addresses (from the documentation ranges of RFC 5737 and RFC 3849)
+// for endpoints whose real address is unknown.
+var (
+	captureClientAddr4 = netip.MustParseAddr("192.0.2.1")
+	captureClientAddr6 = netip.MustParseAddr("2001:db8::1")
+	captureServerAddr4 = netip.MustParseAddr("198.51.100.1")
+)
+
+// packetWriter is a pcapng.Writer or a pcapng.PcapWriter.
+type packetWriter interface {
+	WritePacket(ts time.Time, data []byte, comment string) error
+}
+
+// PcapWriter writes DNS messages as synthetic IP packets to a pcapng (or
+// classic pcap) file, so that they can be examined in tools like Wireshark.  It is safe for
+// concurrent use, so several clients may share one PcapWriter.
+//
+// Each packet is written to the underlying writer as soon as it is captured
+// (there is no buffering), so a capture is complete even if the program
+// exits without closing the PcapWriter.
+type PcapWriter struct {
+	mu     sync.Mutex
+	pw     packetWriter
+	closer io.Closer // nil if the PcapWriter doesn't own the underlying writer
+}
+
+// NewPcapWriter starts a pcapng capture on w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	pw, err := pcapng.NewWriter(w, pcapng.LinkTypeRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pcapng header: %w", err)
+	}
+	return &PcapWriter{pw: pw}, nil
+}
+
+// NewClassicPcapWriter starts a classic pcap capture on w.  The classic format
+// has no packet comments, so the transport and server of each packet are not
+// recorded.
+func NewClassicPcapWriter(w io.Writer) (*PcapWriter, error) {
+	pw, err := pcapng.NewPcapWriter(w, pcapng.LinkTypeRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	return &PcapWriter{pw: pw}, nil
+}
+
+// CreatePcapFile creates (or truncates) the file at path and starts a capture
+// in it: a classic pcap capture if path ends with ".pcap", and a pcapng
+// capture otherwise.
+func CreatePcapFile(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	newWriter := NewPcapWriter
+	if strings.EqualFold(filepath.Ext(path), ".pcap") {
+		newWriter = NewClassicPcapWriter
+	}
+	p, err := newWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.closer = f
+	return p, nil
+}
+
+// Close closes the file, if the PcapWriter created it.
+func (p *PcapWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// captureFlow is the synthetic connection between a client and its server.
+type captureFlow struct {
+	clientPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+}
+
+// serverAddrPort maps an Upstream's server to the address and port used in
+// the synthetic packets.  DoT and DoH messages are written in cleartext, so
+// they are sent to port 53 (where Wireshark expects DNS-over-TCP).
+func serverAddrPort(transport Transport, server string) netip.AddrPort {
+	ap, ok := upstreamAddrPort(transport, server)
+	if !ok {
+		return netip.AddrPortFrom(captureServerAddr4, 53)
+	}
+	if transport == TransportDoT || transport == TransportDoH {
+		return netip.AddrPortFrom(ap.Addr(), 53)
+	}
+	return ap
+}
+
+func (p *PcapWriter) record(flow *captureFlow, next Client, req *dns.Msg, sent time.Time, resp *dns.Msg, received time.Time) error {
+	transport := TransportDo53UDP
+	server := "unknown server"
+	if u, ok := UpstreamOf(next); ok {
+		transport = u.Transport()
+		server = u.Server()
+	}
+
+	serverAP := serverAddrPort(transport, server)
+	clientAddr := captureClientAddr4
+	if serverAP.Addr().Is6() {
+		clientAddr = captureClientAddr6
+	}
+	clientAP := netip.AddrPortFrom(clientAddr, flow.clientPort)
+
+	comment := fmt.Sprintf("%s %s", transport, server)
+	if transport == TransportDoT || transport == TransportDoH {
+		comment = fmt.Sprintf("cleartext of %s", comment)
+	}
+
+	packets := []*dns.Msg{req}
+	if resp != nil {
+		packets = append(packets, resp)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, m := range packets {
+		wire, err := m.Pack()
+		if err != nil {
+			return err
+		}
+
+		ts := sent
+		src, dst := clientAP, serverAP
+		if i == 1 {
+			ts = received
+			src, dst = serverAP, clientAP
+		}
+
+		var pkt []byte
+		if transport == TransportDo53UDP {
+			pkt = pcapng.UDPPacket(src, dst, wire)
+		} else {
+			payload := binary.BigEndian.AppendUint16(nil, uint16(len(wire)))
+			payload = append(payload, wire...)
+			if i == 0 {
+				pkt = pcapng.TCPPacket(src, dst, flow.clientSeq, flow.serverSeq,
+					pcapng.FlagPSH|pcapng.FlagACK, payload)
+				flow.clientSeq += uint32(len(payload))
+			} else {
+				pkt = pcapng.TCPPacket(src, dst, flow.serverSeq, flow.clientSeq,
+					pcapng.FlagPSH|pcapng.FlagACK, payload)
+				flow.serverSeq += uint32(len(payload))
+			}
+		}
+
+		err = p.pw.WritePacket(ts, pkt, comment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Capture returns a Middleware that writes each query, and its response (if
+// there is one), to p.  The packets have the real send and receive times and
+// the server's real address, when it is known; DoT and DoH messages are
+// written in cleartext, as DNS-over-TCP.  Failures to write the capture are
+// reported to the client's Logger and do not affect the query.
+func Capture(p *PcapWriter) Middleware {
+	return func(next Client) Client {
+		flow := &captureFlow{
+			clientPort: uint16(49152 + rand.Intn(16384)),
+			clientSeq:  1,
+			serverSeq:  1,
+		}
+		return Intercept(func(req *dns.Msg, query QueryFunc) (*dns.Msg, error) {
+			sent := time.Now()
+			resp, err := query(req)
+			var captured *dns.Msg
+			if err == nil {
+				captured = resp
+			}
+			if werr := p.record(flow, next, req, sent, captured, time.Now()); werr != nil {
+				next.GetConfig().logger().Warn("failed to write pcap capture", "err", werr)
+			}
+			return resp, err
+		})(next)
+	}
+}
@@ -0,0 +1,294 @@
+package dnsclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosFault is a fault that a ChaosClient can inject into a query.
+type ChaosFault int
+
+const (
+	// FaultDrop loses the query: the ChaosClient doesn't pass it on, and
+	// fails with a timeout once the config's Timeout has elapsed.
+	FaultDrop ChaosFault = iota
+	// FaultLatency delays the query by ChaosConfig.Latency.
+	FaultLatency
+	// FaultRcode sets the response's rcode to ChaosConfig.Rcode and
+	// clears the answer section.
+	FaultRcode
+	// FaultTruncate sets the response's TC bit and removes its records.
+	FaultTruncate
+	// FaultMangle corrupts the answer section: each record is either
+	// removed, renamed, or (for A and AAAA records) given a random
+	// address.
+	FaultMangle
+	// FaultWrongID gives the response an ID that doesn't match the query.
+	FaultWrongID
+)
+
+var ChaosFaultToString = map[ChaosFault]string{
+	FaultDrop:     "drop",
+	FaultLatency:  "latency",
+	FaultRcode:    "rcode",
+	FaultTruncate: "truncate",
+	FaultMangle:   "mangle",
+	FaultWrongID:  "wrong-id",
+}
+
+func (f ChaosFault) String() string {
+	s, ok := ChaosFaultToString[f]
+	if !ok {
+		return fmt.Sprintf("ChaosFault(%d)", int(f))
+	}
+	return s
+}
+
+// ChaosRule injects faults into the queries that it matches, regardless of
+// the probabilities in the ChaosConfig.
+type ChaosRule struct {
+	Qname  string // "" matches any qname; matching is case-insensitive
+	Qtype  uint16 // 0 matches any qtype
+	Faults []ChaosFault
+	// Count is the number of queries that the rule applies to; after that,
+	// the rule is spent.  If 0, the rule applies to all matching queries.
+	Count int
+}
+
+func (r *ChaosRule) matches(q dns.Question) bool {
+	if r.Qname != "" && !strings.EqualFold(dns.Fqdn(r.Qname), q.Name) {
+		return false
+	}
+	return r.Qtype == 0 || r.Qtype == q.Qtype
+}
+
+type ChaosConfig struct {
+	// The probability, in [0, 1], that each fault is injected into a
+	// query that no rule matches.  The faults are drawn independently.
+	DropProb     float64
+	LatencyProb  float64
+	RcodeProb    float64
+	TruncateProb float64
+	MangleProb   float64
+	WrongIDProb  float64
+
+	Latency time.Duration
+	// Rcode is the rcode that FaultRcode sets.  The default (0) is
+	// SERVFAIL; NOERROR can't be injected.
+	Rcode int
+
+	// Rules are tried in order, and the first one that matches a query
+	// determines its faults.
+	Rules []ChaosRule
+
+	// Seed seeds the random draws, so that a test can reproduce a sequence
+	// of faults.  If 0, a random seed is used.
+	Seed int64
+}
+
+// ChaosClient wraps a Client and injects faults into its queries, to
+// simulate a bad network or a misbehaving server.  It is safe for
+// concurrent use if the wrapped Client is.
+type ChaosClient struct {
+	next   Client
+	config *ChaosConfig
+	rcode  int
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	rules []ChaosRule
+}
+
+func NewChaosClient(next Client, config *ChaosConfig) *ChaosClient {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := &ChaosClient{
+		next:   next,
+		config: config,
+		rcode:  config.Rcode,
+		rand:   rand.New(rand.NewSource(seed)),
+		rules:  append([]ChaosRule(nil), config.Rules...),
+	}
+	if c.rcode == dns.RcodeSuccess {
+		c.rcode = dns.RcodeServerFailure
+	}
+	return c
+}
+
+// Unwrap returns the Client that c wraps.
+func (c *ChaosClient) Unwrap() Client {
+	return c.next
+}
+
+func (c *ChaosClient) GetConfig() *Config {
+	return c.next.GetConfig()
+}
+
+func (c *ChaosClient) Dial() error {
+	return c.next.Dial()
+}
+
+func (c *ChaosClient) Close() error {
+	return c.next.Close()
+}
+
+// faults picks the faults to inject into req.
+func (c *ChaosClient) faults(req *dns.Msg) []ChaosFault {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.rules {
+		r := &c.rules[i]
+		if !r.matches(req.Question[0]) {
+			continue
+		}
+		if r.Count > 0 {
+			r.Count--
+			if r.Count == 0 {
+				c.rules = append(c.rules[:i:i], c.rules[i+1:]...)
+			}
+		}
+		return r.Faults
+	}
+
+	var faults []ChaosFault
+	probs := []struct {
+		fault ChaosFault
+		prob  float64
+	}{
+		{FaultDrop, c.config.DropProb},
+		{FaultLatency, c.config.LatencyProb},
+		{FaultRcode, c.config.RcodeProb},
+		{FaultTruncate, c.config.TruncateProb},
+		{FaultMangle, c.config.MangleProb},
+		{FaultWrongID, c.config.WrongIDProb},
+	}
+	for _, p := range probs {
+		if p.prob > 0 && c.rand.Float64() < p.prob {
+			faults = append(faults, p.fault)
+		}
+	}
+	return faults
+}
+
+// chaosTimeout is the error for a dropped query.  It implements net.Error and
+// matches ErrTimeout, so that it is recognized as a timeout (e.g., by
+// DefaultRetryClassifier).
+type chaosTimeout struct{}
+
+func (chaosTimeout) Error() string   { return "chaos: query dropped (timeout)" }
+func (chaosTimeout) Timeout() bool   { return true }
+func (chaosTimeout) Temporary() bool { return true }
+
+func (chaosTimeout) Is(target error) bool { return target == ErrTimeout }
+
+var _ net.Error = chaosTimeout{}
+
+func hasFault(faults []ChaosFault, f ChaosFault) bool {
+	for _, g := range faults {
+		if g == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ChaosClient) mangle(resp *dns.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var answer []dns.RR
+	for _, rr := range resp.Answer {
+		switch c.rand.Intn(3) {
+		case 0:
+			continue
+		case 1:
+			rr.Header().Name = fmt.Sprintf("chaos-%04x.%s", c.rand.Intn(0x10000), rr.Header().Name)
+		case 2:
+			switch rr := rr.(type) {
+			case *dns.A:
+				rr.A = make(net.IP, net.IPv4len)
+				c.rand.Read(rr.A)
+			case *dns.AAAA:
+				rr.AAAA = make(net.IP, net.IPv6len)
+				c.rand.Read(rr.AAAA)
+			default:
+				rr.Header().Name = "chaos." + rr.Header().Name
+			}
+		}
+		answer = append(answer, rr)
+	}
+	resp.Answer = answer
+}
+
+func (c *ChaosClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *ChaosClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return queryContext(ctx, c.next, req)
+	}
+
+	faults := c.faults(req)
+	if len(faults) == 0 {
+		return queryContext(ctx, c.next, req)
+	}
+
+	logger := c.GetConfig().logger()
+	logger.Debug("injecting faults", append(questionAttrs(req), "faults", fmt.Sprint(faults))...)
+
+	if hasFault(faults, FaultLatency) {
+		err := sleepContext(ctx, c.config.Latency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if hasFault(faults, FaultDrop) {
+		err := sleepContext(ctx, c.GetConfig().Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return nil, chaosTimeout{}
+	}
+
+	resp, err := queryContext(ctx, c.next, req)
+	if err != nil {
+		return resp, err
+	}
+	resp = resp.Copy()
+
+	if hasFault(faults, FaultRcode) {
+		resp.Rcode = c.rcode
+		resp.Answer = nil
+	}
+	if hasFault(faults, FaultTruncate) {
+		resp.Truncated = true
+		resp.Answer = nil
+		resp.Ns = nil
+		var extra []dns.RR
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	}
+	if hasFault(faults, FaultMangle) {
+		c.mangle(resp)
+	}
+	if hasFault(faults, FaultWrongID) {
+		resp.Id = req.Id + 1
+	}
+	return resp, nil
+}
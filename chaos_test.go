@@ -0,0 +1,54 @@
+package dnsclient_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+)
+
+func TestChaosWrongID(t *testing.T) {
+	s := newTestServer(t, raceZone)
+	zeroID := dnsclient.Intercept(func(req *dns.Msg, next dnsclient.QueryFunc) (*dns.Msg, error) {
+		resp, err := next(req)
+		if err == nil {
+			resp.Id = 0
+		}
+		return resp, err
+	})
+
+	tests := []struct {
+		name     string
+		c        dnsclient.Client
+		mismatch bool
+	}{
+		{"no fault", dnsclient.NewChaosClient(dnsclient.NewDo53Client(s.Do53Config()),
+			&dnsclient.ChaosConfig{}), false},
+		{"wrong id", dnsclient.NewChaosClient(dnsclient.NewDo53Client(s.Do53Config()),
+			&dnsclient.ChaosConfig{WrongIDProb: 1}), true},
+		{"wrong id over doh", dnsclient.NewChaosClient(dnsclient.NewDoHClient(s.DoHConfig()),
+			&dnsclient.ChaosConfig{WrongIDProb: 1}), true},
+		// RFC 8484 allows DoH responses to have an ID of 0
+		{"zero id over doh", dnsclient.Chain(dnsclient.NewDoHClient(s.DoHConfig()), zeroID), false},
+		{"zero id over do53", dnsclient.Chain(dnsclient.NewDo53Client(s.Do53Config()), zeroID), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Dial(); err != nil {
+				t.Fatal(err)
+			}
+			defer tt.c.Close()
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.Id = 1234
+			_, err := dnsclient.Query(tt.c, req)
+			var dnsErr *dnsclient.DNSError
+			mismatch := errors.As(err, &dnsErr) && dnsErr.Reason == dnsclient.DNSErrIDMismatch
+			if mismatch != tt.mismatch {
+				t.Errorf("got error %v, want an ID mismatch: %v", err, tt.mismatch)
+			}
+		})
+	}
+}
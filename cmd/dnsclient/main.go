@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/cmdutil"
 	"github.com/syslab-wm/dnsclient/internal/defaults"
 	"github.com/syslab-wm/dnsclient/internal/netx"
 	"github.com/syslab-wm/mu"
@@ -41,10 +43,15 @@ general options:
     and port 853 is used for DoT.  For DoH, SERVER is the URL of the
     DoH service.
 
-    The default is to use CloudFlare's open resolver at 1.1.1.1
+    For Do53, the default is to use the nameservers and search list in
+    /etc/resolv.conf, along with its timeout option (unless -timeout is
+    given); if the file can't be read, CloudFlare's open resolver at 1.1.1.1
+    is used.  For DoT and DoH, the default is CloudFlare's open resolver
     (for DoH, the URL is https://cloudflare-dns.com/dns-query).
 
-    Default: 1.1.1.1 (Cloudflare's open resolver)
+    With the Do53 default, A, AAAA and PTR queries for the names and
+    addresses in /etc/hosts are answered from it, as the system's resolver
+    does.
 
   -qtype QTYPE
     The query type (e.g., A, AAAA, NS)
@@ -65,6 +72,34 @@ general options:
     Request DNSSEC records be sent by setting the DNSSEC OK bit (DO) in the OPT
     record in the additional section of the query.
 
+  -no-edns
+    Don't add an OPT record to queries unless -dnssec is given.  By default,
+    each query has one, so that the server can include Extended DNS Errors
+    (RFC 8914) in its response; these are printed along with the outcome.
+
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
+  -pcap FILE
+    Write each DNS query and response to FILE, as synthetic UDP or TCP
+    packets.  For DoT and DoH, the cleartext DNS messages are written, as
+    DNS-over-TCP.  If FILE ends with .pcap, it is written in the classic pcap
+    format; otherwise, it is written in pcapng format.
+
+  -dnstap DEST
+    Emit a dnstap CLIENT_QUERY and CLIENT_RESPONSE message for each DNS query
+    and response.  If DEST has the form unix:PATH, the messages are sent to
+    the Frame Streams receiver listening on the unix socket PATH; otherwise,
+    they are written to the file DEST.
+
+  -trace
+    Resolve QNAME iteratively, starting from the root servers, instead of
+    asking a recursive resolver, and print each step: the zone and server
+    queried, the server's address, the RTT, the referral (NS set and glue),
+    and the final answer.  Only valid for Do53, and -server must not be
+    given.  With -tcp, all queries go over TCP; otherwise, truncated
+    responses are retried over TCP.
+
   -help
     Display this usage statement and exit.
 
@@ -74,24 +109,31 @@ Do53-specific options:
 
   -retry-with-tcp
     For Do53 using UDP, if the DNS response is truncated, then
-    re-issue the query over TCP.
+    re-issue the query over TCP.  Without -server, this is always
+    done, as the system's resolver does.
 
 
 examples:
   $ ./dnsclient -proto doh -qtype NS www.cs.wm.edu
+  $ ./dnsclient -trace -dnssec -qtype AAAA www.cs.wm.edu
 `
 
 type Options struct {
 	// positional
 	qname string
 	// general options
-	proto     string
-	server    string
-	qtypeStr  string
-	qtype     uint16 // derived
-	timeout   time.Duration
-	maxCNAMEs int
-	dnssec    bool
+	proto      string
+	server     string
+	qtypeStr   string
+	qtype      uint16 // derived
+	timeout    time.Duration
+	maxCNAMEs  int
+	dnssec     bool
+	noEDNS     bool
+	logQueries bool
+	pcapFile   string
+	dnstapDest string
+	trace      bool
 	// do53-specific options
 	tcp          bool
 	retryWithTCP bool
@@ -120,6 +162,11 @@ func parseOptions() *Options {
 	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", defaults.MaxCNAMEs, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
+	flag.BoolVar(&opts.noEDNS, "no-edns", false, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
+	flag.StringVar(&opts.pcapFile, "pcap", "", "")
+	flag.StringVar(&opts.dnstapDest, "dnstap", "", "")
+	flag.BoolVar(&opts.trace, "trace", false, "")
 	// do53-specific options
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.BoolVar(&opts.retryWithTCP, "retry-with-tcp", false, "")
@@ -143,14 +190,25 @@ func parseOptions() *Options {
 		mu.Fatalf("error: invalid qtype %q", opts.qtypeStr)
 	}
 
+	if opts.trace {
+		if opts.proto != "do53" {
+			mu.Fatalf("error: -trace is only valid for -proto do53")
+		}
+		if opts.server != "" {
+			mu.Fatalf("error: can't specify both -trace and -server")
+		}
+		if opts.retryWithTCP {
+			mu.Fatalf("error: -retry-with-tcp is implied by -trace")
+		}
+	}
+
 	if opts.proto == "do53" {
 		if opts.tcp && opts.retryWithTCP {
 			mu.Fatalf("error: can't specify both -tcp and -retry-with-tcp")
 		}
 
-		if opts.server == "" {
-			opts.server = defaults.Do53Server
-		} else {
+		// if no server is given, newClient uses resolv.conf
+		if opts.server != "" {
 			opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
 		}
 	}
@@ -182,18 +240,61 @@ func parseOptions() *Options {
 	return &opts
 }
 
-func newClient(opts *Options) dnsclient.Client {
+func openDnstap(dest string) (*dnsclient.DnstapSink, error) {
+	var tap *dnsclient.DnstapSink
+	var err error
+
+	path, ok := strings.CutPrefix(dest, "unix:")
+	if ok {
+		tap, err = dnsclient.DialDnstapSocket(path)
+	} else {
+		tap, err = dnsclient.CreateDnstapFile(dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tap.Version = "dnsclient"
+	return tap, nil
+}
+
+func newClient(opts *Options, extra ...dnsclient.Middleware) dnsclient.Client {
 	var c dnsclient.Client
+	var logger *slog.Logger
+
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
 
 	baseConfig := dnsclient.Config{
 		RecursionDesired: true,
 		Timeout:          opts.timeout,
 		MaxCNAMEs:        opts.maxCNAMEs,
 		DNSSEC:           opts.dnssec,
+		Logger:           logger,
+	}
+
+	var mws []dnsclient.Middleware
+	if !opts.noEDNS {
+		// the OPT record is needed to get Extended DNS Errors
+		mws = append(mws, dnsclient.AddEDNS0Options())
+	}
+	if opts.logQueries {
+		mws = append(mws, dnsclient.Logging(logger))
+	}
+	mws = append(mws, extra...)
+
+	if opts.trace {
+		return newTracer(opts, baseConfig, mws)
 	}
 
 	switch opts.proto {
 	case "do53":
+		if opts.server == "" {
+			// the middlewares wrap each nameserver's client, behind the
+			// hosts file
+			return cmdutil.NewResolvConfClient(baseConfig, opts.tcp, mws...)
+		}
 		config := &dnsclient.Do53Config{
 			Config:       baseConfig,
 			UseTCP:       opts.tcp,
@@ -217,14 +318,93 @@ func newClient(opts *Options) dnsclient.Client {
 		mu.BUG("invalid proto %q", opts.proto)
 	}
 
-	return c
+	return dnsclient.Chain(c, mws...)
+}
+
+// newTracer returns an iterative resolver that prints each hop.  The
+// middlewares wrap the client for each hop, so that, e.g., the pcap output
+// has the actual queries to each server.
+func newTracer(opts *Options, baseConfig dnsclient.Config, mws []dnsclient.Middleware) dnsclient.Client {
+	baseConfig.RecursionDesired = false
+	config := &dnsclient.IterativeConfig{
+		Config: baseConfig,
+		UseTCP: opts.tcp,
+		NewClient: func(config *dnsclient.Do53Config) dnsclient.Client {
+			return dnsclient.Chain(dnsclient.NewDo53Client(config), mws...)
+		},
+		OnHop: printHop,
+	}
+	return dnsclient.NewIterativeResolver(config)
+}
+
+func printHop(hop *dnsclient.Hop) {
+	prefix := ";; " + strings.Repeat("    ", hop.Depth)
+
+	fmt.Printf("%s%s %s from %s (%s) for zone %s in %v\n", prefix, hop.Question.Name,
+		dns.TypeToString[hop.Question.Qtype], hop.Server, hop.Addr, hop.Zone,
+		hop.RTT.Round(time.Microsecond))
+
+	if hop.Err != nil {
+		fmt.Printf("%s  error: %v\n\n", prefix, hop.Err)
+		return
+	}
+
+	resp := hop.Response
+	switch {
+	case hop.Lame:
+		fmt.Printf("%s  lame referral\n", prefix)
+	case hop.Referral != "":
+		fmt.Printf("%s  referral to %s\n", prefix, hop.Referral)
+	default:
+		fmt.Printf("%s  %s, aa=%t\n", prefix, dns.RcodeToString[resp.Rcode], resp.Authoritative)
+	}
+	if edes := dnsclient.ExtendedErrors(resp); len(edes) > 0 {
+		fmt.Printf("%s  extended errors: %s\n", prefix, dnsclient.FormatExtendedErrors(edes))
+	}
+
+	for _, rr := range resp.Answer {
+		fmt.Println(rr)
+	}
+	for _, rr := range resp.Ns {
+		fmt.Println(rr)
+	}
+	for _, ns := range hop.NameServers {
+		if len(ns.Addrs) == 0 {
+			fmt.Printf("%s  %s: no glue\n", prefix, ns.Name)
+		} else {
+			fmt.Printf("%s  %s: glue %v\n", prefix, ns.Name, ns.Addrs)
+		}
+	}
+	fmt.Println()
 }
 
 func main() {
+	var mws []dnsclient.Middleware
+	var tap *dnsclient.DnstapSink
+	var err error
+
 	opts := parseOptions()
 
-	c := newClient(opts)
-	err := c.Dial()
+	if opts.pcapFile != "" {
+		pw, err := dnsclient.CreatePcapFile(opts.pcapFile)
+		if err != nil {
+			mu.Fatalf("error: failed to create pcap file: %v", err)
+		}
+		defer pw.Close()
+		mws = append(mws, dnsclient.Capture(pw))
+	}
+
+	if opts.dnstapDest != "" {
+		tap, err = openDnstap(opts.dnstapDest)
+		if err != nil {
+			mu.Fatalf("error: failed to open dnstap output: %v", err)
+		}
+		defer tap.Close()
+		mws = append(mws, dnsclient.Dnstap(tap))
+	}
+
+	c := newClient(opts, mws...)
+	err = c.Dial()
 	if err != nil {
 		mu.Fatalf("failed to connect to DNS server: %v", err)
 	}
@@ -232,6 +412,11 @@ func main() {
 
 	resp, err := dnsclient.Lookup(c, opts.qname, opts.qtype)
 	if err != nil {
+		if tap != nil {
+			// mu.Fatalf doesn't run the deferred calls; end the stream
+			// properly regardless
+			tap.Close()
+		}
 		mu.Fatalf("query failed: %v", err)
 	}
 
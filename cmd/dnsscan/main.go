@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
@@ -13,6 +13,7 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/cmdutil"
 	"github.com/syslab-wm/dnsclient/internal/defaults"
 	"github.com/syslab-wm/dnsclient/internal/netx"
 	"github.com/syslab-wm/mu"
@@ -51,10 +52,15 @@ general client options:
     and port 853 is used for DoT.  For DoH, SERVER is the URL of the
     DoH service.
 
-    The default is to use CloudFlare's open resolver at 1.1.1.1
+    For Do53, the default is to use the nameservers and search list in
+    /etc/resolv.conf, along with its timeout and attempts options (unless
+    -timeout or -attempts is given); if the file can't be read, CloudFlare's
+    open resolver at 1.1.1.1 is used.  For DoT and DoH, the default is CloudFlare's open resolver
     (for DoH, the URL is https://cloudflare-dns.com/dns-query).
 
-    Default: 1.1.1.1 (Cloudflare's open resolver)
+    With the Do53 default, A, AAAA and PTR queries for the names and
+    addresses in /etc/hosts are answered from it, as the system's resolver
+    does.
 
   -qtype QTYPE
     The query type (e.g., A, AAAA, NS)
@@ -75,6 +81,37 @@ general client options:
     Request DNSSEC records be sent by setting the DNSSEC OK bit (DO) in the OPT
     record in the additional section of the query.
 
+  -no-edns
+    Don't add an OPT record to queries unless -dnssec is given.  By default,
+    each query has one, so that the server can include Extended DNS Errors
+    (RFC 8914) in its response; these are printed along with the outcome.
+
+  -attempts N
+    The maximum number of attempts for each query.  A query is retried if it
+    times out or the response has an RCODE of SERVFAIL or REFUSED.
+
+    Default: 1
+
+  -backoff BACKOFF
+    The delay before the first retry (e.g., 100ms).  Each subsequent delay
+    doubles.  Each delay is randomly varied by up to ±20%.
+
+    Default: 100ms
+
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
+  -pcap FILE
+    Write each DNS query and response to FILE, as synthetic UDP or TCP
+    packets.  For DoT and DoH, the cleartext DNS messages are written, as
+    DNS-over-TCP.  If FILE ends with .pcap, it is written in the classic pcap
+    format; otherwise, it is written in pcapng format.
+
+  -dnstap DEST
+    Emit a dnstap CLIENT_QUERY and CLIENT_RESPONSE message for each DNS query
+    and response.  If DEST has the form unix:PATH, the messages are sent to
+    the Frame Streams receiver listening on the unix socket PATH; otherwise,
+    they are written to the file DEST.
 
 Do53 client-specific options:
   -tcp
@@ -82,7 +119,8 @@ Do53 client-specific options:
 
   -retry-with-tcp
     For Do53 using UDP, if the DNS response is truncated, then
-    re-issue the query over TCP.
+    re-issue the query over TCP.  Without -server, this is always
+    done, as the system's resolver does.
 `
 
 type Options struct {
@@ -91,13 +129,19 @@ type Options struct {
 	// general options
 	numWorkers int
 	// general client opts
-	proto     string
-	server    string
-	qtypeStr  string
-	qtype     uint16 // derived
-	timeout   time.Duration
-	maxCNAMEs int
-	dnssec    bool
+	proto      string
+	server     string
+	qtypeStr   string
+	qtype      uint16 // derived
+	timeout    time.Duration
+	maxCNAMEs  int
+	dnssec     bool
+	noEDNS     bool
+	logQueries bool
+	pcapFile   string
+	dnstapDest string
+	attempts   int
+	backoff    time.Duration
 	// do53 client-specific options
 	tcp          bool
 	retryWithTCP bool
@@ -128,6 +172,12 @@ func parseOptions() *Options {
 	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", defaults.MaxCNAMEs, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
+	flag.BoolVar(&opts.noEDNS, "no-edns", false, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
+	flag.StringVar(&opts.pcapFile, "pcap", "", "")
+	flag.StringVar(&opts.dnstapDest, "dnstap", "", "")
+	flag.IntVar(&opts.attempts, "attempts", 1, "")
+	flag.DurationVar(&opts.backoff, "backoff", 100*time.Millisecond, "")
 	// do53 client-specific options
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.BoolVar(&opts.retryWithTCP, "retry-with-tcp", false, "")
@@ -156,9 +206,8 @@ func parseOptions() *Options {
 			mu.Fatalf("error: can't specify both -tcp and -retry-with-tcp")
 		}
 
-		if opts.server == "" {
-			opts.server = defaults.Do53Server
-		} else {
+		// if no server is given, newClient uses resolv.conf
+		if opts.server != "" {
 			opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
 		}
 	}
@@ -220,18 +269,62 @@ type ScanRecord struct {
 	err   error
 }
 
-func newClient(opts *Options) dnsclient.Client {
+func openDnstap(dest string) (*dnsclient.DnstapSink, error) {
+	var tap *dnsclient.DnstapSink
+	var err error
+
+	path, ok := strings.CutPrefix(dest, "unix:")
+	if ok {
+		tap, err = dnsclient.DialDnstapSocket(path)
+	} else {
+		tap, err = dnsclient.CreateDnstapFile(dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tap.Version = "dnsscan"
+	return tap, nil
+}
+
+func newClient(opts *Options, extra ...dnsclient.Middleware) dnsclient.Client {
 	var c dnsclient.Client
+	var logger *slog.Logger
+
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
 
 	baseConfig := dnsclient.Config{
 		RecursionDesired: true,
 		Timeout:          opts.timeout,
 		MaxCNAMEs:        opts.maxCNAMEs,
 		DNSSEC:           opts.dnssec,
+		Logger:           logger,
+		Retry: dnsclient.RetryPolicy{
+			MaxAttempts: opts.attempts,
+			Backoff:     opts.backoff,
+			Jitter:      0.2,
+		},
+	}
+
+	var mws []dnsclient.Middleware
+	if !opts.noEDNS {
+		// the OPT record is needed to get Extended DNS Errors
+		mws = append(mws, dnsclient.AddEDNS0Options())
+	}
+	if opts.logQueries {
+		mws = append(mws, dnsclient.Logging(logger))
 	}
+	mws = append(mws, extra...)
 
 	switch opts.proto {
 	case "do53":
+		if opts.server == "" {
+			// the middlewares wrap each nameserver's client, behind the
+			// hosts file
+			return cmdutil.NewResolvConfClient(baseConfig, opts.tcp, mws...)
+		}
 		config := &dnsclient.Do53Config{
 			Config:       baseConfig,
 			UseTCP:       opts.tcp,
@@ -255,13 +348,36 @@ func newClient(opts *Options) dnsclient.Client {
 		mu.BUG("invalid proto %q", opts.proto)
 	}
 
-	return c
+	return dnsclient.Chain(c, mws...)
 }
 
 func main() {
 	var wg sync.WaitGroup
 
+	var mws []dnsclient.Middleware
+	var tap *dnsclient.DnstapSink
+	var err error
+
 	opts := parseOptions()
+
+	if opts.pcapFile != "" {
+		pw, err := dnsclient.CreatePcapFile(opts.pcapFile)
+		if err != nil {
+			mu.Fatalf("error: failed to create pcap file: %v", err)
+		}
+		defer pw.Close()
+		mws = append(mws, dnsclient.Capture(pw))
+	}
+
+	if opts.dnstapDest != "" {
+		tap, err = openDnstap(opts.dnstapDest)
+		if err != nil {
+			mu.Fatalf("error: failed to open dnstap output: %v", err)
+		}
+		defer tap.Close()
+		mws = append(mws, dnsclient.Dnstap(tap))
+	}
+
 	inch := make(chan string, opts.numWorkers)
 	outch := make(chan *ScanRecord, opts.numWorkers)
 	wg.Add(opts.numWorkers)
@@ -277,10 +393,10 @@ func main() {
 				}
 			}()
 
-			c = newClient(opts)
+			c = newClient(opts, mws...)
 			err := c.Dial()
 			if err != nil {
-				log.Printf("failed to connect to DNS server: %v", err)
+				slog.Error("failed to connect to DNS server", "err", err)
 				return
 			}
 
@@ -310,7 +426,12 @@ func main() {
 			continue
 		}
 
-		fmt.Printf("%32s: success: %v\n", rec.qname, rec.reply.Answer)
+		if edes := dnsclient.ExtendedErrors(rec.reply); len(edes) > 0 {
+			fmt.Printf("%32s: success: %v [EDE: %s]\n", rec.qname, rec.reply.Answer,
+				dnsclient.FormatExtendedErrors(edes))
+		} else {
+			fmt.Printf("%32s: success: %v\n", rec.qname, rec.reply.Answer)
+		}
 
 		numJobs += 1
 	}
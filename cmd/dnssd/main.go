@@ -3,12 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"time"
 
 	"github.com/syslab-wm/adt/set"
 	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/cmdutil"
 	"github.com/syslab-wm/dnsclient/internal/defaults"
 	"github.com/syslab-wm/dnsclient/internal/netx"
 	"github.com/syslab-wm/mu"
@@ -27,7 +29,11 @@ positional arguments:
     The nameserver to query.  SERVER is of the form
     IP[:PORT].  If PORT is not provided, then port 53 is used.
 
-    Default: 1.1.1.1:53 (Cloudflare's open resolver)
+    The default is to use the nameservers in /etc/resolv.conf, along with
+    its timeout option (unless -timeout is given); if the file can't be
+    read, CloudFlare's open resolver at 1.1.1.1:53 is used.  In either
+    case, A, AAAA and PTR queries for the names and addresses in /etc/hosts
+    are answered from it, as the system's resolver does.
 
   -tcp
     Use TCP instead of UDP for issuing DNS queries.
@@ -37,6 +43,9 @@ positional arguments:
 
     Default: 2s
 
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
   -help
     Display this usage statement and exit.
 
@@ -48,9 +57,10 @@ type Options struct {
 	// positional
 	domain string
 	// options
-	server  string
-	tcp     bool
-	timeout time.Duration
+	server     string
+	tcp        bool
+	timeout    time.Duration
+	logQueries bool
 }
 
 func printUsage() {
@@ -69,9 +79,10 @@ func parseOptions() *Options {
 
 	flag.Usage = printUsage
 	// general options
-	flag.StringVar(&opts.server, "server", defaults.Do53Server, "")
+	flag.StringVar(&opts.server, "server", "", "")
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
 
 	flag.Parse()
 
@@ -80,25 +91,46 @@ func parseOptions() *Options {
 	}
 
 	opts.domain = flag.Arg(0)
-	opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
+	// if no server is given, newClient uses resolv.conf
+	if opts.server != "" {
+		opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
+	}
 
 	return &opts
 }
 
+// newClient returns a client for the server, or, if none was given, for the
+// nameservers in resolv.conf (or the default server, if it can't be read),
+// behind the hosts file.
+func newClient(opts *Options, baseConfig dnsclient.Config) dnsclient.Client {
+	if opts.server != "" {
+		return dnsclient.NewDo53Client(&dnsclient.Do53Config{
+			Config: baseConfig,
+			UseTCP: opts.tcp,
+			Server: opts.server,
+		})
+	}
+
+	return cmdutil.NewResolvConfClient(baseConfig, opts.tcp)
+}
+
 func main() {
 	var c dnsclient.Client
+	var logger *slog.Logger
 
 	opts := parseOptions()
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
 
-	config := &dnsclient.Do53Config{
-		Config: dnsclient.Config{
-			RecursionDesired: true,
-			Timeout:          opts.timeout,
-		},
-		UseTCP: opts.tcp,
-		Server: opts.server,
+	c = newClient(opts, dnsclient.Config{
+		RecursionDesired: true,
+		Timeout:          opts.timeout,
+		Logger:           logger,
+	})
+	if opts.logQueries {
+		c = dnsclient.Chain(c, dnsclient.Logging(logger))
 	}
-	c = dnsclient.NewDo53Client(config)
 
 	err := c.Dial()
 	if err != nil {
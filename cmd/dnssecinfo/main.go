@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/cmdutil"
+	"github.com/syslab-wm/dnsclient/internal/defaults"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+	"github.com/syslab-wm/dnsclient/internal/netx"
+	"github.com/syslab-wm/mu"
+)
+
+const usage = `Usage: dnssecinfo [options] ZONE
+
+Inspect the DNSSEC chain of trust for ZONE, from the root down.  For each zone
+on the way, print its DNSKEYs, the DS records at its parent (and whether they
+match a DNSKEY), and the RRSIGs over its DNSKEY, SOA, NS, and DS RRsets, with
+their inception and expiration times.  Signatures that fail to verify, or that
+expire within the warning threshold, are reported as warnings.
+
+The exit status is 0 if there are no warnings, 2 if there are warnings, and 1
+on error.
+
+positional arguments:
+  ZONE
+    The zone to inspect
+
+general options:
+  -warn-expiry DURATION
+    Warn about signatures that expire within DURATION (e.g., 72h).
+
+    Default: 168h (one week)
+
+  -json
+    Print the report as JSON.
+
+  -proto PROTO
+    The DNS protocol to use (case-insensitive).  Must be either:
+      * Do53
+          Regular cleartext DNS (DNS-over-(Port)53)
+      * DoT
+          DNS-over-TLS
+      * DoH
+          DNS-over-HTTPS
+
+    The default is Do53.
+
+  -server SERVER
+    The recursive resolver to query.  For Do53 and DoH, SERVER is of the form
+    IP[:PORT].  If PORT is not provided, then port 53 is used for Do53
+    and port 853 is used for DoT.  For DoH, SERVER is the URL of the
+    DoH service.
+
+    For Do53, the default is to use the nameservers and search list in
+    /etc/resolv.conf, along with its timeout option (unless -timeout is
+    given); if the file can't be read, CloudFlare's open resolver at 1.1.1.1
+    is used.  For DoT and DoH, the default is CloudFlare's open resolver
+    (for DoH, the URL is https://cloudflare-dns.com/dns-query).
+
+    With the Do53 default, A, AAAA and PTR queries for the names and
+    addresses in /etc/hosts are answered from it, as the system's resolver
+    does.
+
+  -timeout TIMEOUT
+    The timeout for the DNS request (e.g. 500ms, 1.5s).
+
+    Default: 2s
+
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
+  -help
+    Display this usage statement and exit.
+
+Do53-specific options:
+  -tcp
+    For Do53, use TCP instead of UDP.
+
+  -retry-with-tcp
+    For Do53 using UDP, if the DNS response is truncated, then
+    re-issue the query over TCP.  Without -server, this is always
+    done, as the system's resolver does.
+
+examples:
+  $ ./dnssecinfo cs.wm.edu
+  $ ./dnssecinfo -warn-expiry 72h -json example.com
+`
+
+type Options struct {
+	// positional
+	zone string
+	// general options
+	warnExpiry time.Duration
+	json       bool
+	proto      string
+	server     string
+	timeout    time.Duration
+	logQueries bool
+	// do53-specific options
+	tcp          bool
+	retryWithTCP bool
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "%s", usage)
+}
+
+func tryAddDefaultPort(server string, port string) string {
+	if netx.HasPort(server) {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+
+	flag.Usage = printUsage
+	// general options
+	flag.DurationVar(&opts.warnExpiry, "warn-expiry", 7*24*time.Hour, "")
+	flag.BoolVar(&opts.json, "json", false, "")
+	flag.StringVar(&opts.proto, "proto", "do53", "")
+	flag.StringVar(&opts.server, "server", "", "")
+	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
+	// do53-specific options
+	flag.BoolVar(&opts.tcp, "tcp", false, "")
+	flag.BoolVar(&opts.retryWithTCP, "retry-with-tcp", false, "")
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf("error: expected one positional argument but got %d", flag.NArg())
+	}
+
+	opts.zone = dns.CanonicalName(flag.Arg(0))
+
+	opts.proto = strings.ToLower(opts.proto)
+	if opts.proto != "do53" && opts.proto != "dot" && opts.proto != "doh" {
+		mu.Fatalf("error: unrecognized proto %q: must be either \"do53\", \"dot\", or \"doh\"", opts.proto)
+	}
+
+	if opts.proto == "do53" {
+		if opts.tcp && opts.retryWithTCP {
+			mu.Fatalf("error: can't specify both -tcp and -retry-with-tcp")
+		}
+
+		// if no server is given, newClient uses resolv.conf
+		if opts.server != "" {
+			opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
+		}
+	}
+
+	if opts.proto != "do53" {
+		if opts.tcp {
+			mu.Fatalf("error: -tcp is only valid for -proto do53")
+		}
+		if opts.retryWithTCP {
+			mu.Fatalf("error: -retry-with-tcp is only valid for -proto do53")
+		}
+	}
+
+	if opts.proto == "dot" {
+		if opts.server == "" {
+			opts.server = defaults.DoTServer
+		} else {
+			opts.server = tryAddDefaultPort(opts.server, defaults.DoTPort)
+		}
+	}
+
+	if opts.proto == "doh" {
+		if opts.server == "" {
+			opts.server = defaults.DoHURL
+		}
+		// TODO: parse the opts.server URL to make sure it is a valid HTTPS url
+	}
+
+	return &opts
+}
+
+func newClient(opts *Options) dnsclient.Client {
+	var c dnsclient.Client
+	var logger *slog.Logger
+
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+
+	baseConfig := dnsclient.Config{
+		RecursionDesired: true,
+		Timeout:          opts.timeout,
+		DNSSEC:           true,
+		Logger:           logger,
+	}
+
+	switch opts.proto {
+	case "do53":
+		if opts.server == "" {
+			c = cmdutil.NewResolvConfClient(baseConfig, opts.tcp)
+			break
+		}
+		config := &dnsclient.Do53Config{
+			Config:       baseConfig,
+			UseTCP:       opts.tcp,
+			RetryWithTCP: opts.retryWithTCP,
+			Server:       opts.server,
+		}
+		c = dnsclient.NewDo53Client(config)
+	case "dot":
+		config := &dnsclient.DoTConfig{
+			Config: baseConfig,
+			Server: opts.server,
+		}
+		c = dnsclient.NewDoTClient(config)
+	case "doh":
+		config := &dnsclient.DoHConfig{
+			Config: baseConfig,
+			URL:    opts.server,
+		}
+		c = dnsclient.NewDoHClient(config)
+	default:
+		mu.BUG("invalid proto %q", opts.proto)
+	}
+
+	var mws []dnsclient.Middleware
+	if opts.logQueries {
+		mws = append(mws, dnsclient.Logging(logger))
+	}
+
+	return dnsclient.Chain(c, mws...)
+}
+
+type KeyInfo struct {
+	KeyTag      uint16 `json:"key_tag"`
+	Algorithm   string `json:"algorithm"`
+	Flags       uint16 `json:"flags"`
+	Role        string `json:"role"`
+	Size        int    `json:"size"`
+	TrustAnchor bool   `json:"trust_anchor,omitempty"`
+}
+
+type DSInfo struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  string `json:"algorithm"`
+	DigestType string `json:"digest_type"`
+	Matches    bool   `json:"matches"`
+}
+
+type SigInfo struct {
+	RRset      string    `json:"rrset"`
+	KeyTag     uint16    `json:"key_tag"`
+	Signer     string    `json:"signer"`
+	Inception  time.Time `json:"inception"`
+	Expiration time.Time `json:"expiration"`
+	Valid      bool      `json:"valid"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type Level struct {
+	Zone       string     `json:"zone"`
+	Signed     bool       `json:"signed"`
+	DNSKEYs    []*KeyInfo `json:"dnskeys"`
+	DS         []*DSInfo  `json:"ds,omitempty"`
+	Signatures []*SigInfo `json:"signatures"`
+}
+
+type Report struct {
+	Zone     string   `json:"zone"`
+	Status   string   `json:"status"`
+	Reason   string   `json:"reason"`
+	Levels   []*Level `json:"levels"`
+	Warnings []string `json:"warnings"`
+}
+
+// inspector holds the state of an inspection.
+type inspector struct {
+	c      dnsclient.Client
+	opts   *Options
+	now    time.Time
+	report *Report
+}
+
+func (in *inspector) warnf(format string, a ...any) {
+	in.report.Warnings = append(in.report.Warnings, fmt.Sprintf(format, a...))
+}
+
+// fetch queries for name and qtype, with the DO and CD bits set, so that the
+// resolver returns the signatures even for bogus data.
+func (in *inspector) fetch(name string, qtype uint16) (*dns.Msg, error) {
+	req := dnsclient.NewMsg(in.c.GetConfig(), name, qtype)
+	req.CheckingDisabled = true
+	resp, err := in.c.Query(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s %s query got rcode %s", name, dns.TypeToString[qtype],
+			dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// rrset returns the records of type qtype owned by name, and their RRSIGs.
+func rrset(resp *dns.Msg, name string, qtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == qtype {
+				sigs = append(sigs, sig)
+			}
+		} else if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, sigs
+}
+
+// keySize returns the size, in bits, of key.
+func keySize(key *dns.DNSKEY) int {
+	switch key.Algorithm {
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		return 256
+	case dns.ECDSAP384SHA384:
+		return 384
+	case dns.ED448:
+		return 456
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512:
+		// RFC 3110, section 2: exponent length, exponent, modulus
+		b, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil || len(b) < 1 {
+			return 0
+		}
+		explen, off := int(b[0]), 1
+		if explen == 0 {
+			if len(b) < 3 {
+				return 0
+			}
+			explen, off = int(b[1])<<8|int(b[2]), 3
+		}
+		mod := b[min(off+explen, len(b)):]
+		for len(mod) > 0 && mod[0] == 0 {
+			mod = mod[1:]
+		}
+		if len(mod) == 0 {
+			return 0
+		}
+		return (len(mod)-1)*8 + bits.Len8(mod[0])
+	}
+	return 0
+}
+
+func keyRole(key *dns.DNSKEY) string {
+	switch {
+	case key.Flags&dns.REVOKE != 0:
+		return "revoked"
+	case key.Flags&dns.SEP != 0:
+		return "KSK"
+	}
+	return "ZSK"
+}
+
+// checkSigs records the signatures over an RRset, and warns about those that
+// don't verify with keys or that expire soon.
+func (in *inspector) checkSigs(level *Level, rrs []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) {
+	if len(rrs) == 0 {
+		return
+	}
+	name := rrs[0].Header().Name + " " + dns.TypeToString[rrs[0].Header().Rrtype]
+	if len(sigs) == 0 {
+		if level.Signed {
+			in.warnf("%s has no RRSIG", name)
+		}
+		return
+	}
+
+	for _, sig := range sigs {
+		info := &SigInfo{
+			RRset:      name,
+			KeyTag:     sig.KeyTag,
+			Signer:     sig.SignerName,
+			Inception:  time.Unix(int64(sig.Inception), 0).UTC(),
+			Expiration: time.Unix(int64(sig.Expiration), 0).UTC(),
+		}
+		level.Signatures = append(level.Signatures, info)
+
+		var key *dns.DNSKEY
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm {
+				key = k
+				break
+			}
+		}
+		switch {
+		case key == nil:
+			info.Error = "no DNSKEY with this key tag"
+		case !sig.ValidityPeriod(in.now) && in.now.Before(info.Inception):
+			info.Error = "not yet valid"
+		case !sig.ValidityPeriod(in.now):
+			info.Error = "expired"
+		default:
+			if err := sig.Verify(key, rrs); err != nil {
+				info.Error = err.Error()
+			}
+		}
+		info.Valid = info.Error == ""
+		if !info.Valid {
+			in.warnf("%s: RRSIG by key %d: %s", name, sig.KeyTag, info.Error)
+			continue
+		}
+		if left := info.Expiration.Sub(in.now); left < in.opts.warnExpiry {
+			in.warnf("%s: RRSIG by key %d expires in %s (%s)", name, sig.KeyTag,
+				formatDuration(left), info.Expiration.Format(time.RFC3339))
+		}
+	}
+}
+
+// inspectLevel inspects zone, whose parent's keys are parentKeys.  It
+// returns zone's keys, and false if zone isn't a zone (no SOA at the name).
+func (in *inspector) inspectLevel(zone string, parentKeys []*dns.DNSKEY) ([]*dns.DNSKEY, bool, error) {
+	resp, err := in.fetch(zone, dns.TypeSOA)
+	if err != nil {
+		return nil, false, err
+	}
+	soa, soaSigs := rrset(resp, zone, dns.TypeSOA)
+	if len(soa) == 0 {
+		return nil, false, nil
+	}
+
+	level := &Level{Zone: zone}
+	in.report.Levels = append(in.report.Levels, level)
+
+	resp, err = in.fetch(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, true, err
+	}
+	keyRRs, keySigs := rrset(resp, zone, dns.TypeDNSKEY)
+	keys := msgutil.CollectRRs[*dns.DNSKEY](keyRRs)
+	level.Signed = len(keys) > 0
+
+	var anchors []*dns.DS
+	anchored := false
+	if zone == "." {
+		anchors = dnsclient.DefaultTrustAnchors
+	}
+	for _, key := range keys {
+		info := &KeyInfo{
+			KeyTag:    key.KeyTag(),
+			Algorithm: dns.AlgorithmToString[key.Algorithm],
+			Flags:     key.Flags,
+			Role:      keyRole(key),
+			Size:      keySize(key),
+		}
+		for _, ds := range anchors {
+			digest := key.ToDS(ds.DigestType)
+			if digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				info.TrustAnchor = true
+			}
+		}
+		level.DNSKEYs = append(level.DNSKEYs, info)
+		anchored = anchored || info.TrustAnchor
+	}
+	if zone == "." && !anchored {
+		in.warnf("no DNSKEY of the root zone matches the built-in trust anchors")
+	}
+
+	if zone != "." {
+		resp, err = in.fetch(zone, dns.TypeDS)
+		if err != nil {
+			return keys, true, err
+		}
+		dsRRs, dsSigs := rrset(resp, zone, dns.TypeDS)
+		matched := false
+		for _, ds := range msgutil.CollectRRs[*dns.DS](dsRRs) {
+			info := &DSInfo{
+				KeyTag:     ds.KeyTag,
+				Algorithm:  dns.AlgorithmToString[ds.Algorithm],
+				DigestType: dns.HashToString[ds.DigestType],
+			}
+			for _, key := range keys {
+				digest := key.ToDS(ds.DigestType)
+				if digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+					info.Matches = true
+					matched = true
+				}
+			}
+			level.DS = append(level.DS, info)
+		}
+		switch {
+		case len(dsRRs) > 0 && !level.Signed:
+			in.warnf("%s has DS records at its parent, but no DNSKEY records", zone)
+		case len(dsRRs) > 0 && !matched:
+			in.warnf("%s: no DS record at the parent matches a DNSKEY", zone)
+		case len(dsRRs) == 0 && level.Signed && len(parentKeys) > 0:
+			in.warnf("%s is signed, but has no DS records at its parent", zone)
+		}
+		in.checkSigs(level, dsRRs, dsSigs, parentKeys)
+	}
+
+	in.checkSigs(level, keyRRs, keySigs, keys)
+	in.checkSigs(level, soa, soaSigs, keys)
+
+	resp, err = in.fetch(zone, dns.TypeNS)
+	if err != nil {
+		return keys, true, err
+	}
+	ns, nsSigs := rrset(resp, zone, dns.TypeNS)
+	in.checkSigs(level, ns, nsSigs, keys)
+
+	return keys, true, nil
+}
+
+func (in *inspector) inspect() error {
+	labels := dns.SplitDomainName(in.opts.zone)
+	var parentKeys []*dns.DNSKEY
+	for i := len(labels); i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		keys, isZone, err := in.inspectLevel(zone, parentKeys)
+		if err != nil {
+			return err
+		}
+		if isZone {
+			parentKeys = keys
+		}
+	}
+	return nil
+}
+
+func formatDuration(d time.Duration) string {
+	neg := d < 0
+	if neg {
+		d = -d
+	}
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	s := fmt.Sprintf("%dd%dh", days, d/time.Hour)
+	if days == 0 {
+		s = d.Round(time.Minute).String()
+	}
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+func printReport(r *Report, now time.Time) {
+	fmt.Printf("%s: %s (%s)\n", r.Zone, r.Status, r.Reason)
+	for _, level := range r.Levels {
+		fmt.Printf("\nzone %s", level.Zone)
+		if !level.Signed {
+			fmt.Printf(" (unsigned)")
+		}
+		fmt.Println()
+		for _, ds := range level.DS {
+			match := "no matching DNSKEY"
+			if ds.Matches {
+				match = "matches"
+			}
+			fmt.Printf("  DS      %5d  %-16s %-8s %s\n", ds.KeyTag, ds.Algorithm, ds.DigestType, match)
+		}
+		for _, key := range level.DNSKEYs {
+			anchor := ""
+			if key.TrustAnchor {
+				anchor = "  trust anchor"
+			}
+			fmt.Printf("  DNSKEY  %5d  %-16s flags %-4d %-7s %d bits%s\n", key.KeyTag, key.Algorithm,
+				key.Flags, key.Role, key.Size, anchor)
+		}
+		for _, sig := range level.Signatures {
+			status := "ok, expires in " + formatDuration(sig.Expiration.Sub(now))
+			if !sig.Valid {
+				status = "INVALID: " + sig.Error
+			}
+			fmt.Printf("  RRSIG   %5d  %-24s %s .. %s  %s\n", sig.KeyTag, sig.RRset,
+				sig.Inception.Format(time.RFC3339), sig.Expiration.Format(time.RFC3339), status)
+		}
+	}
+
+	if len(r.Warnings) > 0 {
+		fmt.Println("\nwarnings:")
+		for _, w := range r.Warnings {
+			fmt.Printf("  %s\n", w)
+		}
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	c := newClient(opts)
+	err := c.Dial()
+	if err != nil {
+		mu.Fatalf("failed to connect to DNS server: %v", err)
+	}
+	defer c.Close()
+
+	in := &inspector{
+		c:      c,
+		opts:   opts,
+		now:    time.Now(),
+		report: &Report{Zone: opts.zone, Warnings: []string{}},
+	}
+
+	vc := dnsclient.NewValidatingClient(c, &dnsclient.ValidatorConfig{})
+	_, v, err := vc.QueryValidated(context.Background(), dnsclient.NewMsg(c.GetConfig(), opts.zone, dns.TypeSOA))
+	if err != nil {
+		mu.Fatalf("query failed: %v", err)
+	}
+	in.report.Status = v.Status.String()
+	in.report.Reason = fmt.Sprintf("zone %s: %s", v.Zone, v.Reason)
+	if v.Status != dnsclient.ValidationSecure && v.Status != dnsclient.ValidationInsecure {
+		in.warnf("%s is %s", opts.zone, v)
+	}
+
+	err = in.inspect()
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(in.report); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	} else {
+		printReport(in.report, in.now)
+	}
+
+	if len(in.report.Warnings) > 0 {
+		c.Close()
+		os.Exit(2)
+	}
+}
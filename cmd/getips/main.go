@@ -3,12 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/cmdutil"
 	"github.com/syslab-wm/dnsclient/internal/defaults"
 	"github.com/syslab-wm/dnsclient/internal/netx"
 	"github.com/syslab-wm/mu"
@@ -40,10 +42,15 @@ general options:
     and port 853 is used for DoT.  For DoH, SERVER is the URL of the
     DoH service.
 
-    The default is to use CloudFlare's open resolver at 1.1.1.1
+    For Do53, the default is to use the nameservers and search list in
+    /etc/resolv.conf, along with its timeout option (unless -timeout is
+    given); if the file can't be read, CloudFlare's open resolver at 1.1.1.1
+    is used.  For DoT and DoH, the default is CloudFlare's open resolver
     (for DoH, the URL is https://cloudflare-dns.com/dns-query).
 
-    Default: 1.1.1.1 (Cloudflare's open resolver)
+    With the Do53 default, A, AAAA and PTR queries for the names and
+    addresses in /etc/hosts are answered from it, as the system's resolver
+    does.
 
   -timeout TIMEOUT
     The timeout for the DNS request (e.g. 500ms, 1.5s).
@@ -59,6 +66,9 @@ general options:
     Request DNSSEC records be sent by setting the DNSSEC OK bit (DO) in the OPT
     record in the additional section of the query.
 
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
   -help
     Display this usage statement and exit.
 
@@ -68,7 +78,8 @@ Do53-specific options:
 
   -retry-with-tcp
     For Do53 using UDP, if the DNS response is truncated, then
-    re-issue the query over TCP.
+    re-issue the query over TCP.  Without -server, this is always
+    done, as the system's resolver does.
 
 
 examples:
@@ -79,11 +90,12 @@ type Options struct {
 	// positional
 	domainname string
 	// general options
-	proto     string
-	server    string
-	timeout   time.Duration
-	maxCNAMEs int
-	dnssec    bool
+	proto      string
+	server     string
+	timeout    time.Duration
+	maxCNAMEs  int
+	dnssec     bool
+	logQueries bool
 	// do53-specific options
 	tcp          bool
 	retryWithTCP bool
@@ -110,6 +122,7 @@ func parseOptions() *Options {
 	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", defaults.MaxCNAMEs, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
 	// do53-specific options
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.BoolVar(&opts.retryWithTCP, "retry-with-tcp", false, "")
@@ -132,9 +145,8 @@ func parseOptions() *Options {
 			mu.Fatalf("error: can't specify both -tcp and -retry-with-tcp")
 		}
 
-		if opts.server == "" {
-			opts.server = defaults.Do53Server
-		} else {
+		// if no server is given, newClient uses resolv.conf
+		if opts.server != "" {
 			opts.server = tryAddDefaultPort(opts.server, defaults.Do53Port)
 		}
 	}
@@ -168,16 +180,26 @@ func parseOptions() *Options {
 
 func newClient(opts *Options) dnsclient.Client {
 	var c dnsclient.Client
+	var logger *slog.Logger
+
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
 
 	baseConfig := dnsclient.Config{
 		RecursionDesired: true,
 		Timeout:          opts.timeout,
 		MaxCNAMEs:        opts.maxCNAMEs,
 		DNSSEC:           opts.dnssec,
+		Logger:           logger,
 	}
 
 	switch opts.proto {
 	case "do53":
+		if opts.server == "" {
+			c = cmdutil.NewResolvConfClient(baseConfig, opts.tcp)
+			break
+		}
 		config := &dnsclient.Do53Config{
 			Config:       baseConfig,
 			UseTCP:       opts.tcp,
@@ -201,7 +223,12 @@ func newClient(opts *Options) dnsclient.Client {
 		mu.BUG("invalid proto %q", opts.proto)
 	}
 
-	return c
+	var mws []dnsclient.Middleware
+	if opts.logQueries {
+		mws = append(mws, dnsclient.Logging(logger))
+	}
+
+	return dnsclient.Chain(c, mws...)
 }
 
 func main() {
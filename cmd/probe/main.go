@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
@@ -66,6 +67,9 @@ general options:
     Request DNSSEC records be sent by setting the DNSSEC OK bit (DO) in the OPT
     record in the additional section of the query.
 
+  -log-queries
+    Log each DNS query and its outcome to stderr.
+
   -help
     Display this usage statement and exit.
 
@@ -88,11 +92,12 @@ type Options struct {
 	server     string
 	domainname string
 	// general options
-	probeType string
-	proto     string
-	timeout   time.Duration
-	maxCNAMEs int
-	dnssec    bool
+	probeType  string
+	proto      string
+	timeout    time.Duration
+	maxCNAMEs  int
+	dnssec     bool
+	logQueries bool
 	// do53-specific options
 	tcp          bool
 	retryWithTCP bool
@@ -119,6 +124,7 @@ func parseOptions() *Options {
 	flag.DurationVar(&opts.timeout, "timeout", defaults.Timeout, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", defaults.MaxCNAMEs, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
+	flag.BoolVar(&opts.logQueries, "log-queries", false, "")
 	// do53-specific options
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.BoolVar(&opts.retryWithTCP, "retry-with-tcp", false, "")
@@ -182,12 +188,18 @@ func parseOptions() *Options {
 
 func newClient(opts *Options) dnsclient.Client {
 	var c dnsclient.Client
+	var logger *slog.Logger
+
+	if opts.logQueries {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
 
 	baseConfig := dnsclient.Config{
 		RecursionDesired: true,
 		Timeout:          opts.timeout,
 		MaxCNAMEs:        opts.maxCNAMEs,
 		DNSSEC:           opts.dnssec,
+		Logger:           logger,
 	}
 
 	switch opts.proto {
@@ -215,7 +227,12 @@ func newClient(opts *Options) dnsclient.Client {
 		mu.BUG("invalid proto %q", opts.proto)
 	}
 
-	return c
+	var mws []dnsclient.Middleware
+	if opts.logQueries {
+		mws = append(mws, dnsclient.Logging(logger))
+	}
+
+	return dnsclient.Chain(c, mws...)
 }
 
 func doNSIDProbe(c dnsclient.Client, domainname string) {
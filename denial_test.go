@@ -0,0 +1,289 @@
+package dnsclient
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// denialZone is the content of the zone that the proofs are built from: each
+// name with the types at it.  b.example. and wild.example. are empty
+// non-terminals.
+var denialZone = map[string][]uint16{
+	"example.":        {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeRRSIG},
+	"www.example.":    {dns.TypeA, dns.TypeRRSIG},
+	"a.b.example.":    {dns.TypeA, dns.TypeRRSIG},
+	"*.wild.example.": {dns.TypeTXT, dns.TypeRRSIG},
+	"sub.example.":    {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG},
+	"alias.example.":  {dns.TypeCNAME, dns.TypeRRSIG},
+	"old.example.":    {dns.TypeDNAME, dns.TypeRRSIG},
+}
+
+func sortedNames(names map[string][]uint16) []string {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return msgutil.CompareNames(sorted[i], sorted[j]) < 0 })
+	return sorted
+}
+
+// nsecChain returns the NSEC records of a zone with the given names, which
+// must not include empty non-terminals.
+func nsecChain(names map[string][]uint16) []dns.RR {
+	sorted := sortedNames(names)
+	var rrs []dns.RR
+	for i, name := range sorted {
+		rrs = append(rrs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET},
+			NextDomain: sorted[(i+1)%len(sorted)],
+			TypeBitMap: append([]uint16{dns.TypeNSEC}, names[name]...),
+		})
+	}
+	return rrs
+}
+
+// nsec3Chain returns the NSEC3 records of zone for the given names (empty
+// non-terminals included).
+func nsec3Chain(zone string, names map[string][]uint16, flags uint8, iterations uint16) []dns.RR {
+	type entry struct {
+		hash  string
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{dns.HashName(name, dns.SHA1, iterations, "ab"), types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+
+	var rrs []dns.RR
+	for i, e := range entries {
+		rrs = append(rrs, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(e.hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: iterations,
+			SaltLength: 1,
+			Salt:       "ab",
+			HashLength: 20,
+			NextDomain: entries[(i+1)%len(entries)].hash,
+			TypeBitMap: e.types,
+		})
+	}
+	return rrs
+}
+
+// withENTs adds the empty non-terminals of denialZone.
+func withENTs(names map[string][]uint16) map[string][]uint16 {
+	all := map[string][]uint16{"b.example.": nil, "wild.example.": nil}
+	for name, types := range names {
+		all[name] = types
+	}
+	return all
+}
+
+// without returns rrs without the record that matches (NSEC: is owned by;
+// NSEC3: hashes from) name, or the record that covers name.
+func without(rrs []dns.RR, name string) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if equalNames(rr.Hdr.Name, name) || msgutil.NSECCovers(rr, name) {
+				continue
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) || rr.Cover(name) {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+type denialTest struct {
+	name   string
+	rrs    []dns.RR
+	check  func(d *denial) *Validation
+	status ValidationStatus
+	reason string // a substring of the reason
+}
+
+func runDenialTests(t *testing.T, tests []denialTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.check(newDenial("example.", tt.rrs, DefaultMaxNSEC3Iterations))
+			if v.Status != tt.status {
+				t.Errorf("got %v, want %s", v, tt.status)
+			}
+			if !strings.Contains(v.Reason, tt.reason) {
+				t.Errorf("the reason %q doesn't mention %q", v.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func nxdomain(qname string) func(d *denial) *Validation {
+	return func(d *denial) *Validation { return d.nxdomain(qname) }
+}
+
+func nodata(qname string, qtype uint16) func(d *denial) *Validation {
+	return func(d *denial) *Validation { return d.nodata(qname, qtype) }
+}
+
+func wildcardAnswer(qname string, labels int) func(d *denial) *Validation {
+	return func(d *denial) *Validation { return d.wildcardAnswer(qname, labels) }
+}
+
+func TestNSECDenial(t *testing.T) {
+	chain := nsecChain(denialZone)
+
+	runDenialTests(t, []denialTest{
+		{"nxdomain", chain, nxdomain("nope.example."), ValidationSecure, "do not exist"},
+		{"nxdomain below an existing name", chain, nxdomain("x.www.example."), ValidationSecure,
+			"*.www.example."},
+		{"nxdomain for an existing name", chain, nxdomain("www.example."), ValidationBogus,
+			"shows that www.example. exists"},
+		{"nxdomain without a cover", without(chain, "nope.example."), nxdomain("nope.example."),
+			ValidationBogus, "no NSEC record proves that nope.example."},
+		{"nxdomain without a wildcard cover", without(chain, "*.example."), nxdomain("nope.example."),
+			ValidationBogus, "the wildcard *.example."},
+		{"nxdomain with a wildcard", chain, nxdomain("x.y.wild.example."), ValidationBogus,
+			"the wildcard *.wild.example. exists"},
+		{"no records", nil, nxdomain("nope.example."), ValidationBogus, "no NSEC or NSEC3 records"},
+		// the delegation's NSEC record covers foo.sub.example., but the
+		// name is in the child zone
+		{"nxdomain below a delegation", chain, nxdomain("foo.sub.example."), ValidationBogus,
+			"no NSEC record proves that foo.sub.example."},
+		{"nxdomain below a dname", chain, nxdomain("foo.old.example."), ValidationBogus,
+			"no NSEC record proves that foo.old.example."},
+
+		{"nodata", chain, nodata("www.example.", dns.TypeAAAA), ValidationSecure, "has no AAAA"},
+		{"nodata for an existing type", chain, nodata("www.example.", dns.TypeA), ValidationBogus,
+			"lists type A"},
+		{"nodata for a cname", chain, nodata("alias.example.", dns.TypeA), ValidationBogus,
+			"lists type CNAME"},
+		{"nodata from the parent side", chain, nodata("sub.example.", dns.TypeA), ValidationBogus,
+			"parent side of a delegation"},
+		{"nodata for a ds at an apex", chain, nodata("example.", dns.TypeDS), ValidationBogus,
+			"from the child zone"},
+		{"empty non-terminal", chain, nodata("b.example.", dns.TypeA), ValidationSecure,
+			"empty non-terminal"},
+		{"wildcard nodata", chain, nodata("x.wild.example.", dns.TypeA), ValidationSecure,
+			"*.wild.example."},
+		{"wildcard nodata for an existing type", chain, nodata("x.wild.example.", dns.TypeTXT),
+			ValidationBogus, "lists type TXT"},
+		{"nodata without a match or cover", without(chain, "nope.example."),
+			nodata("nope.example.", dns.TypeA), ValidationBogus, "matches or covers"},
+		{"nodata below a delegation", chain, nodata("foo.sub.example.", dns.TypeA), ValidationBogus,
+			"matches or covers foo.sub.example."},
+
+		{"wildcard answer", chain, wildcardAnswer("x.wild.example.", 2), ValidationSecure,
+			"synthesized from a wildcard"},
+		{"wildcard answer for an existing name", chain, wildcardAnswer("www.example.", 1),
+			ValidationBogus, "doesn't exist"},
+	})
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	names := withENTs(denialZone)
+	chain := nsec3Chain("example.", names, 0, 0)
+
+	// with opt-out, the unsigned delegation unsigned.example. has no NSEC3
+	// record of its own
+	optOut := nsec3Chain("example.", names, nsec3OptOut, 0)
+
+	runDenialTests(t, []denialTest{
+		{"nxdomain", chain, nxdomain("nope.example."), ValidationSecure, "closest encloser example."},
+		{"nxdomain with a deeper closest encloser", chain, nxdomain("x.y.b.example."), ValidationSecure,
+			"closest encloser b.example."},
+		{"nxdomain for an existing name", chain, nxdomain("www.example."), ValidationBogus,
+			"shows that www.example. exists"},
+		{"nxdomain without a next closer cover", without(chain, "nope.example."),
+			nxdomain("nope.example."), ValidationBogus, "no NSEC3 closest encloser proof"},
+		// (the record that covers *.example. doesn't also cover
+		// missing.example.)
+		{"nxdomain without a wildcard cover", without(chain, "*.example."), nxdomain("missing.example."),
+			ValidationBogus, "covers the wildcard *.example."},
+		{"nxdomain with a wildcard", chain, nxdomain("x.y.wild.example."), ValidationBogus,
+			"the wildcard *.wild.example. exists"},
+		{"opt-out nxdomain", optOut, nxdomain("nope.example."), ValidationInsecure, "opt-out"},
+		// sub.example. matches, but is a delegation
+		{"nxdomain below a delegation", chain, nxdomain("foo.sub.example."), ValidationBogus,
+			"no NSEC3 closest encloser proof"},
+		{"nxdomain below a dname", chain, nxdomain("foo.old.example."), ValidationBogus,
+			"no NSEC3 closest encloser proof"},
+		{"too many iterations", nsec3Chain("example.", names, 0, DefaultMaxNSEC3Iterations+1),
+			nxdomain("nope.example."), ValidationInsecure, "more than 150 iterations"},
+		{"iterations at the limit", nsec3Chain("example.", names, 0, DefaultMaxNSEC3Iterations),
+			nxdomain("nope.example."), ValidationSecure, "closest encloser"},
+
+		{"nodata", chain, nodata("www.example.", dns.TypeAAAA), ValidationSecure, "has no AAAA"},
+		{"nodata for an existing type", chain, nodata("www.example.", dns.TypeA), ValidationBogus,
+			"lists type A"},
+		{"empty non-terminal", chain, nodata("b.example.", dns.TypeA), ValidationSecure,
+			"b.example. has no A"},
+		{"wildcard nodata", chain, nodata("x.wild.example.", dns.TypeA), ValidationSecure,
+			"*.wild.example. has no A"},
+		{"wildcard nodata without the wildcard", without(chain, "*.wild.example."),
+			nodata("x.wild.example.", dns.TypeA), ValidationBogus, "no NSEC3 record matches"},
+		{"nodata below a delegation", chain, nodata("foo.sub.example.", dns.TypeA), ValidationBogus,
+			"no closest encloser proof"},
+		{"ds nodata", chain, nodata("sub.example.", dns.TypeDS), ValidationBogus, "lists type DS"},
+		{"ds nodata without a match", chain, nodata("unsigned.example.", dns.TypeDS), ValidationBogus,
+			"no NSEC3 record matches unsigned.example."},
+		{"opt-out ds nodata", optOut, nodata("unsigned.example.", dns.TypeDS), ValidationInsecure,
+			"opt-out"},
+
+		{"wildcard answer", chain, wildcardAnswer("x.wild.example.", 2), ValidationSecure,
+			"synthesized from a wildcard"},
+		{"wildcard answer without a next closer cover", without(chain, "x.wild.example."),
+			wildcardAnswer("x.wild.example.", 2), ValidationBogus, "next closer name x.wild.example."},
+	})
+}
+
+func TestNSEC3ClosestEncloser(t *testing.T) {
+	d := newDenial("example.", nsec3Chain("example.", withENTs(denialZone), 0, 0), DefaultMaxNSEC3Iterations)
+
+	tests := []struct {
+		qname string
+		ce    string
+		nc    string
+	}{
+		{"nope.example.", "example.", "nope.example."},
+		{"x.y.b.example.", "b.example.", "y.b.example."},
+		{"x.a.b.example.", "a.b.example.", "x.a.b.example."},
+	}
+	for _, tt := range tests {
+		ce, nc, ok := d.nsec3ClosestEncloser(tt.qname)
+		if !ok {
+			t.Errorf("%s: no closest encloser proof", tt.qname)
+			continue
+		}
+		if ce != tt.ce {
+			t.Errorf("%s: got closest encloser %s, want %s", tt.qname, ce, tt.ce)
+		}
+		if !nc.Cover(tt.nc) {
+			t.Errorf("%s: the NSEC3 record %v doesn't cover the next closer name %s", tt.qname, nc, tt.nc)
+		}
+	}
+}
+
+func TestNewDenialFiltersNSEC3(t *testing.T) {
+	chain := nsec3Chain("example.", withENTs(denialZone), 0, 0)
+
+	unknownFlags := dns.Copy(chain[0]).(*dns.NSEC3)
+	unknownFlags.Flags = 2
+	otherZone := dns.Copy(chain[1]).(*dns.NSEC3)
+	otherZone.Hdr.Name = strings.Replace(otherZone.Hdr.Name, "example.", "sub.example.", 1)
+
+	d := newDenial("example.", []dns.RR{unknownFlags, otherZone, chain[2]}, DefaultMaxNSEC3Iterations)
+	if len(d.nsec3s) != 1 {
+		t.Errorf("got %d NSEC3 records, want 1: %v", len(d.nsec3s), d.nsec3s)
+	}
+}
@@ -3,25 +3,15 @@ package dnsclient
 import (
 	"errors"
 	"fmt"
-	"log"
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/adt/set"
-	"github.com/syslab-wm/dnsclient/internal/msgutil"
 	"github.com/syslab-wm/functools"
 	"github.com/syslab-wm/mu"
 )
 
-func lookupPTR(c Client, domain string) ([]*dns.PTR, error) {
-	resp, err := Lookup(c, domain, dns.TypePTR)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.PTR](resp.Answer), nil
-}
-
 func lookupOnePTR(c Client, domain string) (*dns.PTR, error) {
-	ptrs, err := lookupPTR(c, domain)
+	ptrs, err := LookupRRs[*dns.PTR](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +19,7 @@ func lookupOnePTR(c Client, domain string) (*dns.PTR, error) {
 }
 
 func getPTR(c Client, domain string) ([]string, error) {
-	ptrs, err := lookupPTR(c, domain)
+	ptrs, err := LookupRRs[*dns.PTR](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -47,32 +37,16 @@ func getOnePTR(c Client, domain string) (string, error) {
 	return ptr.Ptr, nil
 }
 
-func lookupSRV(c Client, domain string) ([]*dns.SRV, error) {
-	resp, err := Lookup(c, domain, dns.TypeSRV)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.SRV](resp.Answer), nil
-}
-
 func lookupOneSRV(c Client, domain string) (*dns.SRV, error) {
-	srvs, err := lookupSRV(c, domain)
+	srvs, err := LookupRRs[*dns.SRV](c, domain)
 	if err != nil {
 		return nil, err
 	}
 	return srvs[0], nil
 }
 
-func lookupTXT(c Client, domain string) ([]*dns.TXT, error) {
-	resp, err := Lookup(c, domain, dns.TypeTXT)
-	if err != nil {
-		return nil, err
-	}
-	return msgutil.CollectRRs[*dns.TXT](resp.Answer), nil
-}
-
 func lookupOneTXT(c Client, domain string) (*dns.TXT, error) {
-	txts, err := lookupTXT(c, domain)
+	txts, err := LookupRRs[*dns.TXT](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +54,7 @@ func lookupOneTXT(c Client, domain string) (*dns.TXT, error) {
 }
 
 func getTXT(c Client, domain string) ([][]string, error) {
-	txts, err := lookupTXT(c, domain)
+	txts, err := LookupRRs[*dns.TXT](c, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -116,31 +90,32 @@ func GetLegacyServiceBrowserDomain(c Client, domain string) (string, error) {
 func GetAllServiceBrowserDomains(c Client, domain string) ([]string, error) {
 	var errs []error
 	domainSet := set.New[string]()
+	logger := c.GetConfig().logger().With("domain", domain)
 
 	names, err := GetServiceBrowserDomains(c, domain)
 	if err != nil {
-		log.Printf("GetServiceBrowserDomains: err: %v", err)
+		logger.Debug("no service browser domains", "err", err)
 		errs = append(errs, err)
 	} else {
-		log.Printf("GetServiceBrowserDomains: names: %v", names)
+		logger.Debug("found service browser domains", "names", names)
 		domainSet.Add(names...)
 	}
 
 	name, err := GetDefaultServiceBrowserDomain(c, domain)
 	if err != nil {
-		log.Printf("GetDefaultServiceBrowserDomain: err: %v", err)
+		logger.Debug("no default service browser domain", "err", err)
 		errs = append(errs, err)
 	} else {
-		log.Printf("GetDefaultServiceBrowserDomain: name: %s", name)
+		logger.Debug("found default service browser domain", "name", name)
 		domainSet.Add(name)
 	}
 
 	name, err = GetLegacyServiceBrowserDomain(c, domain)
 	if err != nil {
-		log.Printf("GetLegacyServiceBrowserDomain: err: %v", err)
+		logger.Debug("no legacy service browser domain", "err", err)
 		errs = append(errs, err)
 	} else {
-		log.Printf("GetLegacyServiceBrowserDomain: name: %s", name)
+		logger.Debug("found legacy service browser domain", "name", name)
 		domainSet.Add(name)
 	}
 
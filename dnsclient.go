@@ -1,11 +1,15 @@
 package dnsclient
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/syslab-wm/dnsclient/internal/msgutil"
 )
 
 // This is configuration that applies to all typs of clients -- it deals purely
@@ -16,6 +20,9 @@ type Config struct {
 	Timeout          time.Duration
 	MaxCNAMEs        int
 	DNSSEC           bool
+	Retry            RetryPolicy
+	Metrics          Metrics      // optional
+	Logger           *slog.Logger // optional; if nil, nothing is logged
 }
 
 type Client interface {
@@ -25,6 +32,73 @@ type Client interface {
 	Query(req *dns.Msg) (*dns.Msg, error)
 }
 
+// Upstream is implemented by clients that send their queries to a single
+// server over a single transport.  Server is the server's address (host:port)
+// or, for DoH, its URL.
+type Upstream interface {
+	Transport() Transport
+	Server() string
+}
+
+// UpstreamOf returns the Upstream that c sends its queries to, looking
+// through any wrappers (such as middleware) that have an Unwrap() Client
+// method.
+func UpstreamOf(c Client) (Upstream, bool) {
+	for {
+		if u, ok := c.(Upstream); ok {
+			return u, true
+		}
+		w, ok := c.(interface{ Unwrap() Client })
+		if !ok {
+			return nil, false
+		}
+		c = w.Unwrap()
+	}
+}
+
+// upstreamAddrPort returns the address and port of an Upstream's server, if
+// the server is given as an IP address (rather than a hostname).
+func upstreamAddrPort(transport Transport, server string) (netip.AddrPort, bool) {
+	if transport != TransportDoH {
+		ap, err := netip.ParseAddrPort(server)
+		return ap, err == nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	port := uint16(443)
+	if u.Port() != "" {
+		p, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, false
+		}
+		port = uint16(p)
+	}
+	return netip.AddrPortFrom(addr, port), true
+}
+
+// ContextClient is a Client whose queries can be abandoned early by
+// cancelling a context.
+type ContextClient interface {
+	Client
+	QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// queryContext issues req on c, giving up once ctx is done.  If c does not
+// implement ContextClient, the query runs to completion regardless of ctx.
+func queryContext(ctx context.Context, c Client, req *dns.Msg) (*dns.Msg, error) {
+	if cc, ok := c.(ContextClient); ok {
+		return cc.QueryContext(ctx, req)
+	}
+	return c.Query(req)
+}
+
 type DNSErr int
 
 const (
@@ -36,6 +110,9 @@ const (
 	DNSErrMaxCNAMEs
 
 	DNSErrBadFormatAnswer
+	DNSErrInvalidDNAME
+
+	DNSErrIDMismatch
 )
 
 var DNSErrToString = map[DNSErr]string{
@@ -47,23 +124,65 @@ var DNSErrToString = map[DNSErr]string{
 	DNSErrMaxCNAMEs:         "query followed max number of CNAMEs",
 
 	DNSErrBadFormatAnswer: "DNS response has an answer where the data does not conform to the RR type",
+	DNSErrInvalidDNAME:    "DNS response contains a DNAME that doesn't match its synthesized CNAME",
+
+	DNSErrIDMismatch: "DNS response ID doesn't match the query ID",
 }
 
 type DNSError struct {
 	Reason   DNSErr
 	Response *dns.Msg // optional
+	Attempts int      // attempts made for the final query; 0 if unknown
+	// ExtendedErrors are the Extended DNS Errors in Response, which often
+	// say why the query failed (e.g., "DNSSEC Bogus", or "Blocked").
+	ExtendedErrors []*ExtendedError
 }
 
 func NewDNSError(reason DNSErr, response *dns.Msg) *DNSError {
-	return &DNSError{Reason: reason, Response: response}
+	return &DNSError{
+		Reason:         reason,
+		Response:       response,
+		ExtendedErrors: ExtendedErrors(response),
+	}
 }
 
 func (e *DNSError) Error() string {
+	var s string
 	if e.Reason == DNSErrRcodeNotSuccess {
-		return fmt.Sprintf("%s: %s (rcode=%d)", DNSErrToString[e.Reason],
+		s = fmt.Sprintf("%s: %s (rcode=%d)", DNSErrToString[e.Reason],
 			dns.RcodeToString[e.Response.Rcode], e.Response.Rcode)
+	} else {
+		s = DNSErrToString[e.Reason]
+	}
+	if e.Attempts > 1 {
+		s = fmt.Sprintf("%s (after %d attempts)", s, e.Attempts)
+	}
+	if e.Authenticated() {
+		s += " (authenticated)"
+	}
+	if len(e.ExtendedErrors) > 0 {
+		s = fmt.Sprintf("%s [EDE: %s]", s, FormatExtendedErrors(e.ExtendedErrors))
+	}
+	return s
+}
+
+// Authenticated reports whether the response is an authenticated denial of
+// existence: an NXDOMAIN or NODATA response with the AD bit set.  The AD bit
+// is set by a validating upstream resolver or, if the query went through a
+// ValidatingClient, only when the NSEC or NSEC3 records in the response were
+// verified to prove the denial.  An unsigned (or unverified) negative
+// response is not authenticated.
+func (e *DNSError) Authenticated() bool {
+	if e.Response == nil || !e.Response.AuthenticatedData {
+		return false
+	}
+	switch e.Reason {
+	case DNSErrRcodeNotSuccess:
+		return e.Response.Rcode == dns.RcodeNameError
+	case DNSErrMissingAnswer:
+		return true
 	}
-	return fmt.Sprintf("%s", DNSErrToString[e.Reason])
+	return false
 }
 
 func NewMsg(config *Config, name string, qtype uint16) *dns.Msg {
@@ -78,15 +197,45 @@ func NewMsg(config *Config, name string, qtype uint16) *dns.Msg {
 	return m
 }
 
-func query(c Client, req *dns.Msg) (*dns.Msg, error) {
-	resp, err := c.Query(req)
+// idMatches reports whether resp's ID is that of req.  Over DoH, a response
+// may also have an ID of 0 (RFC 8484, section 4.1).
+func idMatches(c Client, req, resp *dns.Msg) bool {
+	if resp.Id == req.Id {
+		return true
+	}
+	u, ok := UpstreamOf(c)
+	return resp.Id == 0 && ok && u.Transport() == TransportDoH
+}
+
+// query issues req, retrying according to c's retry policy, and returns the
+// number of attempts made along with the outcome.
+func query(ctx context.Context, c Client, req *dns.Msg) (*dns.Msg, int, error) {
+	logger := c.GetConfig().logger()
+
+	resp, attempts, err := queryWithRetry(ctx, c, req)
 	if err != nil {
-		return nil, err
+		logger.Warn("dns query failed", append(questionAttrs(req),
+			"attempts", attempts, "err", err)...)
+		if attempts > 1 {
+			err = fmt.Errorf("query failed after %d attempts: %w", attempts, err)
+		}
+		return nil, attempts, err
+	}
+	if !idMatches(c, req, resp) {
+		logger.Warn("dns response has the wrong ID", append(questionAttrs(req),
+			"attempts", attempts, "id", resp.Id)...)
+		e := NewDNSError(DNSErrIDMismatch, resp)
+		e.Attempts = attempts
+		return nil, attempts, e
 	}
 	if resp.Rcode != dns.RcodeSuccess {
-		return nil, NewDNSError(DNSErrRcodeNotSuccess, resp)
+		logger.Debug("dns query got an unsuccessful rcode", append(questionAttrs(req),
+			"attempts", attempts, "rcode", dns.RcodeToString[resp.Rcode])...)
+		e := NewDNSError(DNSErrRcodeNotSuccess, resp)
+		e.Attempts = attempts
+		return nil, attempts, e
 	}
-	return resp, nil
+	return resp, attempts, nil
 }
 
 // Return an error if:
@@ -97,6 +246,11 @@ func query(c Client, req *dns.Msg) (*dns.Msg, error) {
 //     malformed CNAME (namely, an invalid CNAME chain in an answer; this should be rare)
 //   - The config is set to follow CNAMES, and we reached MaxCNAMEs
 //     without getting an answer
+//   - a DNAME in the answer doesn't agree with the CNAME synthesized from it
+//     (or its substitution produces an invalid name)
+//
+// Aliases are followed from DNAME records (RFC 6672) as well as CNAME
+// records, and names are compared case-insensitively.
 //
 // In other words, if we ergonomics are such that if the caller invokes:
 //
@@ -110,10 +264,39 @@ func query(c Client, req *dns.Msg) (*dns.Msg, error) {
 // nitty-gritty details of why the query didn't get an answer, it can inspect
 // the error value.
 func Query(c Client, req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := queryAliases(context.Background(), c, req)
+	return resp, err
+}
+
+// QueryContext is like Query, but gives up once ctx is done, including while
+// waiting to retry.
+func QueryContext(ctx context.Context, c Client, req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := queryAliases(ctx, c, req)
+	return resp, err
+}
+
+// QueryAliases is like Query, but also returns the alias chain (the CNAME
+// and DNAME hops, in order) that led from the qname to the answer.  The
+// aliases are returned even on error, as far as they were followed.
+func QueryAliases(c Client, req *dns.Msg) (*dns.Msg, []*Alias, error) {
+	return queryAliases(context.Background(), c, req)
+}
+
+func queryAliases(ctx context.Context, c Client, req *dns.Msg) (*dns.Msg, []*Alias, error) {
 	var err error
-	var cnames []*dns.CNAME
+	var aliases []*Alias
 	var resp *dns.Msg
+	var attempts int
 	config := c.GetConfig()
+	logger := config.logger()
+
+	newDNSError := func(reason DNSErr) *DNSError {
+		logger.Debug("dns response does not answer the query", append(questionAttrs(req),
+			"reason", DNSErrToString[reason])...)
+		e := NewDNSError(reason, resp)
+		e.Attempts = attempts
+		return e
+	}
 	qtype := req.Question[0].Qtype
 
 	// if following CNAMES, req will change; thus, make a copy so it
@@ -123,68 +306,59 @@ func Query(c Client, req *dns.Msg) (*dns.Msg, error) {
 	}
 
 	for i := 0; i <= config.MaxCNAMEs; i++ {
-		resp, err = query(c, req)
+		resp, attempts, err = query(ctx, c, req)
 		if err != nil {
-			return nil, err
-		}
-
-		// gather all RRs that are of the qtype
-		var ans []dns.RR
-		for _, rr := range resp.Answer {
-			if rr.Header().Rrtype == qtype {
-				ans = append(ans, rr)
-				// if such an RR matches on the name we're searching for, it's a
-				// direct hit
-				if rr.Header().Name == req.Question[0].Name {
-					return resp, nil
-				}
-			}
-		}
-
-		// if we're following CNAMEs, get all of the CNAMES from the answer
-		cnames = msgutil.CollectRRs[*dns.CNAME](resp.Answer)
-		if len(cnames) == 0 {
-			return nil, NewDNSError(DNSErrMissingAnswer, resp)
+			return nil, aliases, err
 		}
 
-		// validate that the CNAMEs form a chain
-		ordered := msgutil.OrderCNAMEs(cnames)
-		if !ordered {
-			return nil, NewDNSError(DNSErrInvalidCNAMEChain, resp)
-
+		name, hops, answered, reason := followAliases(resp.Answer, req.Question[0].Name, qtype)
+		aliases = append(aliases, hops...)
+		if reason != nil {
+			return nil, aliases, newDNSError(*reason)
 		}
-		// the head of the chain must match the name we're searching for
-		if cnames[0].Hdr.Name != req.Question[0].Name {
-			return nil, NewDNSError(DNSErrInvalidCNAMEChain, resp)
+		if answered {
+			logger.Debug("dns query answered", append(questionAttrs(req),
+				"attempts", attempts, "answers", len(resp.Answer), "aliases", len(aliases))...)
+			return resp, aliases, nil
 		}
 
-		// is the last CNAME in chain an alias for one of the RRs that are of
-		// the qtype we're searching for.  If so, success.
-		lastCNAME := cnames[len(cnames)-1]
-		for _, rr := range ans {
-			if lastCNAME.Target == rr.Header().Name {
-				return resp, nil
+		var ans, redirects int
+		for _, rr := range resp.Answer {
+			switch rr.Header().Rrtype {
+			case qtype:
+				ans++
+			case dns.TypeCNAME, dns.TypeDNAME:
+				redirects++
 			}
 		}
-
-		if len(ans) > 0 {
+		if ans > 0 {
 			// a really weird case: the resp has record types we're searching
 			// for, but not for an alias of a name we're searching for
-			return nil, NewDNSError(DNSErrInvalidAnswer, resp)
+			return nil, aliases, newDNSError(DNSErrInvalidAnswer)
+		}
+		if len(hops) == 0 {
+			if redirects > 0 {
+				// the aliases don't start at the name we're searching for
+				return nil, aliases, newDNSError(DNSErrInvalidCNAMEChain)
+			}
+			return nil, aliases, newDNSError(DNSErrMissingAnswer)
 		}
 
-		// update the domain name to query; TODO: get Qtype
-		req.SetQuestion(dns.Fqdn(cnames[len(cnames)-1].Target), qtype)
-	}
-
-	if len(cnames) > 0 {
-		return nil, NewDNSError(DNSErrMaxCNAMEs, resp)
+		if i == config.MaxCNAMEs {
+			break
+		}
+		logger.Debug("following alias chain", "from", req.Question[0].Name,
+			"to", name, "hops", len(hops))
+		req.SetQuestion(dns.Fqdn(name), qtype)
 	}
 
-	return nil, NewDNSError(DNSErrMissingAnswer, resp)
+	return nil, aliases, newDNSError(DNSErrMaxCNAMEs)
 }
 
+// Lookup queries for the qtype records of name, as Query does.  If c (or a
+// client that it wraps) is a Searcher, such as a ResolvConfClient, name is
+// expanded with its search list.
 func Lookup(c Client, name string, qtype uint16) (*dns.Msg, error) {
-	req := NewMsg(c.GetConfig(), name, qtype)
-	return Query(c, req)
+	_, resp, _, err := lookup(c, name, qtype)
+	return resp, err
 }
@@ -0,0 +1,897 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// ValidationStatus is the outcome of DNSSEC validation, as defined in RFC
+// 4033, section 5.
+type ValidationStatus int
+
+const (
+	// ValidationIndeterminate means that the validator couldn't tell
+	// whether the data should be signed (e.g., there is no trust anchor for
+	// it, or the records needed to decide couldn't be fetched).
+	ValidationIndeterminate ValidationStatus = iota
+	// ValidationSecure means that there is an unbroken chain of trust from
+	// a trust anchor to the data.
+	ValidationSecure
+	// ValidationInsecure means that there is proof that the data is in an
+	// unsigned zone (or a zone signed only with unsupported algorithms).
+	ValidationInsecure
+	// ValidationBogus means that the data should be signed, but the chain
+	// of trust is broken: signatures are missing, expired, or don't verify.
+	ValidationBogus
+)
+
+var ValidationStatusToString = map[ValidationStatus]string{
+	ValidationIndeterminate: "indeterminate",
+	ValidationSecure:        "secure",
+	ValidationInsecure:      "insecure",
+	ValidationBogus:         "bogus",
+}
+
+func (s ValidationStatus) String() string {
+	str, ok := ValidationStatusToString[s]
+	if !ok {
+		return fmt.Sprintf("ValidationStatus(%d)", int(s))
+	}
+	return str
+}
+
+// validationRank orders the statuses from best to worst, for combining the statuses of
+// several RRsets.
+var validationRank = map[ValidationStatus]int{
+	ValidationSecure:        0,
+	ValidationInsecure:      1,
+	ValidationIndeterminate: 2,
+	ValidationBogus:         3,
+}
+
+// Validation is the result of validating a response.
+type Validation struct {
+	Status ValidationStatus
+	// Zone is where the status was determined: the signer of the data if
+	// it is secure, the unsigned delegation if it is insecure, or the zone
+	// where validation failed.
+	Zone   string
+	Reason string
+}
+
+func (v *Validation) String() string {
+	return fmt.Sprintf("%s (zone %s): %s", v.Status, v.Zone, v.Reason)
+}
+
+func newValidation(status ValidationStatus, zone string, format string, a ...any) *Validation {
+	return &Validation{Status: status, Zone: zone, Reason: fmt.Sprintf(format, a...)}
+}
+
+// worse returns whichever of a and b has the worse status.  a may be nil.
+func worse(a, b *Validation) *Validation {
+	if a == nil || validationRank[b.Status] > validationRank[a.Status] {
+		return b
+	}
+	return a
+}
+
+// ValidationError is the error that a ValidatingClient's Query returns for
+// a bogus response.
+type ValidationError struct {
+	Validation *Validation
+	Response   *dns.Msg
+}
+
+func (e *ValidationError) Error() string {
+	return "DNSSEC validation failed: " + e.Validation.String()
+}
+
+func mustParseDS(s string) *dns.DS {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr.(*dns.DS)
+}
+
+// DefaultTrustAnchors are the DS records of the root zone's KSKs, as
+// published by IANA (https://data.iana.org/root-anchors/root-anchors.xml):
+// KSK-2017 (key tag 20326) and KSK-2024 (key tag 38696).
+var DefaultTrustAnchors = []*dns.DS{
+	mustParseDS(". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"),
+	mustParseDS(". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"),
+}
+
+const (
+	// insecureCacheTTL is how long a zone that was found to be insecure
+	// is remembered
+	insecureCacheTTL = 5 * time.Minute
+	// maxTrustCacheTTL caps how long a zone's validated keys are
+	// remembered
+	maxTrustCacheTTL = time.Hour
+	// maxChainLength bounds the length of a chain of trust
+	maxChainLength = 32
+)
+
+var supportedDNSSECAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+var supportedDigestTypes = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+type ValidatorConfig struct {
+	// TrustAnchors are the DS records of the zones whose keys are trusted
+	// without further proof.  If nil, DefaultTrustAnchors is used.  An
+	// anchor need not be for the root zone (e.g., for a private
+	// hierarchy).
+	TrustAnchors []*dns.DS
+	// TrustAnchorStore, if set, supplies the trust anchors instead of
+	// TrustAnchors, so that they follow the store's key rollovers.
+	TrustAnchorStore *TrustAnchorStore
+	// Now returns the time that signature validity periods are checked
+	// against.  If nil, time.Now is used.
+	Now func() time.Time
+	// MaxNSEC3Iterations is the largest NSEC3 iteration count that the
+	// validator computes hashes for; negative answers that rely on NSEC3
+	// records with more iterations are treated as insecure, as per RFC
+	// 9276.  If 0, DefaultMaxNSEC3Iterations is used.
+	MaxNSEC3Iterations int
+}
+
+// zoneTrust is what the validator has established about a zone.
+type zoneTrust struct {
+	validation *Validation
+	keys       []*dns.DNSKEY // the zone's keys, if the zone is secure
+	expires    time.Time
+	generation int // of the trust anchors that it was established with
+}
+
+// ValidatingClient wraps a Client and validates the DNSSEC signatures of its
+// responses.  The queries it sends have the DO and CD bits set, so that the
+// upstream (typically a recursive resolver, or an IterativeResolver) returns
+// the signatures without filtering bogus data itself.  To build chains of
+// trust, the ValidatingClient queries the upstream for DS and DNSKEY
+// records; validated keys are cached.
+//
+// A ValidatingClient is safe for concurrent use if the wrapped Client is.
+type ValidatingClient struct {
+	next    Client
+	config  *ValidatorConfig
+	anchors map[string][]*dns.DS
+
+	mu         sync.Mutex
+	zones      map[string]*zoneTrust
+	generation int // of the TrustAnchorStore's anchors
+}
+
+func NewValidatingClient(next Client, config *ValidatorConfig) *ValidatingClient {
+	c := &ValidatingClient{
+		next:    next,
+		config:  config,
+		anchors: make(map[string][]*dns.DS),
+		zones:   make(map[string]*zoneTrust),
+	}
+
+	anchors := config.TrustAnchors
+	if anchors == nil {
+		anchors = DefaultTrustAnchors
+	}
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		c.anchors[zone] = append(c.anchors[zone], ds)
+	}
+	return c
+}
+
+// Unwrap returns the Client that c wraps.
+func (c *ValidatingClient) Unwrap() Client {
+	return c.next
+}
+
+func (c *ValidatingClient) GetConfig() *Config {
+	return c.next.GetConfig()
+}
+
+func (c *ValidatingClient) Dial() error {
+	return c.next.Dial()
+}
+
+func (c *ValidatingClient) Close() error {
+	return c.next.Close()
+}
+
+func (c *ValidatingClient) now() time.Time {
+	if c.config.Now != nil {
+		return c.config.Now()
+	}
+	return time.Now()
+}
+
+// Query sends req and validates the response.  The response's AD bit is set
+// if and only if the response is secure; for NXDOMAIN and NODATA responses,
+// that means that the NSEC or NSEC3 records prove the denial.  A bogus response is an error (a
+// *ValidationError); use QueryValidated to get the validation status of
+// every response.
+func (c *ValidatingClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *ValidatingClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, v, err := c.QueryValidated(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if v.Status == ValidationBogus {
+		return nil, &ValidationError{Validation: v, Response: resp}
+	}
+	return resp, nil
+}
+
+// QueryValidated sends req and returns the response along with its
+// validation status.
+func (c *ValidatingClient) QueryValidated(ctx context.Context, req *dns.Msg) (*dns.Msg, *Validation, error) {
+	req = req.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(4096, true)
+	}
+	req.CheckingDisabled = true
+
+	resp, err := queryContext(ctx, c.next, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v := c.Validate(ctx, resp)
+	resp.AuthenticatedData = v.Status == ValidationSecure
+	c.GetConfig().logger().Debug("dnssec validation", append(questionAttrs(req),
+		"status", v.Status.String(), "zone", v.Zone, "reason", v.Reason)...)
+	return resp, v, nil
+}
+
+// Validate validates a response, which must have been obtained with the DO
+// bit set.  Any DS and DNSKEY records needed to build the chain of trust are
+// fetched through the wrapped Client.
+func (c *ValidatingClient) Validate(ctx context.Context, resp *dns.Msg) *Validation {
+	anchors, generation := c.trustAnchors()
+	v := &validator{c: c, ctx: ctx, now: c.now(), anchors: anchors, generation: generation}
+	return v.validate(resp)
+}
+
+func (c *ValidatingClient) maxNSEC3Iterations() int {
+	if c.config.MaxNSEC3Iterations > 0 {
+		return c.config.MaxNSEC3Iterations
+	}
+	return DefaultMaxNSEC3Iterations
+}
+
+// trustAnchors returns the current trust anchors and their generation.  When
+// the anchors of the TrustAnchorStore change, the cached zones are forgotten.
+func (c *ValidatingClient) trustAnchors() (map[string][]*dns.DS, int) {
+	store := c.config.TrustAnchorStore
+	if store == nil {
+		return c.anchors, 0
+	}
+	anchors, generation := store.anchorMap()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a validation that took its snapshot of the store earlier may get
+	// here later; it mustn't bring back the old generation
+	if generation > c.generation {
+		c.zones = make(map[string]*zoneTrust)
+		c.generation = generation
+	}
+	return anchors, generation
+}
+
+func (c *ValidatingClient) cachedTrust(zone string, now time.Time) *zoneTrust {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	zt, ok := c.zones[zone]
+	if !ok || now.After(zt.expires) || zt.generation != c.generation {
+		return nil
+	}
+	return zt
+}
+
+// storeTrust caches zt, unless it was established with trust anchors that
+// have since changed.
+func (c *ValidatingClient) storeTrust(zone string, zt *zoneTrust) {
+	if zt.expires.IsZero() {
+		// not worth remembering (e.g., a transient failure)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if zt.generation != c.generation {
+		return
+	}
+	c.zones[zone] = zt
+}
+
+// validator holds the state of a single validation.
+type validator struct {
+	c       *ValidatingClient
+	ctx     context.Context
+	now     time.Time
+	anchors map[string][]*dns.DS
+	// generation is that of anchors; the zoneTrusts that the validator
+	// caches are tagged with it
+	generation int
+	chain      int // the length of the chain of trust being built
+}
+
+// storeTrust tags zt with the generation of v's trust anchors and caches it.
+func (v *validator) storeTrust(zone string, zt *zoneTrust) {
+	zt.generation = v.generation
+	v.c.storeTrust(zone, zt)
+}
+
+func (v *validator) fetch(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.RecursionDesired = v.c.next.GetConfig().RecursionDesired
+	req.CheckingDisabled = true
+	req.SetEdns0(4096, true)
+	return queryContext(v.ctx, v.c.next, req)
+}
+
+// splitRRsets groups rrs into RRsets, in order of appearance, leaving out
+// the RRSIGs.
+func splitRRsets(rrs []dns.RR) [][]dns.RR {
+	var rrsets [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%d", dns.CanonicalName(h.Name), h.Rrtype, h.Class)
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets
+}
+
+// sigsFor returns the RRSIGs in rrs that cover the RRset with the given
+// owner name and type.
+func sigsFor(rrs []dns.RR, name string, rrtype uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, sig := range msgutil.CollectRRs[*dns.RRSIG](rrs) {
+		if sig.TypeCovered == rrtype && equalNames(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// verifyRRset checks that one of sigs is a valid signature over rrset by one
+// of keys.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) error {
+	var problems []string
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm ||
+				!equalNames(key.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			err := sig.Verify(key, rrset)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("RRSIG by key %d: %v", sig.KeyTag, err))
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				problems = append(problems, fmt.Sprintf("RRSIG by key %d is valid from %s to %s",
+					sig.KeyTag, dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration)))
+				continue
+			}
+			return nil
+		}
+	}
+	if len(problems) == 0 {
+		return errors.New("no RRSIG by a trusted key")
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func rrsetString(rrset []dns.RR) string {
+	h := rrset[0].Header()
+	return h.Name + " " + dns.TypeToString[h.Rrtype]
+}
+
+func (v *validator) validate(resp *dns.Msg) *Validation {
+	if len(resp.Question) != 1 {
+		return newValidation(ValidationIndeterminate, "", "the response doesn't have exactly one question")
+	}
+	q := resp.Question[0]
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return newValidation(ValidationIndeterminate, q.Name, "the response has rcode %s",
+			dns.RcodeToString[resp.Rcode])
+	}
+
+	rrsets := splitRRsets(resp.Answer)
+	if len(rrsets) == 0 {
+		return v.validateNegative(resp, q.Name)
+	}
+
+	var result *Validation
+	for _, rrset := range rrsets {
+		if synthesizedCNAME(rrset, resp.Answer) {
+			// the DNAME that it is synthesized from is validated
+			// instead
+			continue
+		}
+		val := v.validateRRset(rrset, resp.Answer)
+		if val.Status == ValidationSecure {
+			val = v.validateExpansion(rrset, resp, val)
+		}
+		result = worse(result, val)
+	}
+
+	// a CNAME chain may end in a name that doesn't exist or has no qtype
+	// RRset, in which case the authority section holds the denial
+	if target, ok := unansweredTarget(resp); ok {
+		result = worse(result, v.validateNegative(resp, target))
+	}
+	return result
+}
+
+// synthesizedCNAME reports whether rrset is an unsigned CNAME that was
+// synthesized from a DNAME in section.  Such a CNAME has no RRSIG of its own
+// (RFC 4035, section 3.2.1, and RFC 6672, section 5.3.1).
+func synthesizedCNAME(rrset []dns.RR, section []dns.RR) bool {
+	cname, ok := rrset[0].(*dns.CNAME)
+	if !ok || len(rrset) != 1 || len(sigsFor(section, cname.Hdr.Name, dns.TypeCNAME)) > 0 {
+		return false
+	}
+	for _, dname := range msgutil.CollectRRs[*dns.DNAME](section) {
+		if equalNames(dname.Hdr.Name, cname.Hdr.Name) || !dns.IsSubDomain(dname.Hdr.Name, cname.Hdr.Name) {
+			continue
+		}
+		target, ok := dnameTarget(cname.Hdr.Name, dname)
+		if ok && equalNames(target, cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// unansweredTarget follows the CNAME chain in resp's answer section, and
+// returns the name at its end if the response denies that name (or its
+// qtype RRset).
+func unansweredTarget(resp *dns.Msg) (string, bool) {
+	q := resp.Question[0]
+	if q.Qtype == dns.TypeCNAME {
+		return "", false
+	}
+	name := q.Name
+	for i := 0; i < len(resp.Answer); i++ {
+		var next string
+		for _, rr := range resp.Answer {
+			if !equalNames(rr.Header().Name, name) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				next = rr.Target
+			default:
+				if rr.Header().Rrtype == q.Qtype {
+					return "", false
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	if equalNames(name, q.Name) {
+		return "", false
+	}
+	if resp.Rcode == dns.RcodeNameError || len(msgutil.CollectRRs[*dns.SOA](resp.Ns)) > 0 {
+		return name, true
+	}
+	return "", false
+}
+
+// verifyAuthority verifies the signatures of the RRsets in a response's
+// authority section against the keys of zone.  It returns nil on success.
+func (v *validator) verifyAuthority(zone string, keys []*dns.DNSKEY, ns []dns.RR) *Validation {
+	for _, rrset := range splitRRsets(ns) {
+		h := rrset[0].Header()
+		err := verifyRRset(rrset, sigsFor(ns, h.Name, h.Rrtype), keys, v.now)
+		if err != nil {
+			return newValidation(ValidationBogus, zone, "%s: %v", rrsetString(rrset), err)
+		}
+	}
+	return nil
+}
+
+// validateExpansion checks whether a (secure) RRset was synthesized from a
+// wildcard and, if so, that the response proves that no closer match
+// exists.
+func (v *validator) validateExpansion(rrset []dns.RR, resp *dns.Msg, val *Validation) *Validation {
+	h := rrset[0].Header()
+	sigs := sigsFor(resp.Answer, h.Name, h.Rrtype)
+	labels := int(sigs[0].Labels)
+	if labels >= dns.CountLabel(h.Name) {
+		return val
+	}
+
+	zt := v.zoneTrust(val.Zone)
+	if bad := v.verifyAuthority(val.Zone, zt.keys, resp.Ns); bad != nil {
+		return bad
+	}
+	return newDenial(val.Zone, resp.Ns, v.c.maxNSEC3Iterations()).wildcardAnswer(h.Name, labels)
+}
+
+// validateRRset validates an RRset against the RRSIGs in section.
+func (v *validator) validateRRset(rrset []dns.RR, section []dns.RR) *Validation {
+	h := rrset[0].Header()
+	sigs := sigsFor(section, h.Name, h.Rrtype)
+	if len(sigs) == 0 {
+		return v.unsigned(h.Name, fmt.Sprintf("%s has no RRSIG", rrsetString(rrset)))
+	}
+
+	signer := dns.CanonicalName(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, h.Name) {
+		return newValidation(ValidationBogus, signer, "the signer of %s is not an ancestor of it",
+			rrsetString(rrset))
+	}
+
+	zt := v.zoneTrust(signer)
+	if zt.validation.Status != ValidationSecure {
+		return zt.validation
+	}
+
+	err := verifyRRset(rrset, sigs, zt.keys, v.now)
+	if err != nil {
+		return newValidation(ValidationBogus, signer, "%s: %v", rrsetString(rrset), err)
+	}
+	return newValidation(ValidationSecure, signer, "%s is signed by %s", rrsetString(rrset), signer)
+}
+
+// validateNegative validates the denial, in a NXDOMAIN or NODATA response,
+// of qname (which is the qname or the end of the CNAME chain).
+func (v *validator) validateNegative(resp *dns.Msg, qname string) *Validation {
+	qtype := resp.Question[0].Qtype
+	sigs := msgutil.CollectRRs[*dns.RRSIG](resp.Ns)
+	if len(sigs) == 0 {
+		return v.unsigned(qname, "the negative response is unsigned")
+	}
+
+	signer := dns.CanonicalName(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, qname) {
+		return newValidation(ValidationBogus, signer, "the signer of the negative response is not an ancestor of %s",
+			qname)
+	}
+	zt := v.zoneTrust(signer)
+	if zt.validation.Status != ValidationSecure {
+		return zt.validation
+	}
+	if bad := v.verifyAuthority(signer, zt.keys, resp.Ns); bad != nil {
+		return bad
+	}
+
+	d := newDenial(signer, resp.Ns, v.c.maxNSEC3Iterations())
+	if resp.Rcode == dns.RcodeNameError {
+		return d.nxdomain(qname)
+	}
+	return d.nodata(qname, qtype)
+}
+
+// zoneTrust establishes whether zone is secure and, if so, its keys.
+func (v *validator) zoneTrust(zone string) *zoneTrust {
+	if zt := v.c.cachedTrust(zone, v.now); zt != nil {
+		return zt
+	}
+
+	v.chain++
+	defer func() { v.chain-- }()
+	if v.chain > maxChainLength {
+		return &zoneTrust{validation: newValidation(ValidationBogus, zone, "the chain of trust is too long")}
+	}
+
+	var zt *zoneTrust
+	if anchors, ok := v.anchors[zone]; ok {
+		zt = v.verifyDNSKEYs(zone, anchors)
+	} else if zone == "." {
+		zt = &zoneTrust{validation: newValidation(ValidationIndeterminate, zone, "there is no trust anchor")}
+	} else {
+		ds, cut, dv := v.childDS(zone)
+		switch {
+		case dv.Status != ValidationSecure:
+			zt = &zoneTrust{validation: dv}
+			if dv.Status == ValidationInsecure {
+				zt.expires = v.now.Add(insecureCacheTTL)
+			}
+		case !cut:
+			zt = &zoneTrust{validation: newValidation(ValidationBogus, zone, "the signer %s is not a zone", zone)}
+		default:
+			zt = v.verifyDNSKEYs(zone, ds)
+		}
+	}
+
+	v.storeTrust(zone, zt)
+	return zt
+}
+
+// verifyDNSKEYs fetches zone's DNSKEY RRset and checks that it is signed by
+// a key that matches one of the DS records.
+func (v *validator) verifyDNSKEYs(zone string, dsSet []*dns.DS) *zoneTrust {
+	fail := func(status ValidationStatus, format string, a ...any) *zoneTrust {
+		return &zoneTrust{validation: newValidation(status, zone, format, a...)}
+	}
+
+	resp, err := v.fetch(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return fail(ValidationIndeterminate, "failed to fetch DNSKEY: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fail(ValidationIndeterminate, "DNSKEY query got rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	var keys []*dns.DNSKEY
+	var rrset []dns.RR
+	for _, key := range msgutil.CollectRRs[*dns.DNSKEY](resp.Answer) {
+		if equalNames(key.Hdr.Name, zone) {
+			keys = append(keys, key)
+			rrset = append(rrset, key)
+		}
+	}
+	if len(keys) == 0 {
+		return fail(ValidationBogus, "there are no DNSKEY records")
+	}
+
+	supported := false
+	var sepKeys []*dns.DNSKEY
+	for _, ds := range dsSet {
+		if !supportedDNSSECAlgorithms[ds.Algorithm] || !supportedDigestTypes[ds.DigestType] {
+			continue
+		}
+		supported = true
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm || key.Flags&dns.REVOKE != 0 {
+				continue
+			}
+			digest := key.ToDS(ds.DigestType)
+			if digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				sepKeys = append(sepKeys, key)
+			}
+		}
+	}
+	if !supported {
+		// RFC 4035, section 5.2
+		zt := fail(ValidationInsecure, "none of the DS records use a supported algorithm and digest type")
+		zt.expires = v.now.Add(insecureCacheTTL)
+		return zt
+	}
+	if len(sepKeys) == 0 {
+		return fail(ValidationBogus, "no DNSKEY matches the DS records")
+	}
+
+	sigs := sigsFor(resp.Answer, zone, dns.TypeDNSKEY)
+	err = verifyRRset(rrset, sigs, sepKeys, v.now)
+	if err != nil {
+		return fail(ValidationBogus, "DNSKEY RRset: %v", err)
+	}
+
+	zt := &zoneTrust{
+		validation: newValidation(ValidationSecure, zone, "the DNSKEY RRset is signed by key %d",
+			sepKeys[0].KeyTag()),
+	}
+	ttl := maxTrustCacheTTL
+	for _, key := range keys {
+		ttl = min(ttl, time.Duration(key.Hdr.Ttl)*time.Second)
+		if key.Flags&dns.ZONE != 0 && key.Flags&dns.REVOKE == 0 {
+			zt.keys = append(zt.keys, key)
+		}
+	}
+	zt.expires = v.now.Add(ttl)
+	return zt
+}
+
+// childDS fetches the DS RRset for child, and validates it (or the proof
+// that it doesn't exist).  cut reports whether child is a zone cut; ds is
+// empty for an insecure cut, in which case the validation is insecure.
+func (v *validator) childDS(child string) (ds []*dns.DS, cut bool, val *Validation) {
+	resp, err := v.fetch(child, dns.TypeDS)
+	if err != nil {
+		return nil, false, newValidation(ValidationIndeterminate, child, "failed to fetch DS: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, false, newValidation(ValidationIndeterminate, child, "DS query got rcode %s",
+			dns.RcodeToString[resp.Rcode])
+	}
+
+	var rrset []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && equalNames(rr.Header().Name, child) {
+			rrset = append(rrset, rr)
+			ds = append(ds, rr.(*dns.DS))
+		}
+	}
+	if len(ds) > 0 {
+		sigs := sigsFor(resp.Answer, child, dns.TypeDS)
+		if len(sigs) > 0 && equalNames(sigs[0].SignerName, child) {
+			return nil, false, newValidation(ValidationBogus, child, "the DS RRset is signed by the child zone")
+		}
+		val = v.validateRRset(rrset, resp.Answer)
+		if val.Status != ValidationSecure {
+			return nil, false, val
+		}
+		return ds, true, val
+	}
+
+	return v.noDS(child, resp)
+}
+
+// noDS handles a response to a DS query that has no DS records: a NODATA
+// response, or an NXDOMAIN response if child doesn't exist.
+func (v *validator) noDS(child string, resp *dns.Msg) ([]*dns.DS, bool, *Validation) {
+	sigs := msgutil.CollectRRs[*dns.RRSIG](resp.Ns)
+	if len(sigs) == 0 {
+		// the denial is unsigned, which is only acceptable if the parent
+		// zone is insecure
+		soas := msgutil.CollectRRs[*dns.SOA](resp.Ns)
+		if len(soas) == 0 || equalNames(soas[0].Hdr.Name, child) ||
+			!dns.IsSubDomain(soas[0].Hdr.Name, child) {
+			return nil, false, newValidation(ValidationIndeterminate, child,
+				"the response to the DS query has no usable SOA record")
+		}
+		parent := dns.CanonicalName(soas[0].Hdr.Name)
+		zt := v.zoneTrust(parent)
+		if zt.validation.Status != ValidationSecure {
+			return nil, false, zt.validation
+		}
+		return nil, false, newValidation(ValidationBogus, parent,
+			"there is no signed proof that %s has no DS records", child)
+	}
+
+	parent := dns.CanonicalName(sigs[0].SignerName)
+	if equalNames(parent, child) || !dns.IsSubDomain(parent, child) {
+		return nil, false, newValidation(ValidationBogus, child,
+			"the denial of the DS RRset is not signed by an ancestor zone")
+	}
+	zt := v.zoneTrust(parent)
+	if zt.validation.Status != ValidationSecure {
+		return nil, false, zt.validation
+	}
+	if bad := v.verifyAuthority(parent, zt.keys, resp.Ns); bad != nil {
+		return nil, false, bad
+	}
+
+	return v.dsDenial(child, parent, resp.Ns, resp.Rcode == dns.RcodeNameError)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// dsDenial interprets the (verified) NSEC or NSEC3 records that deny the
+// existence of a DS RRset for child, or, if nxdomain is set, of child
+// itself.
+func (v *validator) dsDenial(child, parent string, ns []dns.RR, nxdomain bool) ([]*dns.DS, bool, *Validation) {
+	d := newDenial(parent, ns, v.c.maxNSEC3Iterations())
+	if nxdomain {
+		val := d.nxdomain(child)
+		if val.Status != ValidationSecure {
+			return nil, false, val
+		}
+		return nil, false, newValidation(ValidationSecure, child, "%s does not exist (%s)", child, val.Reason)
+	}
+
+	var bitmap []uint16
+	var what string
+	if nsec := d.nsecMatch(child); nsec != nil {
+		bitmap, what = nsec.TypeBitMap, "NSEC"
+	} else if nsec3 := d.nsec3Match(child); nsec3 != nil {
+		bitmap, what = nsec3.TypeBitMap, "NSEC3"
+	}
+	if what != "" {
+		val := d.checkBitmap(bitmap, child, dns.TypeDS, what)
+		if val.Status != ValidationSecure {
+			return nil, false, val
+		}
+		if hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) {
+			return nil, true, newValidation(ValidationInsecure, child,
+				"the delegation from %s has no DS records (proven by %s)", parent, what)
+		}
+		return nil, false, newValidation(ValidationSecure, child, "%s is not a zone cut", child)
+	}
+
+	// child has no record of its own: it's an empty non-terminal, or, with
+	// NSEC3 opt-out, possibly an unsigned delegation
+	val := d.nodata(child, dns.TypeDS)
+	switch val.Status {
+	case ValidationInsecure:
+		val.Zone = child
+		return nil, true, val
+	case ValidationSecure:
+		return nil, false, newValidation(ValidationSecure, child, "%s is not a zone cut", child)
+	}
+	return nil, false, val
+}
+
+// unsigned determines whether unsigned data at name is acceptable: that is,
+// whether name is below an insecure delegation.  It walks down from the
+// closest trust anchor, one label at a time, looking for the delegation.
+func (v *validator) unsigned(name string, what string) *Validation {
+	name = dns.CanonicalName(name)
+
+	zone := ""
+	depth := -1
+	for anchor := range v.anchors {
+		if dns.IsSubDomain(anchor, name) && dns.CountLabel(anchor) > depth {
+			zone = anchor
+			depth = dns.CountLabel(anchor)
+		}
+	}
+	if depth < 0 {
+		return newValidation(ValidationIndeterminate, name, "%s, and there is no trust anchor for it", what)
+	}
+
+	zt := v.zoneTrust(zone)
+	if zt.validation.Status != ValidationSecure {
+		return zt.validation
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := dns.CountLabel(zone) + 1; i <= len(labels); i++ {
+		child := dns.Fqdn(strings.Join(labels[len(labels)-i:], "."))
+		if zt := v.c.cachedTrust(child, v.now); zt != nil {
+			if zt.validation.Status != ValidationSecure {
+				return zt.validation
+			}
+			zone = child
+			continue
+		}
+
+		ds, cut, dv := v.childDS(child)
+		if dv.Status != ValidationSecure {
+			if dv.Status == ValidationInsecure {
+				v.storeTrust(child, &zoneTrust{validation: dv, expires: v.now.Add(insecureCacheTTL)})
+			}
+			return dv
+		}
+		if !cut {
+			continue
+		}
+		zt := v.verifyDNSKEYs(child, ds)
+		v.storeTrust(child, zt)
+		if zt.validation.Status != ValidationSecure {
+			return zt.validation
+		}
+		zone = child
+	}
+
+	return newValidation(ValidationBogus, zone, "%s, but it is in the signed zone %s", what, zone)
+}
@@ -0,0 +1,357 @@
+package dnsclient_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+)
+
+// soa returns the SOA and NS records of a test zone.  Every zone is served
+// by the same dnstest server, whose name is ns.example.
+func soa(origin string) string {
+	return fmt.Sprintf("%[1]s 3600 IN SOA ns.example. hostmaster.example. 1 7200 3600 1209600 300\n"+
+		"%[1]s 3600 IN NS ns.example.\n", origin)
+}
+
+// delegate returns the records that delegate zone: the NS record and, if
+// child is set, the DS record of child's key.
+func delegate(zone string, child *dnstest.SignedZone) string {
+	s := zone + " 3600 IN NS ns.example.\n"
+	if child != nil {
+		ds := *child.DS
+		ds.Hdr.Name = zone
+		s += ds.String() + "\n"
+	}
+	return s
+}
+
+func signZone(t *testing.T, text string, config *dnstest.SignConfig) *dnstest.SignedZone {
+	t.Helper()
+	signed, err := dnstest.SignZone(text, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// signRoot signs a root zone that delegates example. (whose nameserver's
+// address is the glue) to the given signed zone.
+func signRoot(t *testing.T, example *dnstest.SignedZone) *dnstest.SignedZone {
+	t.Helper()
+	return signZone(t, soa(".")+delegate("example.", example)+"ns.example. 3600 IN A 192.0.2.53\n",
+		&dnstest.SignConfig{})
+}
+
+// signedHierarchy is a signed root, a signed example. zone, and its children
+// in various states of (in)security.
+type signedHierarchy struct {
+	server *dnstest.Server
+	anchor *dns.DS // the root's DS record
+}
+
+func newSignedHierarchy(t *testing.T) *signedHierarchy {
+	t.Helper()
+
+	secure := signZone(t, soa("secure.example.")+`
+www.secure.example. 3600 IN A 192.0.2.10
+*.wild.secure.example. 3600 IN TXT "wildcard"
+`, &dnstest.SignConfig{NSEC3: true, Salt: "beef", Iterations: 1})
+
+	insecure := soa("insecure.example.") + "www.insecure.example. 3600 IN A 192.0.2.11\n"
+
+	badsig := signZone(t, soa("badsig.example.")+"www.badsig.example. 3600 IN A 192.0.2.12\n",
+		&dnstest.SignConfig{})
+	// the signature no longer matches the data
+	badsig.Text = strings.Replace(badsig.Text, "192.0.2.12", "192.0.2.99", 1)
+
+	now := time.Now()
+	expired := signZone(t, soa("expired.example.")+"www.expired.example. 3600 IN A 192.0.2.13\n",
+		&dnstest.SignConfig{Inception: now.AddDate(0, 0, -60), Expiration: now.AddDate(0, 0, -30)})
+
+	mismatch := signZone(t, soa("mismatch.example.")+"www.mismatch.example. 3600 IN A 192.0.2.14\n",
+		&dnstest.SignConfig{})
+	// a DS record for some other key
+	other := signZone(t, soa("mismatch.example."), &dnstest.SignConfig{})
+
+	example := signZone(t, soa("example.")+`
+ns.example. 3600 IN A 192.0.2.53
+www.example. 3600 IN A 192.0.2.1
+*.wild.example. 3600 IN TXT "wildcard"
+a.b.ent.example. 3600 IN A 192.0.2.2
+old.example. 3600 IN DNAME new.example.
+www.new.example. 3600 IN A 192.0.2.3
+`+delegate("secure.example.", secure)+
+		delegate("insecure.example.", nil)+
+		delegate("badsig.example.", badsig)+
+		delegate("expired.example.", expired)+
+		delegate("mismatch.example.", other),
+		&dnstest.SignConfig{})
+
+	root := signRoot(t, example)
+
+	s := newTestServer(t, root.Text, example.Text, secure.Text, insecure, badsig.Text, expired.Text,
+		mismatch.Text)
+	return &signedHierarchy{server: s, anchor: root.DS}
+}
+
+func newValidatingClient(t *testing.T, s *dnstest.Server, config *dnsclient.ValidatorConfig, mws ...dnsclient.Middleware) *dnsclient.ValidatingClient {
+	t.Helper()
+	next := dnsclient.Chain(dnsclient.NewDo53Client(s.Do53Config()), mws...)
+	c := dnsclient.NewValidatingClient(next, config)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// tamper returns a Middleware that applies f to the responses to queries of
+// type qtype.
+func tamper(qtype uint16, f func(resp *dns.Msg)) dnsclient.Middleware {
+	return dnsclient.Intercept(func(req *dns.Msg, next dnsclient.QueryFunc) (*dns.Msg, error) {
+		resp, err := next(req)
+		if err == nil && req.Question[0].Qtype == qtype {
+			f(resp)
+		}
+		return resp, err
+	})
+}
+
+func removeTypes(rrs []dns.RR, types ...uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		remove := false
+		for _, t := range types {
+			remove = remove || rr.Header().Rrtype == t
+		}
+		if !remove {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+type validationTest struct {
+	name   string
+	qname  string
+	qtype  uint16
+	config *dnsclient.ValidatorConfig // if nil, the root is the only trust anchor
+	mws    []dnsclient.Middleware
+	status dnsclient.ValidationStatus
+	zone   string
+	reason string // a substring of the reason
+}
+
+func runValidationTests(t *testing.T, s *dnstest.Server, anchor *dns.DS, tests []validationTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config == nil {
+				config = &dnsclient.ValidatorConfig{TrustAnchors: []*dns.DS{anchor}}
+			}
+			c := newValidatingClient(t, s, config, tt.mws...)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			resp, v, err := c.QueryValidated(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Status != tt.status {
+				t.Errorf("got %v, want %s", v, tt.status)
+			}
+			if tt.zone != "" && v.Zone != tt.zone {
+				t.Errorf("got zone %s, want %s (%v)", v.Zone, tt.zone, v)
+			}
+			if !strings.Contains(v.Reason, tt.reason) {
+				t.Errorf("the reason %q doesn't mention %q", v.Reason, tt.reason)
+			}
+			if resp.AuthenticatedData != (v.Status == dnsclient.ValidationSecure) {
+				t.Errorf("AD is %v for a %s response", resp.AuthenticatedData, v.Status)
+			}
+		})
+	}
+}
+
+func TestValidatingClient(t *testing.T) {
+	h := newSignedHierarchy(t)
+
+	servfail := dnsclient.Intercept(func(req *dns.Msg, next dnsclient.QueryFunc) (*dns.Msg, error) {
+		if req.Question[0].Qtype != dns.TypeDNSKEY {
+			return next(req)
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp, nil
+	})
+	stripSigs := func(resp *dns.Msg) { resp.Answer = removeTypes(resp.Answer, dns.TypeRRSIG) }
+	stripNs := func(resp *dns.Msg) { resp.Ns = removeTypes(resp.Ns, dns.TypeRRSIG, dns.TypeNSEC) }
+	stripNSEC := func(resp *dns.Msg) { resp.Ns = removeTypes(resp.Ns, dns.TypeNSEC) }
+
+	runValidationTests(t, h.server, h.anchor, []validationTest{
+		{name: "secure", qname: "www.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationSecure, zone: "example."},
+		{name: "secure child", qname: "www.secure.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationSecure, zone: "secure.example."},
+		{name: "wildcard", qname: "x.wild.example.", qtype: dns.TypeTXT,
+			status: dnsclient.ValidationSecure, zone: "example.", reason: "wildcard"},
+		{name: "nsec3 wildcard", qname: "x.wild.secure.example.", qtype: dns.TypeTXT,
+			status: dnsclient.ValidationSecure, zone: "secure.example.", reason: "wildcard"},
+		{name: "dname", qname: "www.old.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationSecure, zone: "example."},
+		{name: "anchor below the root", qname: "www.secure.example.", qtype: dns.TypeA,
+			config: &dnsclient.ValidatorConfig{TrustAnchors: []*dns.DS{mustDS(t, h.server, "example.")}},
+			status: dnsclient.ValidationSecure, zone: "secure.example."},
+
+		{name: "insecure delegation", qname: "www.insecure.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationInsecure, zone: "insecure.example."},
+
+		{name: "bad signature", qname: "www.badsig.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationBogus, zone: "badsig.example."},
+		{name: "expired signature", qname: "www.expired.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationBogus, zone: "expired.example.", reason: "is valid from"},
+		{name: "ds mismatch", qname: "www.mismatch.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationBogus, zone: "mismatch.example.", reason: "no DNSKEY matches"},
+		{name: "missing signature", qname: "www.example.", qtype: dns.TypeA,
+			mws:    []dnsclient.Middleware{tamper(dns.TypeA, stripSigs)},
+			status: dnsclient.ValidationBogus, zone: "example.", reason: "has no RRSIG"},
+		{name: "unsigned denial", qname: "www.nope.example.", qtype: dns.TypeA,
+			mws:    []dnsclient.Middleware{tamper(dns.TypeA, stripNs)},
+			status: dnsclient.ValidationBogus, zone: "example.", reason: "in the signed zone example."},
+		{name: "unproven ds nxdomain", qname: "www.nope.example.", qtype: dns.TypeA,
+			mws: []dnsclient.Middleware{
+				tamper(dns.TypeA, stripNs),
+				tamper(dns.TypeDS, stripNSEC),
+			},
+			status: dnsclient.ValidationBogus, zone: "example.", reason: "prove that nope.example. does not exist"},
+
+		{name: "no trust anchor", qname: "www.example.", qtype: dns.TypeA,
+			config: &dnsclient.ValidatorConfig{TrustAnchors: []*dns.DS{mustDS(t, h.server, "other.")}},
+			status: dnsclient.ValidationIndeterminate, reason: "no trust anchor"},
+		{name: "dnskey servfail", qname: "www.example.", qtype: dns.TypeA,
+			mws:    []dnsclient.Middleware{servfail},
+			status: dnsclient.ValidationIndeterminate, reason: "SERVFAIL"},
+	})
+}
+
+// mustDS returns a DS record for zone, taken from the DNSKEY RRset that s
+// serves for it, or a made-up one if s doesn't serve zone.
+func mustDS(t *testing.T, s *dnstest.Server, zone string) *dns.DS {
+	t.Helper()
+	c := dnsclient.NewDo53Client(s.Do53Config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion(zone, dns.TypeDNSKEY)
+	resp, err := c.Query(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			return key.ToDS(dns.SHA256)
+		}
+	}
+	rr, err := dns.NewRR(zone + " IN DS 12345 13 2 " + strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr.(*dns.DS)
+}
+
+func TestValidatingClientChainLength(t *testing.T) {
+	// a hierarchy that is 33 zones deep, root included
+	const depth = 32
+	names := []string{"."}
+	for i := 1; i <= depth; i++ {
+		names = append(names, fmt.Sprintf("l%d.%s", i, strings.TrimPrefix(names[i-1], ".")))
+	}
+
+	var zones []string
+	var child *dnstest.SignedZone
+	for i := depth; i >= 0; i-- {
+		text := soa(names[i])
+		if i == depth {
+			text += "www." + names[i] + " 3600 IN A 192.0.2.1\n"
+		} else {
+			text += delegate(names[i+1], child)
+		}
+		child = signZone(t, text, &dnstest.SignConfig{})
+		zones = append(zones, child.Text)
+	}
+	s := newTestServer(t, zones...)
+	qname := "www." + names[depth]
+
+	runValidationTests(t, s, child.DS, []validationTest{
+		{name: "too long", qname: qname, qtype: dns.TypeA,
+			status: dnsclient.ValidationBogus, reason: "too long"},
+		{name: "long enough", qname: qname, qtype: dns.TypeA,
+			config: &dnsclient.ValidatorConfig{TrustAnchors: []*dns.DS{mustDS(t, s, names[1])}},
+			status: dnsclient.ValidationSecure, zone: names[depth]},
+	})
+}
+
+func TestValidatingClientDenial(t *testing.T) {
+	const content = `www.%[1]s 3600 IN A 192.0.2.1
+a.b.%[1]s 3600 IN A 192.0.2.2
+*.wild.%[1]s 3600 IN TXT "wildcard"
+`
+	nsec := signZone(t, soa("nsec.example.")+fmt.Sprintf(content, "nsec.example."), &dnstest.SignConfig{})
+	nsec3 := signZone(t, soa("nsec3.example.")+fmt.Sprintf(content, "nsec3.example."),
+		&dnstest.SignConfig{NSEC3: true, Salt: "beef"})
+	// unsigned.optout.example. is an unsigned delegation without an NSEC3
+	// record of its own
+	optout := signZone(t, soa("optout.example.")+fmt.Sprintf(content, "optout.example.")+
+		delegate("unsigned.optout.example.", nil),
+		&dnstest.SignConfig{NSEC3: true, OptOut: true})
+	unsigned := soa("unsigned.optout.example.") + "www.unsigned.optout.example. 3600 IN A 192.0.2.3\n"
+	// more iterations than RFC 9276 allows
+	iter := signZone(t, soa("iter.example.")+fmt.Sprintf(content, "iter.example."),
+		&dnstest.SignConfig{NSEC3: true, Iterations: dnsclient.DefaultMaxNSEC3Iterations + 1})
+
+	example := signZone(t, soa("example.")+"ns.example. 3600 IN A 192.0.2.53\n"+
+		delegate("nsec.example.", nsec)+
+		delegate("nsec3.example.", nsec3)+
+		delegate("optout.example.", optout)+
+		delegate("iter.example.", iter),
+		&dnstest.SignConfig{})
+	root := signRoot(t, example)
+	s := newTestServer(t, root.Text, example.Text, nsec.Text, nsec3.Text, optout.Text, unsigned, iter.Text)
+
+	var tests []validationTest
+	for _, zone := range []string{"nsec.example.", "nsec3.example."} {
+		tests = append(tests,
+			validationTest{name: zone + " nxdomain", qname: "nope." + zone, qtype: dns.TypeA,
+				status: dnsclient.ValidationSecure, zone: zone},
+			validationTest{name: zone + " nxdomain below an empty non-terminal", qname: "x.b." + zone,
+				qtype: dns.TypeA, status: dnsclient.ValidationSecure, zone: zone},
+			validationTest{name: zone + " nodata", qname: "www." + zone, qtype: dns.TypeAAAA,
+				status: dnsclient.ValidationSecure, zone: zone},
+			validationTest{name: zone + " empty non-terminal", qname: "b." + zone, qtype: dns.TypeA,
+				status: dnsclient.ValidationSecure, zone: zone},
+			validationTest{name: zone + " wildcard nodata", qname: "x.wild." + zone, qtype: dns.TypeA,
+				status: dnsclient.ValidationSecure, zone: zone},
+		)
+	}
+	tests = append(tests,
+		validationTest{name: "opt-out", qname: "www.unsigned.optout.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationInsecure, zone: "unsigned.optout.example.", reason: "opt-out"},
+		validationTest{name: "opt-out nxdomain", qname: "nope.optout.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationInsecure, zone: "optout.example.", reason: "opt-out"},
+		validationTest{name: "too many iterations", qname: "nope.iter.example.", qtype: dns.TypeA,
+			status: dnsclient.ValidationInsecure, zone: "iter.example.", reason: "iterations"},
+		validationTest{name: "too many iterations nodata", qname: "www.iter.example.", qtype: dns.TypeAAAA,
+			status: dnsclient.ValidationInsecure, zone: "iter.example.", reason: "iterations"},
+	)
+	runValidationTests(t, s, root.DS, tests)
+}
@@ -0,0 +1,156 @@
+package dnsclient
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/dnstap"
+)
+
+var transportToDnstapProtocol = map[Transport]dnstap.SocketProtocol{
+	TransportDo53UDP: dnstap.ProtocolUDP,
+	TransportDo53TCP: dnstap.ProtocolTCP,
+	TransportDoT:     dnstap.ProtocolDoT,
+	TransportDoH:     dnstap.ProtocolDoH,
+}
+
+// DnstapSink writes dnstap CLIENT_QUERY and CLIENT_RESPONSE messages as a
+// Frame Streams stream, to a file or a unix socket.  It is safe for
+// concurrent use, so several clients may share one DnstapSink.
+type DnstapSink struct {
+	// Identity and Version, if set, are included in every dnstap message
+	// (e.g., the host name and the program name).
+	Identity string
+	Version  string
+
+	mu     sync.Mutex
+	fw     *dnstap.FrameWriter
+	closer io.Closer // nil if the sink doesn't own the underlying writer
+}
+
+// NewDnstapSink starts a unidirectional Frame Streams stream on w.
+func NewDnstapSink(w io.Writer) (*DnstapSink, error) {
+	fw, err := dnstap.NewFrameWriter(w, dnstap.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start dnstap stream: %w", err)
+	}
+	return &DnstapSink{fw: fw}, nil
+}
+
+// CreateDnstapFile creates (or truncates) the file at path and starts a
+// dnstap stream in it.  The sink must be closed to properly end the stream.
+func CreateDnstapFile(path string) (*DnstapSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewDnstapSink(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// DialDnstapSocket connects to a dnstap receiver (such as fstrm_capture)
+// listening on the unix socket at path.
+func DialDnstapSocket(path string) (*DnstapSink, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to dnstap socket: %w", err)
+	}
+	fw, err := dnstap.NewBidirectionalFrameWriter(conn, dnstap.ContentType)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &DnstapSink{fw: fw, closer: conn}, nil
+}
+
+// Close ends the stream and, if the sink created the file or socket, closes
+// it.
+func (s *DnstapSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.fw.Stop()
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *DnstapSink) write(m *dnstap.Message) error {
+	var identity, version []byte
+	if s.Identity != "" {
+		identity = []byte(s.Identity)
+	}
+	if s.Version != "" {
+		version = []byte(s.Version)
+	}
+	frame := dnstap.Marshal(m, identity, version)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fw.WriteFrame(frame)
+}
+
+func (s *DnstapSink) record(next Client, req *dns.Msg, sent time.Time, resp *dns.Msg, received time.Time) error {
+	m := &dnstap.Message{
+		Type:      dnstap.MessageClientQuery,
+		QueryTime: sent,
+	}
+	if u, ok := UpstreamOf(next); ok {
+		m.Protocol = transportToDnstapProtocol[u.Transport()]
+		m.ResponseAddress, _ = upstreamAddrPort(u.Transport(), u.Server())
+	}
+
+	wire, err := req.Pack()
+	if err != nil {
+		return err
+	}
+	m.QueryMessage = wire
+	err = s.write(m)
+	if err != nil || resp == nil {
+		return err
+	}
+
+	wire, err = resp.Pack()
+	if err != nil {
+		return err
+	}
+	m.Type = dnstap.MessageClientResponse
+	m.ResponseTime = received
+	m.ResponseMessage = wire
+	return s.write(m)
+}
+
+// Dnstap returns a Middleware that emits a CLIENT_QUERY message for each
+// query, and a CLIENT_RESPONSE message for each response, to s.  The
+// messages' socket protocol reflects the transport of the wrapped client.
+// Failures to write to the sink are reported to the client's Logger and do
+// not affect the query.
+func Dnstap(s *DnstapSink) Middleware {
+	return func(next Client) Client {
+		return Intercept(func(req *dns.Msg, query QueryFunc) (*dns.Msg, error) {
+			sent := time.Now()
+			resp, err := query(req)
+			var tapped *dns.Msg
+			if err == nil {
+				tapped = resp
+			}
+			if werr := s.record(next, req, sent, tapped, time.Now()); werr != nil {
+				next.GetConfig().logger().Warn("failed to write dnstap message", "err", werr)
+			}
+			return resp, err
+		})(next)
+	}
+}
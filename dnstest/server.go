@@ -0,0 +1,466 @@
+// Package dnstest provides an authoritative DNS server, running on the
+// loopback interface, for testing code that uses the dnsclient package.
+//
+// A Server serves zones given as zone-file text over UDP, TCP, TLS, and
+// HTTPS, and hands out client configs (Do53Config, DoTConfig, DoHConfig)
+// that point at it.  The TLS certificate is issued by a CA that is generated
+// for each Server, and the DoT and DoH configs trust that CA.
+//
+// Rules script misbehavior, such as delayed, truncated, or SERVFAIL
+// responses, for selected queries.  SignZone signs a zone, with NSEC or
+// NSEC3 records, for testing DNSSEC validation.
+package dnstest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+)
+
+// DefaultTimeout is the timeout of the client configs that a Server returns.
+const DefaultTimeout = 2 * time.Second
+
+type ServerConfig struct {
+	// Zones is zone-file text.  Each SOA record starts a new zone, so a
+	// single string may hold several zones.
+	Zones []string
+	// Addr is the IP address to listen on.  The default is 127.0.0.1.
+	// Other loopback addresses (127.0.0.2, ...) can be used on Linux to run
+	// several servers, e.g., a fake DNS hierarchy.
+	Addr string
+	// Port is the UDP and TCP port to listen on.  If 0, a random free port
+	// is used.  The TLS and HTTPS ports are always random.
+	Port int
+}
+
+// Behavior is a scripted misbehavior.
+type Behavior struct {
+	Delay    time.Duration // delay the response
+	Drop     bool          // don't respond at all
+	ServFail bool          // respond with SERVFAIL and no records
+	Truncate bool          // set TC and remove all records
+	WrongID  bool          // respond with an ID that doesn't match the query
+}
+
+// Rule applies a Behavior to the queries that it matches.
+type Rule struct {
+	Qname string // "" matches any qname; matching is case-insensitive
+	Qtype uint16 // 0 matches any qtype
+	// Transports limits the rule to queries over these transports.  If
+	// empty, the rule matches queries over any transport.
+	Transports []dnsclient.Transport
+	// Count is the number of queries that the rule applies to; after that,
+	// the rule is spent.  If 0, the rule applies to all matching queries.
+	Count int
+	Behavior
+}
+
+func (r *Rule) matches(q dns.Question, transport dnsclient.Transport) bool {
+	if r.Qname != "" && !strings.EqualFold(dns.Fqdn(r.Qname), q.Name) {
+		return false
+	}
+	if r.Qtype != 0 && r.Qtype != q.Qtype {
+		return false
+	}
+	if len(r.Transports) == 0 {
+		return true
+	}
+	for _, t := range r.Transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// Server is an authoritative DNS server.  It is safe for concurrent use.
+type Server struct {
+	// Do53Addr, DoTAddr, and URL are where the server listens for Do53
+	// (UDP and TCP), DoT, and DoH queries.
+	Do53Addr string
+	DoTAddr  string
+	URL      string
+	// CertPool holds the certificate of the CA that issued the server's
+	// certificate.
+	CertPool *x509.CertPool
+
+	zones []*zone
+
+	// the listeners are also closed by Close, in case a server never got
+	// to start
+	listeners []io.Closer
+
+	udp   *dns.Server
+	tcp   *dns.Server
+	tls   *dns.Server
+	https *http.Server
+	// started holds the DNS servers that have started
+	started []*dns.Server
+
+	mu      sync.Mutex
+	rules   []*Rule
+	queries []*dns.Msg
+}
+
+// NewServer parses the zones and starts serving them.  The caller must Close
+// the server.
+func NewServer(config *ServerConfig) (*Server, error) {
+	s := &Server{}
+
+	for _, text := range config.Zones {
+		zones, err := parseZones(text)
+		if err != nil {
+			return nil, err
+		}
+		s.zones = append(s.zones, zones...)
+	}
+
+	addr := config.Addr
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid listen address %q", addr)
+	}
+
+	ca, err := newCertAuthority()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA: %w", err)
+	}
+	cert, err := ca.issue(ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue server certificate: %w", err)
+	}
+	s.CertPool = ca.pool
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	pc, l, err := listenDo53(addr, config.Port)
+	if err != nil {
+		return nil, err
+	}
+	tl, err := tls.Listen("tcp", net.JoinHostPort(addr, "0"), tlsConfig)
+	if err != nil {
+		pc.Close()
+		l.Close()
+		return nil, err
+	}
+	hl, err := tls.Listen("tcp", net.JoinHostPort(addr, "0"), tlsConfig)
+	if err != nil {
+		pc.Close()
+		l.Close()
+		tl.Close()
+		return nil, err
+	}
+
+	s.Do53Addr = pc.LocalAddr().String()
+	s.DoTAddr = tl.Addr().String()
+	s.URL = "https://" + hl.Addr().String() + "/dns-query"
+
+	s.listeners = []io.Closer{pc, l, tl, hl}
+
+	s.udp = &dns.Server{PacketConn: pc, Handler: s.handler(dnsclient.TransportDo53UDP)}
+	s.tcp = &dns.Server{Listener: l, Handler: s.handler(dnsclient.TransportDo53TCP)}
+	s.tls = &dns.Server{Listener: tl, Handler: s.handler(dnsclient.TransportDoT)}
+	s.https = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+
+	// a server that fails to start never notifies, so wait for either
+	started := make(chan *dns.Server, 3)
+	failed := make(chan error, 3)
+	for _, srv := range []*dns.Server{s.udp, s.tcp, s.tls} {
+		srv := srv
+		srv.NotifyStartedFunc = func() { started <- srv }
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil {
+				failed <- err
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case srv := <-started:
+			s.started = append(s.started, srv)
+		case err := <-failed:
+			s.Close()
+			return nil, fmt.Errorf("failed to start server: %w", err)
+		}
+	}
+	// http.Server.Serve accepts on the listener right away
+	go s.https.Serve(hl)
+
+	return s, nil
+}
+
+// listenDo53 listens on the same UDP and TCP port.
+func listenDo53(addr string, port int) (net.PacketConn, net.Listener, error) {
+	var err error
+	tries := 1
+	if port == 0 {
+		// the random UDP port may be taken for TCP
+		tries = 10
+	}
+
+	for i := 0; i < tries; i++ {
+		var pc net.PacketConn
+		pc, err = net.ListenPacket("udp", net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err != nil {
+			return nil, nil, err
+		}
+		_, p, _ := net.SplitHostPort(pc.LocalAddr().String())
+		var l net.Listener
+		l, err = net.Listen("tcp", net.JoinHostPort(addr, p))
+		if err == nil {
+			return pc, l, nil
+		}
+		pc.Close()
+	}
+	return nil, nil, err
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	var errs []error
+	// a server that didn't start can't be shut down; its listener is
+	// closed below
+	for _, srv := range s.started {
+		errs = append(errs, srv.Shutdown())
+	}
+	errs = append(errs, s.https.Close())
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddRule adds a rule.  If several rules match a query, the one added first
+// applies.
+func (s *Server) AddRule(r Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, &r)
+}
+
+// ClearRules removes all rules.
+func (s *Server) ClearRules() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = nil
+}
+
+// Queries returns the queries the server has received, in order.
+func (s *Server) Queries() []*dns.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*dns.Msg(nil), s.queries...)
+}
+
+func (s *Server) baseConfig() dnsclient.Config {
+	return dnsclient.Config{Timeout: DefaultTimeout}
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.CertPool}
+}
+
+// Do53Config returns a config for querying the server over UDP.  Set
+// UseTCP to query it over TCP.
+func (s *Server) Do53Config() *dnsclient.Do53Config {
+	return &dnsclient.Do53Config{
+		Config: s.baseConfig(),
+		Server: s.Do53Addr,
+	}
+}
+
+// DoTConfig returns a config for querying the server over TLS.
+func (s *Server) DoTConfig() *dnsclient.DoTConfig {
+	return &dnsclient.DoTConfig{
+		Config:    s.baseConfig(),
+		Server:    s.DoTAddr,
+		TLSConfig: s.tlsConfig(),
+	}
+}
+
+// DoHConfig returns a config for querying the server over HTTPS.
+func (s *Server) DoHConfig() *dnsclient.DoHConfig {
+	return &dnsclient.DoHConfig{
+		Config:    s.baseConfig(),
+		URL:       s.URL,
+		TLSConfig: s.tlsConfig(),
+	}
+}
+
+// behavior records req and returns the behavior of the first rule that
+// matches it.
+func (s *Server) behavior(req *dns.Msg, transport dnsclient.Transport) Behavior {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries = append(s.queries, req.Copy())
+	if len(req.Question) == 0 {
+		return Behavior{}
+	}
+
+	for i, r := range s.rules {
+		if !r.matches(req.Question[0], transport) {
+			continue
+		}
+		if r.Count > 0 {
+			r.Count--
+			if r.Count == 0 {
+				s.rules = append(s.rules[:i:i], s.rules[i+1:]...)
+			}
+		}
+		return r.Behavior
+	}
+	return Behavior{}
+}
+
+// findZone returns the most specific zone that contains qname.  A DS query
+// for a zone's apex is answered from the parent zone, if the server has it.
+func (s *Server) findZone(qname string, qtype uint16) *zone {
+	var best *zone
+	for _, z := range s.zones {
+		if !dns.IsSubDomain(z.origin, qname) {
+			continue
+		}
+		if qtype == dns.TypeDS && z.origin == qname && qname != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.origin) > dns.CountLabel(best.origin) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (s *Server) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+		resp.SetEdns0(dns.DefaultMsgSize, do)
+	}
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeNotImplemented
+		return resp
+	}
+
+	q := req.Question[0]
+	z := s.findZone(strings.ToLower(q.Name), q.Qtype)
+	if z == nil {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	z.answer(resp, q, do)
+	return resp
+}
+
+// respond answers req, applying any scripted misbehavior.  It returns nil if
+// the query is to be dropped.
+func (s *Server) respond(req *dns.Msg, transport dnsclient.Transport) *dns.Msg {
+	b := s.behavior(req, transport)
+	if b.Delay > 0 {
+		time.Sleep(b.Delay)
+	}
+	if b.Drop {
+		return nil
+	}
+
+	resp := s.answer(req)
+	if b.ServFail {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	if b.Truncate {
+		resp.Truncated = true
+		resp.Answer = nil
+		resp.Ns = nil
+		resp.Extra = nil
+	}
+	if b.WrongID {
+		resp.Id = req.Id + 1
+	}
+	return resp
+}
+
+func (s *Server) handler(transport dnsclient.Transport) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := s.respond(req, transport)
+		if resp == nil {
+			return
+		}
+		if transport == dnsclient.TransportDo53UDP && !resp.Truncated {
+			size := dns.MinMsgSize
+			if opt := req.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			resp.Truncate(size)
+		}
+		w.WriteMsg(resp)
+	})
+}
+
+// serveHTTP answers DoH queries, both GET (RFC 8484 section 4.1) and POST.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	err = req.Unpack(wire)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := s.respond(req, dnsclient.TransportDoH)
+	if resp == nil {
+		// there is no way to drop an HTTP request; hold it until the
+		// client gives up
+		<-r.Context().Done()
+		return
+	}
+
+	wire, err = resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(wire)
+}
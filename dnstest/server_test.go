@@ -0,0 +1,288 @@
+package dnstest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+const exampleZone = `
+example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300
+example.com.	3600	IN	NS	ns1.example.com.
+ns1.example.com.	3600	IN	A	192.0.2.53
+www.example.com.	3600	IN	A	192.0.2.1
+alias.example.com.	3600	IN	CNAME	www.example.com.
+*.wild.example.com.	3600	IN	TXT	"wildcard"
+a.b.c.example.com.	3600	IN	A	192.0.2.2
+sub.example.com.	3600	IN	NS	ns.sub.example.com.
+ns.sub.example.com.	3600	IN	A	192.0.2.54
+`
+
+func newServer(t *testing.T, zones ...string) *dnstest.Server {
+	t.Helper()
+	s, err := dnstest.NewServer(&dnstest.ServerConfig{Zones: zones})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, c dnsclient.Client) dnsclient.Client {
+	t.Helper()
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func exchange(t *testing.T, c dnsclient.Client, name string, qtype uint16, do bool) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	if do {
+		req.SetEdns0(4096, true)
+	}
+	resp, err := c.Query(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	return resp
+}
+
+func TestTransports(t *testing.T) {
+	s := newServer(t, exampleZone)
+
+	tcp := s.Do53Config()
+	tcp.UseTCP = true
+	clients := map[string]dnsclient.Client{
+		"udp": dnsclient.NewDo53Client(s.Do53Config()),
+		"tcp": dnsclient.NewDo53Client(tcp),
+		"dot": dnsclient.NewDoTClient(s.DoTConfig()),
+		"doh": dnsclient.NewDoHClient(s.DoHConfig()),
+	}
+	for name, c := range clients {
+		t.Run(name, func(t *testing.T) {
+			dial(t, c)
+			resp := exchange(t, c, "www.example.com.", dns.TypeA, false)
+			addrs := msgutil.CollectRRs[*dns.A](resp.Answer)
+			if len(addrs) != 1 || addrs[0].A.String() != "192.0.2.1" {
+				t.Errorf("unexpected answer: %v", resp.Answer)
+			}
+		})
+	}
+	if n := len(s.Queries()); n != len(clients) {
+		t.Errorf("the server recorded %d queries, want %d", n, len(clients))
+	}
+}
+
+func TestAnswers(t *testing.T) {
+	s := newServer(t, exampleZone)
+	c := dial(t, dnsclient.NewDo53Client(s.Do53Config()))
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+		auth    bool
+	}{
+		{"answer", "www.example.com.", dns.TypeA, dns.RcodeSuccess, 1, true},
+		{"cname", "alias.example.com.", dns.TypeA, dns.RcodeSuccess, 2, true},
+		{"wildcard", "x.wild.example.com.", dns.TypeTXT, dns.RcodeSuccess, 1, true},
+		{"nodata", "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0, true},
+		{"empty non-terminal", "b.c.example.com.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"nxdomain", "nope.example.com.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"referral", "www.sub.example.com.", dns.TypeA, dns.RcodeSuccess, 0, false},
+		{"refused", "www.example.org.", dns.TypeA, dns.RcodeRefused, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := exchange(t, c, tt.qname, tt.qtype, false)
+			if resp.Rcode != tt.rcode {
+				t.Errorf("rcode: got %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if len(resp.Answer) != tt.answers {
+				t.Errorf("got %d answers, want %d: %v", len(resp.Answer), tt.answers, resp.Answer)
+			}
+			if resp.Authoritative != tt.auth {
+				t.Errorf("AA: got %v, want %v", resp.Authoritative, tt.auth)
+			}
+		})
+	}
+
+	resp := exchange(t, c, "www.sub.example.com.", dns.TypeA, false)
+	if len(msgutil.CollectRRs[*dns.NS](resp.Ns)) != 1 || len(msgutil.CollectRRs[*dns.A](resp.Extra)) != 1 {
+		t.Errorf("the referral lacks the NS record or its glue: %v", resp)
+	}
+}
+
+func TestRules(t *testing.T) {
+	s := newServer(t, exampleZone)
+
+	udpConfig := s.Do53Config()
+	udpConfig.Timeout = 200 * time.Millisecond
+	udp := dial(t, dnsclient.NewDo53Client(udpConfig))
+	tcpConfig := s.Do53Config()
+	tcpConfig.UseTCP = true
+	tcp := dial(t, dnsclient.NewDo53Client(tcpConfig))
+
+	t.Run("truncate", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{Qname: "www.example.com", Count: 1, Behavior: dnstest.Behavior{Truncate: true}})
+		resp := exchange(t, udp, "www.example.com.", dns.TypeA, false)
+		if !resp.Truncated || len(resp.Answer) != 0 {
+			t.Errorf("expected an empty, truncated response: %v", resp)
+		}
+		// the rule is spent
+		resp = exchange(t, udp, "www.example.com.", dns.TypeA, false)
+		if resp.Truncated || len(resp.Answer) != 1 {
+			t.Errorf("expected a full response: %v", resp)
+		}
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{Qtype: dns.TypeA, Count: 1, Behavior: dnstest.Behavior{ServFail: true}})
+		resp := exchange(t, udp, "www.example.com.", dns.TypeA, false)
+		if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 {
+			t.Errorf("expected an empty SERVFAIL response: %v", resp)
+		}
+	})
+
+	t.Run("transports", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{
+			Transports: []dnsclient.Transport{dnsclient.TransportDo53TCP},
+			Count:      1,
+			Behavior:   dnstest.Behavior{ServFail: true},
+		})
+		if resp := exchange(t, udp, "www.example.com.", dns.TypeA, false); resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("a TCP rule applied to a UDP query")
+		}
+		if resp := exchange(t, tcp, "www.example.com.", dns.TypeA, false); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("the TCP rule didn't apply")
+		}
+	})
+
+	t.Run("wrong id", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{Count: 1, Behavior: dnstest.Behavior{WrongID: true}})
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if _, err := tcp.Query(req); !errors.Is(err, dns.ErrId) {
+			t.Errorf("got error %v, want %v", err, dns.ErrId)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{Count: 1, Behavior: dnstest.Behavior{Drop: true}})
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if _, err := udp.Query(req); !errors.Is(err, dnsclient.ErrTimeout) {
+			t.Errorf("got error %v, want %v", err, dnsclient.ErrTimeout)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		s.AddRule(dnstest.Rule{Count: 1, Behavior: dnstest.Behavior{Delay: 100 * time.Millisecond}})
+		start := time.Now()
+		exchange(t, udp, "www.example.com.", dns.TypeA, false)
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("the response came after %v", elapsed)
+		}
+	})
+
+	s.ClearRules()
+	if resp := exchange(t, udp, "www.example.com.", dns.TypeA, false); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("a rule survived ClearRules")
+	}
+}
+
+// verifySigs checks that each RRset in section is covered by a valid RRSIG
+// by key.
+func verifySigs(t *testing.T, section []dns.RR, key *dns.DNSKEY) {
+	t.Helper()
+	rrsets := make(map[string][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		key := rr.Header().Name + "/" + dns.TypeToString[rr.Header().Rrtype]
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	for name, rrset := range rrsets {
+		verified := false
+		for _, sig := range sigs {
+			if sig.Hdr.Name == rrset[0].Header().Name && sig.TypeCovered == rrset[0].Header().Rrtype {
+				if err := sig.Verify(key, rrset); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				verified = true
+			}
+		}
+		if !verified {
+			t.Errorf("%s has no RRSIG", name)
+		}
+	}
+}
+
+func TestSignZone(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		name := "nsec"
+		if nsec3 {
+			name = "nsec3"
+		}
+		t.Run(name, func(t *testing.T) {
+			signed, err := dnstest.SignZone(exampleZone, &dnstest.SignConfig{NSEC3: nsec3, Salt: "abcd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newServer(t, signed.Text)
+			c := dial(t, dnsclient.NewDo53Client(s.Do53Config()))
+
+			resp := exchange(t, c, "example.com.", dns.TypeDNSKEY, true)
+			keys := msgutil.CollectRRs[*dns.DNSKEY](resp.Answer)
+			if len(keys) != 1 || keys[0].KeyTag() != signed.Key.KeyTag() {
+				t.Fatalf("unexpected DNSKEY RRset: %v", resp.Answer)
+			}
+			if signed.DS.KeyTag != signed.Key.KeyTag() {
+				t.Errorf("the DS record is for key %d, not %d", signed.DS.KeyTag, signed.Key.KeyTag())
+			}
+			verifySigs(t, resp.Answer, signed.Key)
+
+			for _, q := range []struct {
+				name  string
+				qtype uint16
+			}{
+				{"www.example.com.", dns.TypeA},
+				{"www.example.com.", dns.TypeAAAA},
+				{"x.wild.example.com.", dns.TypeTXT},
+				{"b.c.example.com.", dns.TypeA},
+				{"nope.example.com.", dns.TypeA},
+			} {
+				resp := exchange(t, c, q.name, q.qtype, true)
+				verifySigs(t, resp.Answer, signed.Key)
+				verifySigs(t, resp.Ns, signed.Key)
+				if len(resp.Answer) == 0 || q.name == "x.wild.example.com." {
+					denials := len(msgutil.CollectRRs[*dns.NSEC](resp.Ns)) +
+						len(msgutil.CollectRRs[*dns.NSEC3](resp.Ns))
+					if denials == 0 {
+						t.Errorf("%s %s: no NSEC or NSEC3 records", q.name, dns.TypeToString[q.qtype])
+					}
+				}
+			}
+
+			// the delegation is unsigned, and so is the glue
+			resp = exchange(t, c, "www.sub.example.com.", dns.TypeA, true)
+			if sigs := msgutil.CollectRRs[*dns.RRSIG](append(resp.Ns, resp.Extra...)); len(sigs) != 0 {
+				t.Errorf("the referral has signatures: %v", sigs)
+			}
+		})
+	}
+}
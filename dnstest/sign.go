@@ -0,0 +1,325 @@
+package dnstest
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// SignConfig configures SignZone.  The zero value signs with NSEC records
+// that are valid from an hour ago until 30 days from now.
+type SignConfig struct {
+	// NSEC3 selects NSEC3 records (RFC 5155) instead of NSEC records for
+	// authenticated denial of existence.
+	NSEC3 bool
+	// OptOut sets the NSEC3 Opt-Out flag, and leaves unsigned delegations
+	// out of the NSEC3 chain.
+	OptOut bool
+	// Iterations and Salt (in hex) are the NSEC3 parameters.
+	Iterations uint16
+	Salt       string
+	// Inception and Expiration bound the validity period of the
+	// signatures.
+	Inception  time.Time
+	Expiration time.Time
+}
+
+// SignedZone is a zone signed by SignZone.
+type SignedZone struct {
+	// Text is the signed zone, as zone-file text, for a ServerConfig.
+	Text string
+	// Key is the zone's only key, which signs all of its RRsets.
+	Key *dns.DNSKEY
+	// DS is the DS record (with a SHA-256 digest) of Key, for the parent
+	// zone or as a trust anchor.
+	DS *dns.DS
+}
+
+// SignZone signs the zone in text, which must hold a single zone, with a
+// freshly generated ECDSA P-256 key.  It adds the DNSKEY RRset, the NSEC or
+// NSEC3 chain, and the RRSIGs.  Any DS records for delegations must already
+// be in the zone; names below a delegation are glue, and are left unsigned.
+func SignZone(text string, config *SignConfig) (*SignedZone, error) {
+	zones, err := parseZones(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) != 1 {
+		return nil, fmt.Errorf("expected one zone, got %d", len(zones))
+	}
+	z := zones[0]
+
+	inception, expiration := config.Inception, config.Expiration
+	if inception.IsZero() {
+		inception = time.Now().Add(-time.Hour)
+	}
+	if expiration.IsZero() {
+		expiration = time.Now().Add(30 * 24 * time.Hour)
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	z.records[z.origin] = append(z.records[z.origin], key)
+
+	soas := z.soa()
+	if len(soas) == 0 {
+		return nil, errors.New("the zone has no SOA record")
+	}
+	soa := soas[0].(*dns.SOA)
+	denialTTL := min(soa.Hdr.Ttl, soa.Minttl)
+
+	var denials []dns.RR
+	if config.NSEC3 {
+		param := &dns.NSEC3PARAM{
+			Hdr:        dns.RR_Header{Name: z.origin, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			Iterations: config.Iterations,
+			SaltLength: uint8(len(config.Salt) / 2),
+			Salt:       config.Salt,
+		}
+		z.records[z.origin] = append(z.records[z.origin], param)
+		denials = z.nsec3Chain(config, denialTTL)
+	} else {
+		denials = z.nsecChain(denialTTL)
+	}
+
+	signer := priv.(crypto.Signer)
+	sign := func(rrset []dns.RR) (dns.RR, error) {
+		h := rrset[0].Header()
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+			Inception:  uint32(inception.Unix()),
+			Expiration: uint32(expiration.Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: z.origin,
+			Algorithm:  key.Algorithm,
+		}
+		if err := sig.Sign(signer, rrset); err != nil {
+			return nil, fmt.Errorf("failed to sign %s %s: %w", h.Name, dns.TypeToString[h.Rrtype], err)
+		}
+		return sig, nil
+	}
+
+	var out []dns.RR
+	for _, name := range z.names() {
+		if z.occluded(name) {
+			out = append(out, z.records[name]...)
+			continue
+		}
+		_, delegation := z.delegation(name)
+		for _, rrset := range groupRRsets(z.records[name]) {
+			out = append(out, rrset...)
+			t := rrset[0].Header().Rrtype
+			if delegation && t != dns.TypeDS {
+				// the parent doesn't sign the delegation's NS RRset
+				continue
+			}
+			sig, err := sign(rrset)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sig)
+		}
+	}
+	for _, rr := range denials {
+		out = append(out, rr)
+		sig, err := sign([]dns.RR{rr})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sig)
+	}
+
+	var b strings.Builder
+	for _, rr := range out {
+		b.WriteString(rr.String())
+		b.WriteByte('\n')
+	}
+	return &SignedZone{Text: b.String(), Key: key, DS: key.ToDS(dns.SHA256)}, nil
+}
+
+// groupRRsets groups rrs, which share an owner name, by type, leaving out any
+// RRSIGs.
+func groupRRsets(rrs []dns.RR) [][]dns.RR {
+	var rrsets [][]dns.RR
+	index := make(map[uint16]int)
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == dns.TypeRRSIG {
+			continue
+		}
+		i, ok := index[t]
+		if !ok {
+			i = len(rrsets)
+			index[t] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets
+}
+
+// names returns the owner names of the zone, in canonical order.
+func (z *zone) names() []string {
+	var names []string
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return msgutil.CompareNames(names[i], names[j]) < 0
+	})
+	return names
+}
+
+// delegation reports whether name is a delegation point, and whether the
+// delegation is signed (has a DS RRset).
+func (z *zone) delegation(name string) (signed, ok bool) {
+	if name == z.origin || len(z.rrset(name, dns.TypeNS)) == 0 {
+		return false, false
+	}
+	return len(z.rrset(name, dns.TypeDS)) > 0, true
+}
+
+// occluded reports whether name is below a delegation point or a DNAME, and
+// is thus not authoritative data of the zone.
+func (z *zone) occluded(name string) bool {
+	for name != z.origin {
+		name = parentOf(name)
+		if _, ok := z.delegation(name); ok {
+			return true
+		}
+		if len(z.rrset(name, dns.TypeDNAME)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parentOf(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// typeBitmap returns the types present at name, plus extra, in ascending
+// order.
+func (z *zone) typeBitmap(name string, extra ...uint16) []uint16 {
+	seen := make(map[uint16]bool)
+	var types []uint16
+	for _, t := range extra {
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	for _, rr := range z.records[name] {
+		t := rr.Header().Rrtype
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// nsecChain returns the NSEC records of the zone (RFC 4034, section 4).
+func (z *zone) nsecChain(ttl uint32) []dns.RR {
+	var names []string
+	for _, name := range z.names() {
+		if !z.occluded(name) {
+			names = append(names, name)
+		}
+	}
+
+	var nsecs []dns.RR
+	for i, name := range names {
+		nsecs = append(nsecs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: z.typeBitmap(name, dns.TypeNSEC, dns.TypeRRSIG),
+		})
+	}
+	return nsecs
+}
+
+// nsec3Chain returns the NSEC3 records of the zone (RFC 5155, section 7.1),
+// including those of empty non-terminals.
+func (z *zone) nsec3Chain(config *SignConfig, ttl uint32) []dns.RR {
+	type entry struct {
+		hash   string
+		bitmap []uint16
+	}
+
+	var flags uint8
+	if config.OptOut {
+		flags = 1
+	}
+
+	seen := make(map[string]bool)
+	var entries []entry
+	add := func(name string, bitmap []uint16) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		hash := strings.ToLower(dns.HashName(name, dns.SHA1, config.Iterations, config.Salt))
+		entries = append(entries, entry{hash: hash, bitmap: bitmap})
+	}
+
+	for _, name := range z.names() {
+		if z.occluded(name) {
+			continue
+		}
+		signed, delegation := z.delegation(name)
+		switch {
+		case delegation && !signed:
+			if config.OptOut {
+				continue
+			}
+			add(name, z.typeBitmap(name))
+		default:
+			add(name, z.typeBitmap(name, dns.TypeRRSIG))
+		}
+		for ent := name; ent != z.origin; {
+			ent = parentOf(ent)
+			if len(z.records[ent]) == 0 {
+				add(ent, nil)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+
+	var nsec3s []dns.RR
+	for i, e := range entries {
+		nsec3s = append(nsec3s, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: e.hash + "." + strings.TrimPrefix(z.origin, "."), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: config.Iterations,
+			SaltLength: uint8(len(config.Salt) / 2),
+			Salt:       config.Salt,
+			HashLength: 20,
+			NextDomain: strings.ToUpper(entries[(i+1)%len(entries)].hash),
+			TypeBitMap: e.bitmap,
+		})
+	}
+	return nsec3s
+}
@@ -0,0 +1,399 @@
+package dnstest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// maxCNAMEChase bounds how many in-zone CNAMEs the server follows when
+// building an answer.
+const maxCNAMEChase = 8
+
+// zone holds the records of one zone, indexed by (lowercased) owner name.
+type zone struct {
+	origin  string
+	records map[string][]dns.RR
+}
+
+// parseZones parses zone-file text into zones.  Each SOA record in the text
+// starts a new zone, so several zones may be given in one text; records that
+// appear before the first SOA are an error.
+func parseZones(text string) ([]*zone, error) {
+	var zones []*zone
+	var z *zone
+
+	zp := dns.NewZoneParser(strings.NewReader(text), ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		rr.Header().Name = name
+		if soa, ok := rr.(*dns.SOA); ok {
+			z = &zone{origin: name, records: make(map[string][]dns.RR)}
+			zones = append(zones, z)
+			soa.Hdr.Name = name
+		}
+		if z == nil {
+			return nil, fmt.Errorf("record %q appears before any SOA record", rr.String())
+		}
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("record %q is outside of zone %q", rr.String(), z.origin)
+		}
+		z.records[name] = append(z.records[name], rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone: %w", err)
+	}
+	return zones, nil
+}
+
+func (z *zone) soa() []dns.RR {
+	return z.rrset(z.origin, dns.TypeSOA)
+}
+
+// rrset returns the records of type t at name.  Signatures (type RRSIG) are
+// selected by the type they cover, so rrset(name, dns.TypeRRSIG) returns
+// nothing.
+func (z *zone) rrset(name string, t uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.records[name] {
+		if rr.Header().Rrtype == t {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+// sigs returns the RRSIGs at name that cover type t.
+func (z *zone) sigs(name string, t uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.records[name] {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+// withSigs appends the RRSIGs that cover rrs, if do is set.
+func (z *zone) withSigs(rrs []dns.RR, do bool) []dns.RR {
+	if !do || len(rrs) == 0 {
+		return rrs
+	}
+	h := rrs[0].Header()
+	return append(rrs, z.sigs(h.Name, h.Rrtype)...)
+}
+
+// exists reports whether name owns records or is an empty non-terminal.
+func (z *zone) exists(name string) bool {
+	if len(z.records[name]) > 0 {
+		return true
+	}
+	for owner := range z.records {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// cut returns the highest delegation point (a non-apex name with NS records)
+// at or above qname, if any.
+func (z *zone) cut(qname string) (string, bool) {
+	labels := dns.SplitDomainName(qname)
+	depth := dns.CountLabel(z.origin)
+	for i := len(labels) - depth - 1; i >= 0; i-- {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		if len(z.rrset(name, dns.TypeNS)) > 0 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// glue returns the in-zone address records of the nameservers in ns.
+func (z *zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(z.origin, target) {
+			continue
+		}
+		extra = append(extra, z.rrset(target, dns.TypeA)...)
+		extra = append(extra, z.rrset(target, dns.TypeAAAA)...)
+	}
+	return extra
+}
+
+// wildcard returns the wildcard name that would synthesize qname: the
+// wildcard child of qname's closest encloser.
+func (z *zone) wildcard(qname string) string {
+	name := qname
+	for name != z.origin {
+		off, _ := dns.NextLabel(name, 0)
+		name = name[off:]
+		if name == "" {
+			name = "."
+		}
+		if z.exists(name) {
+			break
+		}
+	}
+	return wildcardName(name)
+}
+
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// dname returns the DNAME record at a proper ancestor of qname, if any.
+func (z *zone) dname(qname string) (*dns.DNAME, bool) {
+	name := qname
+	for name != z.origin {
+		off, _ := dns.NextLabel(name, 0)
+		name = name[off:]
+		if name == "" {
+			name = "."
+		}
+		if rrs := z.rrset(name, dns.TypeDNAME); len(rrs) > 0 {
+			return rrs[0].(*dns.DNAME), true
+		}
+	}
+	return nil, false
+}
+
+// synthesize copies rrs, with their owner name replaced by qname.
+func synthesize(rrs []dns.RR, qname string) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Name = qname
+	}
+	return rrs
+}
+
+// answer fills in resp (which has been initialized with SetReply) as an
+// authoritative server for z.
+func (z *zone) answer(resp *dns.Msg, q dns.Question, do bool) {
+	qname := strings.ToLower(q.Name)
+
+	// a name at or below a zone cut is answered with a referral, except
+	// for a DS query at the cut itself, which the parent answers
+	if cut, ok := z.cut(qname); ok && !(cut == qname && q.Qtype == dns.TypeDS) {
+		ns := z.rrset(cut, dns.TypeNS)
+		resp.Ns = append(resp.Ns, ns...)
+		if do {
+			resp.Ns = append(resp.Ns, z.withSigs(z.rrset(cut, dns.TypeDS), do)...)
+		}
+		resp.Extra = append(resp.Extra, z.glue(ns)...)
+		return
+	}
+
+	resp.Authoritative = true
+
+	for i := 0; i < maxCNAMEChase; i++ {
+		if dname, ok := z.dname(qname); ok {
+			// RFC 6672, section 3.1: the DNAME, and the CNAME
+			// synthesized from it
+			target := strings.TrimSuffix(qname, dname.Hdr.Name) + dns.Fqdn(dname.Target)
+			if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+				resp.Rcode = dns.RcodeYXDomain
+				return
+			}
+			resp.Answer = append(resp.Answer, z.withSigs(z.rrset(dname.Hdr.Name, dns.TypeDNAME), do)...)
+			resp.Answer = append(resp.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.Hdr.Ttl},
+				Target: target,
+			})
+			target = strings.ToLower(target)
+			if !dns.IsSubDomain(z.origin, target) {
+				return
+			}
+			if _, ok := z.cut(target); ok {
+				return
+			}
+			qname = target
+			continue
+		}
+
+		owner := qname
+		if !z.exists(qname) {
+			owner = z.wildcard(qname)
+			if !z.exists(owner) {
+				// as per RFC 6604, the rcode reflects the last name in
+				// the chain
+				resp.Rcode = dns.RcodeNameError
+				resp.Ns = append(resp.Ns, z.withSigs(z.soa(), do)...)
+				if do {
+					resp.Ns = append(resp.Ns, z.proveNoName(qname, true)...)
+				}
+				return
+			}
+		}
+
+		if do && owner != qname {
+			// prove that the wildcard applies (RFC 4035, section 3.1.3.3)
+			resp.Ns = append(resp.Ns, z.proveNoName(qname, false)...)
+		}
+
+		rrs := z.rrset(owner, q.Qtype)
+		if len(rrs) > 0 {
+			rrs = z.withSigs(rrs, do)
+			resp.Answer = append(resp.Answer, synthesize(rrs, qname)...)
+			return
+		}
+
+		cname := z.rrset(owner, dns.TypeCNAME)
+		if len(cname) == 0 || q.Qtype == dns.TypeCNAME {
+			// NODATA
+			resp.Ns = append(resp.Ns, z.withSigs(z.soa(), do)...)
+			if do {
+				resp.Ns = append(resp.Ns, z.proveNoData(owner)...)
+			}
+			return
+		}
+
+		target := strings.ToLower(cname[0].(*dns.CNAME).Target)
+		cname = z.withSigs(cname, do)
+		resp.Answer = append(resp.Answer, synthesize(cname, qname)...)
+		if !dns.IsSubDomain(z.origin, target) {
+			return
+		}
+		if _, ok := z.cut(target); ok {
+			return
+		}
+		qname = target
+	}
+}
+
+// closestEncloser returns the closest existing ancestor of qname.
+func (z *zone) closestEncloser(qname string) string {
+	name := qname
+	for name != z.origin && !z.exists(name) {
+		off, _ := dns.NextLabel(name, 0)
+		name = name[off:]
+	}
+	return name
+}
+
+// nextCloser returns the name that is one label longer than ce, on the way to
+// qname.
+func nextCloser(qname, ce string) string {
+	labels := dns.SplitDomainName(qname)
+	n := dns.CountLabel(ce)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n-1:], "."))
+}
+
+// denialRecords collects NSEC or NSEC3 records of a zone, with their
+// signatures and without duplicates.
+type denialRecords struct {
+	z    *zone
+	rrs  []dns.RR
+	seen map[string]bool
+}
+
+func (d *denialRecords) add(rr dns.RR) {
+	key := rr.String()
+	if d.seen[key] {
+		return
+	}
+	d.seen[key] = true
+	d.rrs = append(d.rrs, dns.Copy(rr))
+	d.rrs = append(d.rrs, d.z.sigs(rr.Header().Name, rr.Header().Rrtype)...)
+}
+
+func (z *zone) newDenialRecords() *denialRecords {
+	return &denialRecords{z: z, seen: make(map[string]bool)}
+}
+
+// matching adds the NSEC or NSEC3 record whose owner is (or hashes
+// from) name.
+func (d *denialRecords) matching(name string) {
+	for _, rrs := range d.z.records {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if rr.Hdr.Name == name {
+					d.add(rr)
+				}
+			case *dns.NSEC3:
+				if rr.Match(name) {
+					d.add(rr)
+				}
+			}
+		}
+	}
+}
+
+// covering adds the NSEC or NSEC3 record that proves that name doesn't exist.
+func (d *denialRecords) covering(name string) {
+	for _, rrs := range d.z.records {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if msgutil.NSECCovers(rr, name) {
+					d.add(rr)
+				}
+			case *dns.NSEC3:
+				if rr.Cover(name) {
+					d.add(rr)
+				}
+			}
+		}
+	}
+}
+
+func (z *zone) hasNSEC3() bool {
+	return len(z.rrset(z.origin, dns.TypeNSEC3PARAM)) > 0
+}
+
+// proveNoName returns the records that prove that qname doesn't exist: the
+// record that covers it (for NSEC3, the closest encloser proof) and, if
+// nxdomain is set, the record that covers the wildcard at the closest
+// encloser.  Without nxdomain, it is the proof that goes with a wildcard
+// answer.
+func (z *zone) proveNoName(qname string, nxdomain bool) []dns.RR {
+	d := z.newDenialRecords()
+	ce := z.closestEncloser(qname)
+	if z.hasNSEC3() {
+		d.matching(ce)
+		d.covering(nextCloser(qname, ce))
+	} else {
+		d.covering(qname)
+	}
+	if nxdomain {
+		d.covering(wildcardName(ce))
+	}
+	return d.rrs
+}
+
+// proveNoData returns the records that prove that name (which exists) has
+// no RRset of the query type: the record that matches it or, for an empty
+// non-terminal in an NSEC zone, the record that covers it.  An unsigned
+// delegation in an opt-out NSEC3 zone has no record of its own; for it, the
+// closest encloser proof is returned.
+func (z *zone) proveNoData(name string) []dns.RR {
+	d := z.newDenialRecords()
+	d.matching(name)
+	if len(d.rrs) > 0 {
+		return d.rrs
+	}
+	if !z.hasNSEC3() {
+		d.covering(name)
+		return d.rrs
+	}
+	ce := name
+	for ce != z.origin {
+		off, _ := dns.NextLabel(ce, 0)
+		ce = ce[off:]
+		d.matching(ce)
+		if len(d.rrs) > 0 {
+			break
+		}
+	}
+	d.covering(nextCloser(name, ce))
+	return d.rrs
+}
@@ -1,7 +1,8 @@
 package dnsclient
 
 import (
-	"fmt"
+	"context"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -37,11 +38,23 @@ func (c *Do53Client) GetConfig() *Config {
 	return &c.config.Config
 }
 
+func (c *Do53Client) Transport() Transport {
+	if c.config.UseTCP {
+		return TransportDo53TCP
+	}
+	return TransportDo53UDP
+}
+
+func (c *Do53Client) Server() string {
+	return c.config.Server
+}
+
 func (c *Do53Client) Dial() error {
 	var err error
 	c.conn, err = c.client.Dial(c.config.Server)
+	observeDial(&c.config.Config, c.Transport(), c.config.Server, err)
 	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server: %w", err)
+		return newTransportError(c.Transport(), c.config.Server, "dial", err)
 	}
 	return nil
 }
@@ -51,6 +64,59 @@ func (c *Do53Client) Close() error {
 }
 
 func (c *Do53Client) Query(req *dns.Msg) (*dns.Msg, error) {
-	resp, _, err := c.client.ExchangeWithConn(req, c.conn)
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *Do53Client) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, aborted, err := exchangeContext(ctx, c.client, c.conn, req)
+	timedOut := isTimeout(err)
+	if err != nil {
+		err = newTransportError(c.Transport(), c.config.Server, "query", err)
+	}
+	observeQuery(&c.config.Config, c.Transport(), c.config.Server, req, resp, err, start)
+	if (aborted || timedOut) && c.config.UseTCP {
+		// the stream may hold part of the abandoned response, or the
+		// late response to it
+		c.conn = redial(&c.config.Config, c.Transport(), c.client, c.conn, c.config.Server)
+	}
 	return resp, err
 }
+
+// exchangeContext sends req over conn and waits for the response, giving up
+// as soon as ctx is done.  aborted reports whether the exchange was cut
+// short, in which case a stream-oriented conn is left in an unknown state.
+// A response that arrived before ctx was done is still returned.
+func exchangeContext(ctx context.Context, client *dns.Client, conn *dns.Conn, req *dns.Msg) (resp *dns.Msg, aborted bool, err error) {
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+		close(done)
+	})
+	resp, _, err = client.ExchangeWithConnContext(ctx, req, conn)
+	if stop() {
+		return resp, false, err
+	}
+
+	// the deadline was (or is being) cut short
+	<-done
+	if err != nil {
+		return nil, true, ctx.Err()
+	}
+	// the exchange completed regardless; the next one sets its own
+	// deadlines
+	conn.SetDeadline(time.Time{})
+	return resp, false, nil
+}
+
+// redial replaces conn with a fresh connection to server.  If the dial fails,
+// the old (closed) conn is returned so that subsequent queries fail cleanly.
+func redial(config *Config, transport Transport, client *dns.Client, conn *dns.Conn, server string) *dns.Conn {
+	conn.Close()
+	newConn, err := client.Dial(server)
+	observeDial(config, transport, server, err)
+	if err != nil {
+		return conn
+	}
+	return newConn
+}
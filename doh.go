@@ -3,16 +3,19 @@ package dnsclient
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 type DoHConfig struct {
 	Config
-	URL string
+	URL       string
+	TLSConfig *tls.Config // optional
 }
 
 type DoHClient struct {
@@ -23,6 +26,12 @@ type DoHClient struct {
 func NewDoHClient(config *DoHConfig) *DoHClient {
 	c := &DoHClient{config: config}
 	c.client = &http.Client{Timeout: config.Timeout}
+	if config.TLSConfig != nil {
+		c.client.Transport = &http.Transport{
+			TLSClientConfig:   config.TLSConfig,
+			ForceAttemptHTTP2: true,
+		}
+	}
 	return c
 }
 
@@ -30,6 +39,14 @@ func (c *DoHClient) GetConfig() *Config {
 	return &c.config.Config
 }
 
+func (c *DoHClient) Transport() Transport {
+	return TransportDoH
+}
+
+func (c *DoHClient) Server() string {
+	return c.config.URL
+}
+
 func (c *DoHClient) Dial() error {
 	return nil
 }
@@ -38,10 +55,9 @@ func (c *DoHClient) Close() error {
 	return nil
 }
 
-func newHTTPPostRequest(url string, postData []byte) (*http.Request, error) {
+func newHTTPPostRequest(ctx context.Context, url string, postData []byte) (*http.Request, error) {
 	reqBodyReader := bytes.NewReader(postData)
-	req, err := http.NewRequestWithContext(context.Background(),
-		http.MethodPost, url, reqBodyReader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reqBodyReader)
 	if err != nil {
 		return nil, err
 	}
@@ -52,35 +68,51 @@ func newHTTPPostRequest(url string, postData []byte) (*http.Request, error) {
 
 // Raw Query
 func (c *DoHClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *DoHClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := c.exchange(ctx, req)
+	observeQuery(&c.config.Config, TransportDoH, c.config.URL, req, resp, err, start)
+	return resp, err
+}
+
+func (c *DoHClient) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	msg, err := req.Pack()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DNS request %w", err)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query",
+			fmt.Errorf("failed to create DNS request: %w", err))
 	}
 
-	post, err := newHTTPPostRequest(c.config.URL, msg)
+	post, err := newHTTPPostRequest(ctx, c.config.URL, msg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query",
+			fmt.Errorf("failed to create HTTP request: %w", err))
 	}
 
 	resp, err := c.client.Do(post)
 	if err != nil {
-		return nil, fmt.Errorf("error making HTTPS request: %w", err)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading HTTPS response: %w", err)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query",
+			fmt.Errorf("error reading HTTPS response: %w", err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTPS response returned an error: %v", resp.StatusCode)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query",
+			&HTTPStatusError{StatusCode: resp.StatusCode})
 	}
 
 	var reply dns.Msg
 	err = reply.Unpack(body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unpack DNS response message: %w", err)
+		return nil, newTransportError(TransportDoH, c.config.URL, "query",
+			fmt.Errorf("failed to unpack DNS response message: %w", err))
 	}
 
 	return &reply, nil
@@ -1,8 +1,9 @@
 package dnsclient
 
 import (
+	"context"
 	"crypto/tls"
-	"fmt"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -22,8 +23,9 @@ type DoTClient struct {
 func NewDoTClient(config *DoTConfig) *DoTClient {
 	c := &DoTClient{config: config}
 	c.client = &dns.Client{
-		Net:     "tcp-tls",
-		Timeout: config.Timeout,
+		Net:       "tcp-tls",
+		Timeout:   config.Timeout,
+		TLSConfig: config.TLSConfig,
 	}
 	return c
 }
@@ -32,11 +34,20 @@ func (c *DoTClient) GetConfig() *Config {
 	return &c.config.Config
 }
 
+func (c *DoTClient) Transport() Transport {
+	return TransportDoT
+}
+
+func (c *DoTClient) Server() string {
+	return c.config.Server
+}
+
 func (c *DoTClient) Dial() error {
 	var err error
 	c.conn, err = c.client.Dial(c.config.Server)
+	observeDial(&c.config.Config, TransportDoT, c.config.Server, err)
 	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server: %w", err)
+		return newTransportError(TransportDoT, c.config.Server, "dial", err)
 	}
 	return nil
 }
@@ -46,6 +57,21 @@ func (c *DoTClient) Close() error {
 }
 
 func (c *DoTClient) Query(req *dns.Msg) (*dns.Msg, error) {
-	resp, _, err := c.client.ExchangeWithConn(req, c.conn)
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *DoTClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, aborted, err := exchangeContext(ctx, c.client, c.conn, req)
+	timedOut := isTimeout(err)
+	if err != nil {
+		err = newTransportError(TransportDoT, c.config.Server, "query", err)
+	}
+	observeQuery(&c.config.Config, TransportDoT, c.config.Server, req, resp, err, start)
+	if aborted || timedOut {
+		// as for Do53 over TCP, the stream may hold a (late) response
+		// to this query
+		c.conn = redial(&c.config.Config, TransportDoT, c.client, c.conn, c.config.Server)
+	}
 	return resp, err
 }
@@ -0,0 +1,62 @@
+package dnsclient
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ExtendedError is an Extended DNS Error (RFC 8914): an EDNS option in which
+// a server explains a failure (or a notable success, such as a stale or
+// filtered answer).  InfoCode is one of the dns.ExtendedErrorCode constants,
+// e.g., dns.ExtendedErrorCodeDNSBogus or dns.ExtendedErrorCodeBlocked.
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string // optional; free-form text for humans
+}
+
+func (e *ExtendedError) String() string {
+	s, ok := dns.ExtendedErrorCodeToString[e.InfoCode]
+	if !ok {
+		s = fmt.Sprintf("EDE(%d)", e.InfoCode)
+	} else {
+		s = fmt.Sprintf("%s (%d)", s, e.InfoCode)
+	}
+	if e.ExtraText != "" {
+		s = fmt.Sprintf("%s: %q", s, e.ExtraText)
+	}
+	return s
+}
+
+// ExtendedErrors returns the Extended DNS Errors in m's OPT record, if any.
+// A server only includes them if the query had an OPT record (see
+// AddEDNS0Options).
+func ExtendedErrors(m *dns.Msg) []*ExtendedError {
+	if m == nil {
+		return nil
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var edes []*ExtendedError
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			edes = append(edes, &ExtendedError{
+				InfoCode:  ede.InfoCode,
+				ExtraText: ede.ExtraText,
+			})
+		}
+	}
+	return edes
+}
+
+// FormatExtendedErrors joins edes into a single line, e.g., for printing.
+func FormatExtendedErrors(edes []*ExtendedError) string {
+	strs := make([]string, len(edes))
+	for i, ede := range edes {
+		strs[i] = ede.String()
+	}
+	return strings.Join(strs, "; ")
+}
@@ -0,0 +1,119 @@
+package dnsclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// Sentinel errors for classifying failures with errors.Is.  The errors that
+// the clients return are not these values themselves, but match them: e.g., a
+// *DNSError for an NXDOMAIN response matches ErrNXDomain, and a
+// *TransportError for a query that timed out matches ErrTimeout.
+var (
+	ErrNXDomain   = errors.New("dnsclient: name does not exist (NXDOMAIN)")
+	ErrNoData     = errors.New("dnsclient: name has no records of the requested type (NODATA)")
+	ErrServFail   = errors.New("dnsclient: server failure (SERVFAIL)")
+	ErrRefused    = errors.New("dnsclient: query refused (REFUSED)")
+	ErrTimeout    = errors.New("dnsclient: timeout")
+	ErrTLS        = errors.New("dnsclient: TLS failure")
+	ErrHTTPStatus = errors.New("dnsclient: unsuccessful HTTP status")
+)
+
+// Is makes a DNSError match ErrNXDomain, ErrNoData, ErrServFail or ErrRefused,
+// according to the response.
+func (e *DNSError) Is(target error) bool {
+	if e.Response == nil {
+		return false
+	}
+	rcode := e.Response.Rcode
+	switch target {
+	case ErrNXDomain:
+		return e.Reason == DNSErrRcodeNotSuccess && rcode == dns.RcodeNameError
+	case ErrNoData:
+		return e.Reason == DNSErrMissingAnswer && rcode == dns.RcodeSuccess
+	case ErrServFail:
+		return e.Reason == DNSErrRcodeNotSuccess && rcode == dns.RcodeServerFailure
+	case ErrRefused:
+		return e.Reason == DNSErrRcodeNotSuccess && rcode == dns.RcodeRefused
+	}
+	return false
+}
+
+// TransportError is the error that the Do53, DoT and DoH clients return when
+// they fail to dial their server or to exchange a query with it.  It matches
+// ErrTimeout if the underlying error is a timeout (including an expired
+// context), and ErrTLS if it is a TLS handshake or certificate error.
+type TransportError struct {
+	Transport Transport
+	Server    string
+	Op        string // "dial" or "query"
+	Err       error
+}
+
+func newTransportError(transport Transport, server, op string, err error) *TransportError {
+	return &TransportError{Transport: transport, Server: server, Op: op, Err: err}
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s %s %s: %v", e.Transport, e.Op, e.Server, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return isTimeout(e.Err)
+	case ErrTLS:
+		return isTLSError(e.Err)
+	}
+	return false
+}
+
+// HTTPStatusError is the error for a DoH response with a status other than
+// 200 OK.  It matches ErrHTTPStatus.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTPS response returned an error: %d %s",
+		e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrHTTPStatus
+}
+
+// isTLSError reports whether err comes from the TLS layer: a failed handshake
+// (including an alert from the peer), an invalid certificate, or a non-TLS
+// peer.
+func isTLSError(err error) bool {
+	var (
+		verifyErr  *tls.CertificateVerificationError
+		headerErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		authErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		opErr      *net.OpError
+	)
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &headerErr),
+		errors.As(err, &alertErr), errors.As(err, &authErr),
+		errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return true
+	case errors.As(err, &opErr):
+		// crypto/tls reports the peer's alerts as a net.OpError
+		return opErr.Op == "remote error" || opErr.Op == "local error"
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package dnsclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultHostsPath is the system's hosts file.
+const DefaultHostsPath = "/etc/hosts"
+
+// DefaultHostsCheckInterval is how often, at most, a HostsClient checks
+// whether its hosts file has changed.
+const DefaultHostsCheckInterval = 5 * time.Second
+
+// hostsTable maps names to addresses and back.  The names are lowercase and
+// fully-qualified; the reverse names are those of dns.ReverseAddr.
+type hostsTable struct {
+	addrs map[string][]netip.Addr
+	names map[string][]string
+}
+
+func newHostsTable() *hostsTable {
+	return &hostsTable{
+		addrs: make(map[string][]netip.Addr),
+		names: make(map[string][]string),
+	}
+}
+
+func (t *hostsTable) add(addr netip.Addr, names ...string) {
+	// an address may have a zone (e.g., fe80::1%lo0), which has no meaning
+	// in DNS
+	addr = addr.WithZone("")
+	rev, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		name = strings.ToLower(dns.Fqdn(name))
+		if _, ok := dns.IsDomainName(name); !ok {
+			continue
+		}
+		t.addrs[name] = append(t.addrs[name], addr)
+		t.names[rev] = append(t.names[rev], name)
+	}
+}
+
+// parseHosts parses a file in the hosts(5) format: each line has an address
+// followed by the canonical hostname and any aliases, and a # starts a
+// comment.  Lines with an invalid address are skipped.
+func parseHosts(r io.Reader) (*hostsTable, error) {
+	t := newHostsTable()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		t.add(addr, fields[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type HostsConfig struct {
+	// Path is the hosts file.  If empty, DefaultHostsPath is used.  A
+	// missing file is treated as an empty one.
+	Path string
+	// CheckInterval is how often, at most, the file is checked for
+	// changes (by its modification time and size).  If 0,
+	// DefaultHostsCheckInterval is used.
+	CheckInterval time.Duration
+	// Static maps hostnames to addresses, as extra lines of the file
+	// would, except that a name in Static hides the name's entries in the
+	// file.
+	Static map[string][]netip.Addr
+	// TTL is the TTL of the records in the synthesized responses.
+	TTL uint32
+}
+
+// HostsClient wraps a Client and answers A, AAAA and PTR queries for the
+// names and addresses in a hosts file (and the static overrides) itself, as
+// the "files" source of the system's resolver does; any other query goes to
+// the wrapped Client.  A query for a listed name is answered from the file
+// even if the name has no addresses of the queried type, in which case the
+// response is NODATA.  As a Searcher, a HostsClient looks up a listed name
+// as is, rather than applying the wrapped Client's search list to it.
+//
+// A HostsClient is safe for concurrent use if the wrapped Client is.
+type HostsClient struct {
+	next   Client
+	config *HostsConfig
+	path   string
+
+	mu      sync.Mutex
+	static  *hostsTable
+	file    *hostsTable
+	checked time.Time
+	modTime time.Time
+	size    int64
+}
+
+func NewHostsClient(next Client, config *HostsConfig) *HostsClient {
+	c := &HostsClient{
+		next:   next,
+		config: config,
+		path:   config.Path,
+		file:   newHostsTable(),
+	}
+	if c.path == "" {
+		c.path = DefaultHostsPath
+	}
+	c.setStatic(config.Static)
+	return c
+}
+
+// Unwrap returns the Client that c wraps.
+func (c *HostsClient) Unwrap() Client {
+	return c.next
+}
+
+func (c *HostsClient) GetConfig() *Config {
+	return c.next.GetConfig()
+}
+
+func (c *HostsClient) Dial() error {
+	return c.next.Dial()
+}
+
+func (c *HostsClient) Close() error {
+	return c.next.Close()
+}
+
+func (c *HostsClient) setStatic(static map[string][]netip.Addr) {
+	t := newHostsTable()
+	for name, addrs := range static {
+		for _, addr := range addrs {
+			t.add(addr, name)
+		}
+		if len(addrs) == 0 {
+			// the name hides the file's entries, and has no addresses
+			t.addrs[strings.ToLower(dns.Fqdn(name))] = nil
+		}
+	}
+	c.static = t
+}
+
+// SetStatic replaces the static overrides (see HostsConfig.Static).
+func (c *HostsClient) SetStatic(static map[string][]netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setStatic(static)
+}
+
+// refresh reloads the file if it has changed since it was last loaded, and
+// returns the current tables.
+func (c *HostsClient) refresh() (static, file *hostsTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	interval := c.config.CheckInterval
+	if interval == 0 {
+		interval = DefaultHostsCheckInterval
+	}
+	now := time.Now()
+	if !c.checked.IsZero() && now.Sub(c.checked) < interval {
+		return c.static, c.file
+	}
+	c.checked = now
+
+	logger := c.GetConfig().logger().With("path", c.path)
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("can't check hosts file", "err", err)
+		}
+		c.file = newHostsTable()
+		c.modTime, c.size = time.Time{}, 0
+		return c.static, c.file
+	}
+	if fi.ModTime().Equal(c.modTime) && fi.Size() == c.size {
+		return c.static, c.file
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		logger.Warn("can't read hosts file", "err", err)
+		return c.static, c.file
+	}
+	defer f.Close()
+	t, err := parseHosts(f)
+	if err != nil {
+		logger.Warn("can't read hosts file", "err", err)
+		return c.static, c.file
+	}
+	logger.Debug("loaded hosts file", "names", len(t.addrs))
+	c.file = t
+	c.modTime, c.size = fi.ModTime(), fi.Size()
+	return c.static, c.file
+}
+
+// lookupAddrs returns the addresses of name, and whether name is listed.
+func (c *HostsClient) lookupAddrs(name string) ([]netip.Addr, bool) {
+	static, file := c.refresh()
+	name = strings.ToLower(dns.Fqdn(name))
+	if addrs, ok := static.addrs[name]; ok {
+		return addrs, true
+	}
+	addrs, ok := file.addrs[name]
+	return addrs, ok
+}
+
+// lookupNames returns the hostnames for the reverse name rev.
+func (c *HostsClient) lookupNames(rev string) []string {
+	static, file := c.refresh()
+	rev = strings.ToLower(dns.Fqdn(rev))
+	if names, ok := static.names[rev]; ok {
+		return names
+	}
+	var names []string
+	for _, name := range file.names[rev] {
+		// a static override of the name hides the file's entry
+		if _, ok := static.addrs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// SearchNames returns just name (fully-qualified) if it is listed;
+// otherwise, it defers to the wrapped Client's search list, if any.
+func (c *HostsClient) SearchNames(name string) []string {
+	if _, ok := c.lookupAddrs(name); ok {
+		return []string{dns.Fqdn(name)}
+	}
+	if s, ok := searcherOf(c.next); ok {
+		return s.SearchNames(name)
+	}
+	return []string{name}
+}
+
+// answer returns the response to req from the hosts file, or nil if the
+// query isn't for a listed name or address.
+func (c *HostsClient) answer(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		return nil
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: c.config.TTL}
+	var answer []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs, ok := c.lookupAddrs(q.Name)
+		if !ok {
+			return nil
+		}
+		for _, addr := range addrs {
+			switch {
+			case q.Qtype == dns.TypeA && addr.Is4():
+				answer = append(answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			case q.Qtype == dns.TypeAAAA && addr.Is6():
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	case dns.TypePTR:
+		names := c.lookupNames(q.Name)
+		if len(names) == 0 {
+			return nil
+		}
+		for _, name := range names {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: name})
+		}
+	default:
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = req.RecursionDesired
+	resp.Answer = answer
+	return resp
+}
+
+func (c *HostsClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *HostsClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if resp := c.answer(req); resp != nil {
+		c.GetConfig().logger().Debug("answered from hosts file", append(questionAttrs(req),
+			"answers", len(resp.Answer))...)
+		return resp, nil
+	}
+	return queryContext(ctx, c.next, req)
+}
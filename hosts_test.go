@@ -0,0 +1,193 @@
+package dnsclient
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testHosts = `
+# a comment
+192.0.2.1	host.example host	# another comment
+2001:db8::1	host.example
+192.0.2.2	shadowed.example
+fe80::1%lo0	link.example
+not-an-address	bogus.example
+192.0.2.3
+`
+
+func newTestHostsClient(t *testing.T, contents string, config *HostsConfig) *HostsClient {
+	t.Helper()
+	config.Path = filepath.Join(t.TempDir(), "hosts")
+	if contents != "" {
+		writeHosts(t, config.Path, contents)
+	}
+	return NewHostsClient(NewDo53Client(&Do53Config{}), config)
+}
+
+func writeHosts(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustAddrs(s ...string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range s {
+		addrs = append(addrs, netip.MustParseAddr(a))
+	}
+	return addrs
+}
+
+func TestHostsLookup(t *testing.T) {
+	c := newTestHostsClient(t, testHosts, &HostsConfig{
+		Static: map[string][]netip.Addr{
+			"shadowed.example": mustAddrs("192.0.2.9"),
+			"empty.example":    nil,
+			"Static.Example":   mustAddrs("192.0.2.10"),
+		},
+	})
+
+	addrTests := []struct {
+		name   string
+		addrs  []netip.Addr
+		listed bool
+	}{
+		{"host.example", mustAddrs("192.0.2.1", "2001:db8::1"), true},
+		{"HOST.example.", mustAddrs("192.0.2.1", "2001:db8::1"), true},
+		{"host", mustAddrs("192.0.2.1"), true},
+		{"link.example", mustAddrs("fe80::1"), true},
+		{"shadowed.example", mustAddrs("192.0.2.9"), true},
+		{"empty.example", nil, true},
+		{"static.example", mustAddrs("192.0.2.10"), true},
+		{"bogus.example", nil, false},
+		{"missing.example", nil, false},
+	}
+	for _, tt := range addrTests {
+		addrs, listed := c.lookupAddrs(tt.name)
+		if !reflect.DeepEqual(addrs, tt.addrs) || listed != tt.listed {
+			t.Errorf("lookupAddrs(%q): got %v, %v; want %v, %v", tt.name, addrs, listed, tt.addrs, tt.listed)
+		}
+	}
+
+	nameTests := []struct {
+		addr  string
+		names []string
+	}{
+		{"192.0.2.1", []string{"host.example.", "host."}},
+		{"2001:db8::1", []string{"host.example."}},
+		{"fe80::1", []string{"link.example."}},
+		// the static override hides the file's entry
+		{"192.0.2.2", nil},
+		{"192.0.2.9", []string{"shadowed.example."}},
+		{"192.0.2.10", []string{"static.example."}},
+		{"192.0.2.99", nil},
+	}
+	for _, tt := range nameTests {
+		rev, err := dns.ReverseAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := c.lookupNames(rev); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("lookupNames(%q): got %v, want %v", rev, names, tt.names)
+		}
+	}
+}
+
+func TestHostsAnswer(t *testing.T) {
+	c := newTestHostsClient(t, testHosts, &HostsConfig{
+		Static: map[string][]netip.Addr{"empty.example": nil},
+		TTL:    60,
+	})
+	rev192, _ := dns.ReverseAddr("192.0.2.1")
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		answer []string // nil if the query isn't answered from the file
+	}{
+		{"host.example.", dns.TypeA, []string{"host.example.\t60\tIN\tA\t192.0.2.1"}},
+		{"host.example.", dns.TypeAAAA, []string{"host.example.\t60\tIN\tAAAA\t2001:db8::1"}},
+		// NODATA
+		{"host.", dns.TypeAAAA, []string{}},
+		{"empty.example.", dns.TypeA, []string{}},
+		{rev192, dns.TypePTR, []string{
+			rev192 + "\t60\tIN\tPTR\thost.example.",
+			rev192 + "\t60\tIN\tPTR\thost.",
+		}},
+		{"host.example.", dns.TypeMX, nil},
+		{"missing.example.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		resp := c.answer(req)
+		name := tt.qname + " " + dns.TypeToString[tt.qtype]
+		switch {
+		case resp == nil && tt.answer != nil:
+			t.Errorf("%s: not answered from the hosts file", name)
+			continue
+		case resp != nil && tt.answer == nil:
+			t.Errorf("%s: unexpectedly answered from the hosts file", name)
+			continue
+		case resp == nil:
+			continue
+		}
+
+		if resp.Rcode != dns.RcodeSuccess || resp.Id != req.Id {
+			t.Errorf("%s: got a bad response\n%v", name, resp)
+		}
+		answer := []string{}
+		for _, rr := range resp.Answer {
+			answer = append(answer, rr.String())
+		}
+		if !reflect.DeepEqual(answer, tt.answer) {
+			t.Errorf("%s: got answer %q, want %q", name, answer, tt.answer)
+		}
+	}
+}
+
+func TestHostsRefresh(t *testing.T) {
+	// a missing file is an empty one
+	c := newTestHostsClient(t, "", &HostsConfig{CheckInterval: time.Nanosecond})
+	if _, listed := c.lookupAddrs("host.example"); listed {
+		t.Fatal("a name is listed without a hosts file")
+	}
+
+	check := func(step string, want []netip.Addr) {
+		t.Helper()
+		if addrs, _ := c.lookupAddrs("host.example"); !reflect.DeepEqual(addrs, want) {
+			t.Errorf("%s: got %v, want %v", step, addrs, want)
+		}
+	}
+
+	writeHosts(t, c.path, "192.0.2.1 host.example\n")
+	check("created", mustAddrs("192.0.2.1"))
+
+	writeHosts(t, c.path, "192.0.2.10 host.example\n")
+	check("size changed", mustAddrs("192.0.2.10"))
+
+	// the same size, so only the modification time tells
+	writeHosts(t, c.path, "192.0.2.20 host.example\n")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(c.path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("modification time changed", mustAddrs("192.0.2.20"))
+
+	if err := os.Remove(c.path); err != nil {
+		t.Fatal(err)
+	}
+	check("removed", nil)
+
+	// the file isn't checked again until the interval has passed
+	c.config.CheckInterval = time.Hour
+	writeHosts(t, c.path, "192.0.2.1 host.example\n")
+	check("within the check interval", nil)
+}
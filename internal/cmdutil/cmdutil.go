@@ -0,0 +1,65 @@
+// Package cmdutil holds what the command-line tools have in common.
+package cmdutil
+
+import (
+	"flag"
+
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/defaults"
+)
+
+// IsFlagSet reports whether the named flag was given on the command line.
+func IsFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// NewResolvConfClient returns a client for the nameservers in resolv.conf or,
+// if it can't be read, for the default server, behind the hosts file.  The
+// file's timeout and attempts options apply unless the -timeout or -attempts
+// flag was given.  Unless useTCP is set, truncated responses are retried over
+// TCP.
+//
+// The middlewares wrap the client for each nameserver, so that, e.g., a pcap
+// capture has the server that answered each query, and the queries that the
+// hosts file answers aren't captured at all.
+func NewResolvConfClient(baseConfig dnsclient.Config, useTCP bool, mws ...dnsclient.Middleware) dnsclient.Client {
+	config := &dnsclient.ResolvConfConfig{
+		Config: baseConfig,
+		UseTCP: useTCP,
+		NewClient: func(config *dnsclient.Do53Config) dnsclient.Client {
+			return dnsclient.Chain(dnsclient.NewDo53Client(config), mws...)
+		},
+	}
+	if !IsFlagSet("timeout") {
+		config.Timeout = 0
+	}
+	if !IsFlagSet("attempts") {
+		config.Retry.MaxAttempts = 0
+	}
+
+	var c dnsclient.Client
+	rc, err := dnsclient.NewResolvConfClient(config)
+	if err == nil {
+		c = rc
+	} else {
+		if baseConfig.Logger != nil {
+			baseConfig.Logger.Warn("can't use resolv.conf; using the default server",
+				"server", defaults.Do53Server, "err", err)
+		}
+		c = dnsclient.Chain(dnsclient.NewDo53Client(&dnsclient.Do53Config{
+			Config:       baseConfig,
+			UseTCP:       useTCP,
+			RetryWithTCP: !useTCP,
+			Server:       defaults.Do53Server,
+		}), mws...)
+	}
+
+	// as the system's resolver does, answer from /etc/hosts first
+	return dnsclient.NewHostsClient(c, &dnsclient.HostsConfig{})
+}
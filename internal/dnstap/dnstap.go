@@ -0,0 +1,140 @@
+// Package dnstap encodes dnstap messages (https://dnstap.info) and writes
+// them as Frame Streams.
+//
+// Only the subset of the dnstap schema that a DNS client produces is
+// supported: Message payloads of type CLIENT_QUERY and CLIENT_RESPONSE.  The
+// protobuf encoding is done by hand to avoid depending on a protobuf runtime.
+package dnstap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// ContentType is the Frame Streams content type of dnstap payloads.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+type MessageType int
+
+const (
+	MessageClientQuery    MessageType = 5
+	MessageClientResponse MessageType = 6
+)
+
+type SocketProtocol int
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDoT SocketProtocol = 3
+	ProtocolDoH SocketProtocol = 4
+)
+
+const (
+	familyINET  = 1
+	familyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Message is a dnstap Message.  Zero-valued fields are omitted.
+type Message struct {
+	Type            MessageType
+	Protocol        SocketProtocol
+	QueryAddress    netip.AddrPort
+	ResponseAddress netip.AddrPort
+	QueryTime       time.Time
+	QueryMessage    []byte
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendTag(b, field, wireFixed32)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func (m *Message) marshal() []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(m.Type))
+
+	addr := m.ResponseAddress.Addr()
+	if !addr.IsValid() {
+		addr = m.QueryAddress.Addr()
+	}
+	if addr.IsValid() {
+		family := familyINET6
+		if addr.Unmap().Is4() {
+			family = familyINET
+		}
+		b = appendVarintField(b, 2, uint64(family))
+	}
+	if m.Protocol != 0 {
+		b = appendVarintField(b, 3, uint64(m.Protocol))
+	}
+	if m.QueryAddress.IsValid() {
+		b = appendBytesField(b, 4, m.QueryAddress.Addr().Unmap().AsSlice())
+	}
+	if m.ResponseAddress.IsValid() {
+		b = appendBytesField(b, 5, m.ResponseAddress.Addr().Unmap().AsSlice())
+	}
+	if m.QueryAddress.IsValid() {
+		b = appendVarintField(b, 6, uint64(m.QueryAddress.Port()))
+	}
+	if m.ResponseAddress.IsValid() {
+		b = appendVarintField(b, 7, uint64(m.ResponseAddress.Port()))
+	}
+	if !m.QueryTime.IsZero() {
+		b = appendVarintField(b, 8, uint64(m.QueryTime.Unix()))
+		b = appendFixed32Field(b, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.QueryMessage != nil {
+		b = appendBytesField(b, 10, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		b = appendVarintField(b, 12, uint64(m.ResponseTime.Unix()))
+		b = appendFixed32Field(b, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.ResponseMessage != nil {
+		b = appendBytesField(b, 14, m.ResponseMessage)
+	}
+	return b
+}
+
+// Marshal returns the protobuf encoding of a Dnstap envelope of type MESSAGE
+// that carries m.  identity and version may be nil.
+func Marshal(m *Message, identity, version []byte) []byte {
+	var b []byte
+	if identity != nil {
+		b = appendBytesField(b, 1, identity)
+	}
+	if version != nil {
+		b = appendBytesField(b, 2, version)
+	}
+	b = appendBytesField(b, 14, m.marshal())
+	b = appendVarintField(b, 15, dnstapTypeMessage)
+	return b
+}
@@ -0,0 +1,130 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame Streams control frame types
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+
+	// upper bound on the size of a control frame that we'll read
+	maxControlFrameLen = 512
+)
+
+var be = binary.BigEndian
+
+// FrameWriter writes data frames to a Frame Streams stream.  It is not safe
+// for concurrent use.
+type FrameWriter struct {
+	w io.Writer
+	r io.Reader // nil for a unidirectional stream
+}
+
+func encodeControlFrame(controlType uint32, contentType string) []byte {
+	var body []byte
+	body = be.AppendUint32(body, controlType)
+	if contentType != "" {
+		body = be.AppendUint32(body, controlFieldContentType)
+		body = be.AppendUint32(body, uint32(len(contentType)))
+		body = append(body, contentType...)
+	}
+
+	var b []byte
+	b = be.AppendUint32(b, 0) // escape: a zero-length data frame
+	b = be.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+func (fw *FrameWriter) writeControl(controlType uint32, contentType string) error {
+	_, err := fw.w.Write(encodeControlFrame(controlType, contentType))
+	return err
+}
+
+func readControl(r io.Reader, want uint32) error {
+	var hdr [8]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return err
+	}
+	if be.Uint32(hdr[0:]) != 0 {
+		return fmt.Errorf("expected a control frame")
+	}
+
+	n := be.Uint32(hdr[4:])
+	if n < 4 || n > maxControlFrameLen {
+		return fmt.Errorf("invalid control frame length %d", n)
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return err
+	}
+
+	got := be.Uint32(body)
+	if got != want {
+		return fmt.Errorf("expected control frame type %d, but got %d", want, got)
+	}
+	return nil
+}
+
+// NewFrameWriter starts a unidirectional stream (as used for files) of the
+// given content type on w.
+func NewFrameWriter(w io.Writer, contentType string) (*FrameWriter, error) {
+	fw := &FrameWriter{w: w}
+	err := fw.writeControl(controlStart, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// NewBidirectionalFrameWriter performs the READY/ACCEPT handshake that
+// socket receivers expect, and then starts a stream of the given content
+// type on rw.
+func NewBidirectionalFrameWriter(rw io.ReadWriter, contentType string) (*FrameWriter, error) {
+	fw := &FrameWriter{w: rw, r: rw}
+
+	err := fw.writeControl(controlReady, contentType)
+	if err != nil {
+		return nil, err
+	}
+	err = readControl(rw, controlAccept)
+	if err != nil {
+		return nil, fmt.Errorf("frame streams handshake failed: %w", err)
+	}
+	err = fw.writeControl(controlStart, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// WriteFrame writes one data frame.
+func (fw *FrameWriter) WriteFrame(data []byte) error {
+	b := be.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	b = append(b, data...)
+	_, err := fw.w.Write(b)
+	return err
+}
+
+// Stop ends the stream.  On a bidirectional stream, Stop waits for the
+// receiver to acknowledge the end of the stream.
+func (fw *FrameWriter) Stop() error {
+	err := fw.writeControl(controlStop, "")
+	if err != nil {
+		return err
+	}
+	if fw.r != nil {
+		return readControl(fw.r, controlFinish)
+	}
+	return nil
+}
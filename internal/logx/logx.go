@@ -0,0 +1,24 @@
+package logx
+
+import (
+	"context"
+	"log/slog"
+)
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Discard is a logger that discards everything.
+var Discard = slog.New(discardHandler{})
+
+// OrDiscard returns logger, or Discard if logger is nil.
+func OrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return Discard
+	}
+	return logger
+}
@@ -1,6 +1,8 @@
 package msgutil
 
 import (
+	"bytes"
+
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/functools"
 )
@@ -110,3 +112,72 @@ func OrderCNAMEs(a []*dns.CNAME) bool {
 
 	return n == len(a)
 }
+
+// unescapeLabel converts a label in presentation format (as returned by
+// [github.com/miekg/dns.SplitDomainName]) to its wire-format octets.
+func unescapeLabel(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func toLowerASCII(b []byte) []byte {
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return b
+}
+
+// CompareNames compares two domain names in the canonical order of RFC
+// 4034, section 6.1: label by label, starting from the rightmost label,
+// with each label compared as a case-insensitive octet string.  It returns
+// -1 if a sorts before b, 1 if a sorts after b, and 0 if they are equal.
+func CompareNames(a, b string) int {
+	la := dns.SplitDomainName(a)
+	lb := dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		x := toLowerASCII(unescapeLabel(la[i]))
+		y := toLowerASCII(unescapeLabel(lb[j]))
+		if c := bytes.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// NSECCovers reports whether name falls strictly between the owner name and
+// the next domain name of nsec, in canonical order; that is, whether nsec
+// proves that name doesn't exist.  The last NSEC record of a zone, whose
+// next domain name is the zone apex, covers every name that sorts after its
+// owner.
+func NSECCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if CompareNames(owner, next) < 0 {
+		return CompareNames(owner, name) < 0 && CompareNames(name, next) < 0
+	}
+	return CompareNames(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
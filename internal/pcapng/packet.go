@@ -0,0 +1,113 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	// TCP flags
+	FlagPSH = 0x08
+	FlagACK = 0x10
+)
+
+var be = binary.BigEndian
+
+// checksum computes the Internet checksum (RFC 1071) of the concatenation
+// of bufs, each of which must have even length except possibly the last.
+func checksum(bufs ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range bufs {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(be.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeader(src, dst netip.Addr, proto uint8, length int) []byte {
+	var b []byte
+	b = append(b, src.AsSlice()...)
+	b = append(b, dst.AsSlice()...)
+	if src.Is4() {
+		b = append(b, 0, proto)
+		b = be.AppendUint16(b, uint16(length))
+	} else {
+		b = be.AppendUint32(b, uint32(length))
+		b = append(b, 0, 0, 0, proto)
+	}
+	return b
+}
+
+// ipPacket prepends an IPv4 or IPv6 header (depending on the family of src
+// and dst, which must match) to the transport-layer segment.
+func ipPacket(src, dst netip.Addr, proto uint8, segment []byte) []byte {
+	var b []byte
+	if src.Is4() {
+		b = append(b, 0x45, 0) // version 4, IHL 5; TOS
+		b = be.AppendUint16(b, uint16(20+len(segment)))
+		b = be.AppendUint16(b, 0)      // identification
+		b = be.AppendUint16(b, 0x4000) // DF
+		b = append(b, 64, proto)       // TTL, protocol
+		b = be.AppendUint16(b, 0)      // checksum; filled in below
+		b = append(b, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+		be.PutUint16(b[10:], checksum(b))
+	} else {
+		b = be.AppendUint32(b, 6<<28)
+		b = be.AppendUint16(b, uint16(len(segment)))
+		b = append(b, proto, 64) // next header, hop limit
+		b = append(b, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+	}
+	return append(b, segment...)
+}
+
+// UDPPacket returns an IP packet that carries payload in a UDP datagram from
+// src to dst.
+func UDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	length := 8 + len(payload)
+	var seg []byte
+	seg = be.AppendUint16(seg, src.Port())
+	seg = be.AppendUint16(seg, dst.Port())
+	seg = be.AppendUint16(seg, uint16(length))
+	seg = be.AppendUint16(seg, 0) // checksum; filled in below
+	seg = append(seg, payload...)
+
+	sum := checksum(pseudoHeader(src.Addr(), dst.Addr(), protoUDP, length), seg)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	be.PutUint16(seg[6:], sum)
+
+	return ipPacket(src.Addr(), dst.Addr(), protoUDP, seg)
+}
+
+// TCPPacket returns an IP packet that carries payload in a TCP segment from
+// src to dst, with the given sequence and acknowledgment numbers and flags.
+func TCPPacket(src, dst netip.AddrPort, seq, ack uint32, flags uint8, payload []byte) []byte {
+	var seg []byte
+	seg = be.AppendUint16(seg, src.Port())
+	seg = be.AppendUint16(seg, dst.Port())
+	seg = be.AppendUint32(seg, seq)
+	seg = be.AppendUint32(seg, ack)
+	seg = append(seg, 5<<4, flags)    // data offset, flags
+	seg = be.AppendUint16(seg, 65535) // window
+	seg = be.AppendUint16(seg, 0)     // checksum; filled in below
+	seg = be.AppendUint16(seg, 0)     // urgent pointer
+	seg = append(seg, payload...)
+
+	sum := checksum(pseudoHeader(src.Addr(), dst.Addr(), protoTCP, len(seg)), seg)
+	be.PutUint16(seg[16:], sum)
+
+	return ipPacket(src.Addr(), dst.Addr(), protoTCP, seg)
+}
@@ -0,0 +1,50 @@
+package pcapng
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	pcapMagic   = 0xA1B2C3D4 // microsecond timestamps
+	pcapSnapLen = 262144
+)
+
+// PcapWriter writes a classic (libpcap) capture file, for tools that don't
+// read pcapng.  The classic format has no packet comments, so WritePacket
+// ignores them.  A PcapWriter is not safe for concurrent use.
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes the file header to w, and returns a PcapWriter for
+// appending packets of the given link type.  Timestamps have microsecond
+// resolution.
+func NewPcapWriter(w io.Writer, linkType uint16) (*PcapWriter, error) {
+	var hdr []byte
+	hdr = le.AppendUint32(hdr, pcapMagic)
+	hdr = le.AppendUint16(hdr, 2) // major version
+	hdr = le.AppendUint16(hdr, 4) // minor version
+	hdr = le.AppendUint32(hdr, 0) // thiszone: UTC
+	hdr = le.AppendUint32(hdr, 0) // sigfigs
+	hdr = le.AppendUint32(hdr, pcapSnapLen)
+	hdr = le.AppendUint32(hdr, uint32(linkType))
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket appends one packet, captured at time ts.
+func (w *PcapWriter) WritePacket(ts time.Time, data []byte, comment string) error {
+	usecs := ts.UnixMicro()
+
+	b := make([]byte, 0, 16+len(data))
+	b = le.AppendUint32(b, uint32(usecs/1e6))
+	b = le.AppendUint32(b, uint32(usecs%1e6))
+	b = le.AppendUint32(b, uint32(len(data))) // captured length
+	b = le.AppendUint32(b, uint32(len(data))) // original length
+	b = append(b, data...)
+	_, err := w.w.Write(b)
+	return err
+}
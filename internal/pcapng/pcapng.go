@@ -0,0 +1,103 @@
+// Package pcapng writes packet captures in the pcapng format (or, for older
+// tools, the classic pcap format), along with the helpers to synthesize the
+// IP/UDP/TCP packets that go in them.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	blockTypeSHB = 0x0A0D0D0A
+	blockTypeIDB = 0x00000001
+	blockTypeEPB = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEndOfOpt = 0
+	optComment  = 1
+
+	// LinkTypeRaw means that each packet begins with an IPv4 or IPv6
+	// header.
+	LinkTypeRaw = 101
+)
+
+var le = binary.LittleEndian
+
+// Writer writes a pcapng file with a single section and a single interface.
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	w io.Writer
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// appendOption appends a pcapng option (code, length, padded value).
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = le.AppendUint16(b, code)
+	b = le.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(12 + len(body))
+	b := make([]byte, 0, totalLen)
+	b = le.AppendUint32(b, blockType)
+	b = le.AppendUint32(b, totalLen)
+	b = append(b, body...)
+	b = le.AppendUint32(b, totalLen)
+	_, err := w.w.Write(b)
+	return err
+}
+
+// NewWriter writes the section header and interface description blocks to w,
+// and returns a Writer for appending packets of the given link type.
+// Timestamps have microsecond resolution.
+func NewWriter(w io.Writer, linkType uint16) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	var shb []byte
+	shb = le.AppendUint32(shb, byteOrderMagic)
+	shb = le.AppendUint16(shb, 1) // major version
+	shb = le.AppendUint16(shb, 0) // minor version
+	shb = le.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	if err := pw.writeBlock(blockTypeSHB, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = le.AppendUint16(idb, linkType)
+	idb = le.AppendUint16(idb, 0) // reserved
+	idb = le.AppendUint32(idb, 0) // snaplen: no limit
+	if err := pw.writeBlock(blockTypeIDB, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// WritePacket appends one packet, captured at time ts, with an optional
+// comment (which Wireshark displays alongside the packet).
+func (w *Writer) WritePacket(ts time.Time, data []byte, comment string) error {
+	usecs := uint64(ts.UnixMicro())
+
+	var epb []byte
+	epb = le.AppendUint32(epb, 0) // interface ID
+	epb = le.AppendUint32(epb, uint32(usecs>>32))
+	epb = le.AppendUint32(epb, uint32(usecs))
+	epb = le.AppendUint32(epb, uint32(len(data))) // captured length
+	epb = le.AppendUint32(epb, uint32(len(data))) // original length
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad4(len(data)))...)
+	if comment != "" {
+		epb = appendOption(epb, optComment, []byte(comment))
+		epb = appendOption(epb, optEndOfOpt, nil)
+	}
+
+	return w.writeBlock(blockTypeEPB, epb)
+}
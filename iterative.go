@@ -0,0 +1,627 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+const (
+	DefaultIterativeMaxQueries = 100
+	DefaultIterativeMaxDepth   = 8
+
+	// defaults from RFC 9156, section 2.3
+	DefaultMaxMinimiseCount = 10
+	DefaultMinimiseOneLab   = 4
+)
+
+var (
+	// ErrQueryBudgetExceeded means that a resolution needed more queries
+	// than IterativeConfig.MaxQueries allows.
+	ErrQueryBudgetExceeded = errors.New("query budget exceeded")
+	// ErrResolutionLoop means that a resolution went around in circles:
+	// e.g., to find a nameserver's address, the resolver needed to ask that
+	// same nameserver.
+	ErrResolutionLoop = errors.New("resolution loop detected")
+)
+
+func mustParseAddrs(ss ...string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, s := range ss {
+		addrs = append(addrs, netip.MustParseAddr(s))
+	}
+	return addrs
+}
+
+// DefaultRootHints are the root servers, as listed in the IANA root hints
+// file (https://www.internic.net/domain/named.root).
+var DefaultRootHints = []*NameServer{
+	{Name: "a.root-servers.net.", Addrs: mustParseAddrs("198.41.0.4", "2001:503:ba3e::2:30")},
+	{Name: "b.root-servers.net.", Addrs: mustParseAddrs("170.247.170.2", "2801:1b8:10::b")},
+	{Name: "c.root-servers.net.", Addrs: mustParseAddrs("192.33.4.12", "2001:500:2::c")},
+	{Name: "d.root-servers.net.", Addrs: mustParseAddrs("199.7.91.13", "2001:500:2d::d")},
+	{Name: "e.root-servers.net.", Addrs: mustParseAddrs("192.203.230.10", "2001:500:a8::e")},
+	{Name: "f.root-servers.net.", Addrs: mustParseAddrs("192.5.5.241", "2001:500:2f::f")},
+	{Name: "g.root-servers.net.", Addrs: mustParseAddrs("192.112.36.4", "2001:500:12::d0d")},
+	{Name: "h.root-servers.net.", Addrs: mustParseAddrs("198.97.190.53", "2001:500:1::53")},
+	{Name: "i.root-servers.net.", Addrs: mustParseAddrs("192.36.148.17", "2001:7fe::53")},
+	{Name: "j.root-servers.net.", Addrs: mustParseAddrs("192.58.128.30", "2001:503:c27::2:30")},
+	{Name: "k.root-servers.net.", Addrs: mustParseAddrs("193.0.14.129", "2001:7fd::1")},
+	{Name: "l.root-servers.net.", Addrs: mustParseAddrs("199.7.83.42", "2001:500:9f::42")},
+	{Name: "m.root-servers.net.", Addrs: mustParseAddrs("202.12.27.33", "2001:dc3::35")},
+}
+
+// IterativeConfig configures an IterativeResolver.  Of the embedded Config,
+// Timeout, DNSSEC, Metrics, and Logger apply to each hop;
+// RecursionDesired is ignored (it is never set on the resolver's queries).
+type IterativeConfig struct {
+	Config
+	// RootHints are the servers that each resolution starts from.  If nil,
+	// DefaultRootHints is used.
+	RootHints []*NameServer
+	// Port is the port that every nameserver is queried on.  If 0, port 53
+	// is used; tests can use another port to run a fake hierarchy.
+	Port uint16
+	// UseTCP queries the nameservers over TCP.  Otherwise, queries go over
+	// UDP, and are retried over TCP if the response is truncated.
+	UseTCP bool
+	// UseIPv6 also queries nameservers at their IPv6 addresses.
+	UseIPv6 bool
+	// MaxQueries is the query budget for a single resolution, including
+	// the queries to resolve nameserver addresses.  If 0,
+	// DefaultIterativeMaxQueries is used.
+	MaxQueries int
+	// MaxDepth limits how deeply resolutions of nameserver addresses may
+	// nest.  If 0, DefaultIterativeMaxDepth is used.
+	MaxDepth int
+	// NewClient creates the client for a single hop.  If nil,
+	// NewDo53Client is used.
+	NewClient func(config *Do53Config) Client
+
+	// QNAMEMinimisation turns on QNAME minimisation (RFC 9156) for
+	// queries that don't set it through Resolve.
+	QNAMEMinimisation bool
+	// MaxMinimiseCount limits the number of minimised queries per name,
+	// and MinimiseOneLab is the number of those queries that add a single
+	// label each; the remaining queries add labels in larger steps.  If 0,
+	// DefaultMaxMinimiseCount and DefaultMinimiseOneLab are used.
+	MaxMinimiseCount int
+	MinimiseOneLab   int
+
+	// OnHop, if set, is called after each query that the resolver sends
+	// (e.g., to trace a resolution).  It may be called concurrently for
+	// concurrent resolutions.
+	OnHop func(hop *Hop)
+}
+
+// Hop is a single query of an iterative resolution.
+type Hop struct {
+	Zone     string // the zone that the server was queried as a server for
+	Server   string // the nameserver's name
+	Addr     netip.Addr
+	Question dns.Question
+	// Depth is 0 for the hops that resolve the query itself, and greater
+	// for the hops that resolve (glueless) nameserver addresses.
+	Depth    int
+	RTT      time.Duration
+	Response *dns.Msg // nil if Err is set
+	Err      error
+	// Referral is the child zone that the response referred the resolver
+	// to, if any, and NameServers are the child zone's nameservers, along
+	// with the addresses from the glue that the resolver accepted.
+	Referral    string
+	NameServers []*NameServer
+	// Lame is set if the response was a referral that doesn't lead closer
+	// to the qname.
+	Lame bool
+}
+
+// ResolveOptions are per-query options for an IterativeResolver.
+type ResolveOptions struct {
+	QNAMEMinimisation bool
+}
+
+// IterativeResolver resolves queries by itself, starting at the root and
+// following referrals down to an authoritative server, rather than asking a
+// recursive resolver.  The response it returns is the authoritative
+// server's.  There is no cache: each query is resolved from scratch.
+//
+// An IterativeResolver is safe for concurrent use.
+type IterativeResolver struct {
+	config *IterativeConfig
+}
+
+func NewIterativeResolver(config *IterativeConfig) *IterativeResolver {
+	return &IterativeResolver{config: config}
+}
+
+func (r *IterativeResolver) GetConfig() *Config {
+	return &r.config.Config
+}
+
+// Dial is a no-op: the resolver dials each server as it needs to.
+func (r *IterativeResolver) Dial() error {
+	return nil
+}
+
+func (r *IterativeResolver) Close() error {
+	return nil
+}
+
+func (r *IterativeResolver) Query(req *dns.Msg) (*dns.Msg, error) {
+	return r.QueryContext(context.Background(), req)
+}
+
+func (r *IterativeResolver) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	opts := &ResolveOptions{QNAMEMinimisation: r.config.QNAMEMinimisation}
+	return r.Resolve(ctx, req, opts)
+}
+
+// Resolve is like QueryContext, but with options that override the
+// resolver's config for this query.
+func (r *IterativeResolver) Resolve(ctx context.Context, req *dns.Msg, opts *ResolveOptions) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("query must have exactly one question")
+	}
+
+	do := r.config.DNSSEC
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		do = true
+	}
+
+	res := &resolution{
+		r:         r,
+		ctx:       ctx,
+		do:        do,
+		minimise:  opts.QNAMEMinimisation,
+		resolving: make(map[string]bool),
+	}
+	resp, err := res.resolve(req.Question[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// resolution is the state of a single query's resolution, including any
+// nested resolutions of nameserver addresses.
+type resolution struct {
+	r        *IterativeResolver
+	ctx      context.Context
+	do       bool
+	minimise bool
+	queries  int
+	// resolving holds the nameserver names whose addresses are being
+	// resolved
+	resolving map[string]bool
+}
+
+func (res *resolution) maxQueries() int {
+	if res.r.config.MaxQueries > 0 {
+		return res.r.config.MaxQueries
+	}
+	return DefaultIterativeMaxQueries
+}
+
+func (res *resolution) maxDepth() int {
+	if res.r.config.MaxDepth > 0 {
+		return res.r.config.MaxDepth
+	}
+	return DefaultIterativeMaxDepth
+}
+
+func (res *resolution) rootHints() []*NameServer {
+	if res.r.config.RootHints != nil {
+		return res.r.config.RootHints
+	}
+	return DefaultRootHints
+}
+
+func equalNames(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// minimiser picks the names of the minimised queries for a qname, as per
+// RFC 9156, section 2.3.
+type minimiser struct {
+	labels  []string
+	n       int // number of labels in the last minimised name
+	count   int // minimised queries left
+	oneLabs int // single-label steps left
+}
+
+func (res *resolution) newMinimiser(qname string) *minimiser {
+	m := &minimiser{
+		labels:  dns.SplitDomainName(qname),
+		count:   res.r.config.MaxMinimiseCount,
+		oneLabs: res.r.config.MinimiseOneLab,
+	}
+	if m.count <= 0 {
+		m.count = DefaultMaxMinimiseCount
+	}
+	if m.oneLabs <= 0 {
+		m.oneLabs = DefaultMinimiseOneLab
+	}
+	return m
+}
+
+// next returns the name to query the servers of zone for.  ok is false
+// once the name would be the full qname.
+func (m *minimiser) next(zone string) (string, bool) {
+	n := max(m.n, dns.CountLabel(zone))
+	left := len(m.labels) - n
+	if left <= 0 || m.count <= 0 {
+		return "", false
+	}
+
+	step := 1
+	if m.oneLabs > 0 {
+		m.oneLabs--
+	} else {
+		// spread the remaining labels over the remaining queries
+		step = (left + m.count - 1) / m.count
+	}
+	m.count--
+
+	m.n = n + step
+	if m.n >= len(m.labels) {
+		return "", false
+	}
+	return dns.Fqdn(strings.Join(m.labels[len(m.labels)-m.n:], ".")), true
+}
+
+// resolve resolves q, starting from the root hints.
+func (res *resolution) resolve(q dns.Question, depth int) (*dns.Msg, error) {
+	logger := res.r.config.logger()
+	zone := "."
+	servers := res.rootHints()
+
+	var min *minimiser
+	if res.minimise {
+		min = res.newMinimiser(q.Name)
+	}
+
+	for {
+		hop := q
+		minimised := false
+		if min != nil {
+			if name, ok := min.next(zone); ok {
+				// RFC 9156 recommends QTYPE A for the minimised queries
+				hop = dns.Question{Name: name, Qtype: dns.TypeA, Qclass: q.Qclass}
+				minimised = true
+			} else {
+				min = nil
+			}
+		}
+
+		resp, next, err := res.queryZone(zone, servers, hop, depth)
+		if minimised {
+			switch {
+			case err != nil && (errors.Is(err, ErrQueryBudgetExceeded) || res.ctx.Err() != nil):
+				return nil, err
+			case err != nil:
+				// the servers may be choking on the minimised query
+				logger.Debug("minimised query failed; falling back to the full qname",
+					"qname", q.Name, "name", hop.Name, "zone", zone, "err", err)
+				min = nil
+				continue
+			case next != nil:
+				// a zone cut; follow the referral below
+			case resp.Rcode == dns.RcodeNameError:
+				// the name may be an empty non-terminal that a broken
+				// server denies; don't trust the NXDOMAIN
+				logger.Debug("minimised query got NXDOMAIN; falling back to the full qname",
+					"qname", q.Name, "name", hop.Name, "zone", zone)
+				min = nil
+				continue
+			default:
+				// not a zone cut; add more labels.  The servers may
+				// also be authoritative for a child zone, in which
+				// case they answer for it without a referral.
+				if child, ok := authorityZone(resp, zone, q.Name); ok {
+					zone = child
+				}
+				continue
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return resp, nil
+		}
+
+		logger.Debug("following referral", "qname", q.Name, "from", zone, "to", next.zone,
+			"nameservers", len(next.servers))
+		zone = next.zone
+		servers = next.servers
+	}
+}
+
+// authorityZone returns the zone whose SOA or NS RRset is in the authority
+// section of resp, if that zone is below zone and at or above qname.
+func authorityZone(resp *dns.Msg, zone, qname string) (string, bool) {
+	for _, rr := range resp.Ns {
+		t := rr.Header().Rrtype
+		if t != dns.TypeSOA && t != dns.TypeNS {
+			continue
+		}
+		owner := rr.Header().Name
+		if !equalNames(owner, zone) && dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, qname) {
+			return dns.Fqdn(strings.ToLower(owner)), true
+		}
+	}
+	return "", false
+}
+
+// delegation is a referral to the servers of a child zone.
+type delegation struct {
+	zone    string
+	servers []*NameServer
+}
+
+// referral checks whether resp, from a server for zone, is a referral to a
+// child zone on the way to qname.  lame is set if resp is a referral that
+// doesn't lead closer to qname (e.g., an upward referral).
+func referral(resp *dns.Msg, zone, qname string) (d *delegation, lame bool) {
+	if resp.Authoritative || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil, false
+	}
+
+	nses := msgutil.CollectRRs[*dns.NS](resp.Ns)
+	if len(nses) == 0 {
+		return nil, false
+	}
+
+	child := nses[0].Hdr.Name
+	if equalNames(child, zone) || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, qname) {
+		return nil, true
+	}
+
+	d = &delegation{zone: dns.Fqdn(strings.ToLower(child))}
+	for _, ns := range nses {
+		if !equalNames(ns.Hdr.Name, child) {
+			continue
+		}
+		d.servers = append(d.servers, &NameServer{Name: ns.Ns})
+	}
+
+	// only accept glue that the server is authoritative for
+	for _, rr := range resp.Extra {
+		name := rr.Header().Name
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A)
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		for _, ns := range d.servers {
+			if equalNames(ns.Name, name) && addr.IsValid() {
+				ns.Addrs = append(ns.Addrs, addr.Unmap())
+			}
+		}
+	}
+
+	return d, false
+}
+
+func (res *resolution) usableAddrs(addrs []netip.Addr) []netip.Addr {
+	var usable []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() || res.r.config.UseIPv6 {
+			usable = append(usable, addr)
+		}
+	}
+	return usable
+}
+
+// queryZone asks the servers for zone about q, trying each server (and each
+// of its addresses) in turn until one gives a usable response: either a
+// final response, or a referral to a child zone.  Servers with glue are
+// tried before servers whose addresses must first be resolved.
+func (res *resolution) queryZone(zone string, servers []*NameServer, q dns.Question, depth int) (*dns.Msg, *delegation, error) {
+	var errs []error
+
+	var ordered []*NameServer
+	for _, ns := range servers {
+		if len(res.usableAddrs(ns.Addrs)) > 0 {
+			ordered = append(ordered, ns)
+		}
+	}
+	for _, ns := range servers {
+		if len(res.usableAddrs(ns.Addrs)) == 0 {
+			ordered = append(ordered, ns)
+		}
+	}
+
+	for _, ns := range ordered {
+		addrs := res.usableAddrs(ns.Addrs)
+		if len(addrs) == 0 {
+			var err error
+			addrs, err = res.lookupAddrs(ns.Name, depth+1)
+			if err != nil {
+				if errors.Is(err, ErrQueryBudgetExceeded) || res.ctx.Err() != nil {
+					return nil, nil, err
+				}
+				errs = append(errs, fmt.Errorf("%s: %w", ns.Name, err))
+				continue
+			}
+		}
+
+		for _, addr := range addrs {
+			start := time.Now()
+			resp, err := res.exchange(addr, q)
+			hop := &Hop{
+				Zone:     zone,
+				Server:   ns.Name,
+				Addr:     addr,
+				Question: q,
+				Depth:    depth,
+				RTT:      time.Since(start),
+				Response: resp,
+				Err:      err,
+			}
+
+			var d *delegation
+			var lame bool
+			usable := err == nil && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError)
+			if usable {
+				d, lame = referral(resp, zone, q.Name)
+				hop.Lame = lame
+				if d != nil {
+					hop.Referral = d.zone
+					hop.NameServers = d.servers
+				}
+			}
+			if res.r.config.OnHop != nil {
+				res.r.config.OnHop(hop)
+			}
+
+			if err != nil {
+				if errors.Is(err, ErrQueryBudgetExceeded) || res.ctx.Err() != nil {
+					return nil, nil, err
+				}
+				errs = append(errs, fmt.Errorf("%s (%s): %w", ns.Name, addr, err))
+				continue
+			}
+			if !usable {
+				errs = append(errs, fmt.Errorf("%s (%s): rcode %s", ns.Name, addr,
+					dns.RcodeToString[resp.Rcode]))
+				continue
+			}
+			if lame {
+				errs = append(errs, fmt.Errorf("%s (%s): lame referral", ns.Name, addr))
+				continue
+			}
+			return resp, d, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("no usable nameservers for zone %q", zone)
+	}
+	return nil, nil, fmt.Errorf("no nameserver for zone %q answered: %w", zone, errors.Join(errs...))
+}
+
+// lookupAddrs resolves the addresses of a nameserver that came without
+// glue.
+func (res *resolution) lookupAddrs(name string, depth int) ([]netip.Addr, error) {
+	key := strings.ToLower(dns.Fqdn(name))
+	if depth > res.maxDepth() {
+		return nil, fmt.Errorf("%w: nameserver lookups nested more than %d deep", ErrResolutionLoop,
+			res.maxDepth())
+	}
+	if res.resolving[key] {
+		return nil, fmt.Errorf("%w: resolving %s requires its own address", ErrResolutionLoop, name)
+	}
+	res.resolving[key] = true
+	defer delete(res.resolving, key)
+
+	qtypes := []uint16{dns.TypeA}
+	if res.r.config.UseIPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+
+	var addrs []netip.Addr
+	var errs []error
+	for _, qtype := range qtypes {
+		q := dns.Question{Name: key, Qtype: qtype, Qclass: dns.ClassINET}
+		resp, err := res.resolve(q, depth)
+		if err != nil {
+			if errors.Is(err, ErrQueryBudgetExceeded) {
+				return nil, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for _, a := range msgutil.CollectRRs[*dns.A](resp.Answer) {
+			if addr, ok := netip.AddrFromSlice(a.A); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+		for _, aaaa := range msgutil.CollectRRs[*dns.AAAA](resp.Answer) {
+			if addr, ok := netip.AddrFromSlice(aaaa.AAAA); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, fmt.Errorf("nameserver %s has no addresses", name)
+	}
+	return addrs, nil
+}
+
+func (res *resolution) newClient(addr netip.Addr, useTCP bool) Client {
+	config := res.r.config
+	port := config.Port
+	if port == 0 {
+		port = 53
+	}
+
+	hopConfig := &Do53Config{
+		Config: Config{
+			Timeout: config.Timeout,
+			Metrics: config.Metrics,
+			Logger:  config.Logger,
+		},
+		UseTCP: useTCP,
+		Server: netip.AddrPortFrom(addr, port).String(),
+	}
+	if config.NewClient != nil {
+		return config.NewClient(hopConfig)
+	}
+	return NewDo53Client(hopConfig)
+}
+
+// exchange sends q to the server at addr, charging the query to the budget.
+// A truncated UDP response is retried over TCP.
+func (res *resolution) exchange(addr netip.Addr, q dns.Question) (*dns.Msg, error) {
+	useTCP := res.r.config.UseTCP
+	for {
+		if res.queries >= res.maxQueries() {
+			return nil, fmt.Errorf("%w (%d queries)", ErrQueryBudgetExceeded, res.maxQueries())
+		}
+		res.queries++
+
+		req := new(dns.Msg)
+		req.SetQuestion(q.Name, q.Qtype)
+		req.Question[0].Qclass = q.Qclass
+		req.RecursionDesired = false
+		req.SetEdns0(4096, res.do)
+
+		c := res.newClient(addr, useTCP)
+		err := c.Dial()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := queryContext(res.ctx, c, req)
+		c.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Truncated && !useTCP {
+			useTCP = true
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,271 @@
+package dnsclient_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// The fake hierarchy: a root server, and servers for test. and provider.,
+// which delegate in various ways.  127.0.0.4 serves a copy of the root, so
+// it answers queries for lame.test. with an upward referral.
+var hierarchy = map[string][]string{
+	"127.0.0.1": {`
+.	3600	IN	SOA	a.root. hostmaster.root. 1 7200 3600 1209600 300
+.	3600	IN	NS	a.root.
+a.root.	3600	IN	A	127.0.0.1
+test.	3600	IN	NS	ns1.test.
+ns1.test.	3600	IN	A	127.0.0.2
+provider.	3600	IN	NS	ns.provider.
+ns.provider.	3600	IN	A	127.0.0.3
+`},
+	"127.0.0.2": {`
+test.	3600	IN	SOA	ns1.test. hostmaster.test. 1 7200 3600 1209600 300
+test.	3600	IN	NS	ns1.test.
+ns1.test.	3600	IN	A	127.0.0.2
+www.test.	3600	IN	A	192.0.2.1
+sub.test.	3600	IN	NS	ns.sub.test.
+ns.sub.test.	3600	IN	A	127.0.0.3
+glueless.test.	3600	IN	NS	ns.provider.
+lame.test.	3600	IN	NS	ns.lame.test.
+ns.lame.test.	3600	IN	A	127.0.0.4
+halflame.test.	3600	IN	NS	ns.lame.test.
+halflame.test.	3600	IN	NS	ns.sub.test.
+loop.test.	3600	IN	NS	ns.loop.test.
+deep.test.	3600	IN	NS	ns1.test.
+`, `
+deep.test.	3600	IN	SOA	ns1.test. hostmaster.test. 1 7200 3600 1209600 300
+deep.test.	3600	IN	NS	ns1.test.
+a.b.deep.test.	3600	IN	A	192.0.2.5
+`},
+	"127.0.0.3": {`
+provider.	3600	IN	SOA	ns.provider. hostmaster.provider. 1 7200 3600 1209600 300
+provider.	3600	IN	NS	ns.provider.
+ns.provider.	3600	IN	A	127.0.0.3
+`, `
+sub.test.	3600	IN	SOA	ns.sub.test. hostmaster.test. 1 7200 3600 1209600 300
+sub.test.	3600	IN	NS	ns.sub.test.
+www.sub.test.	3600	IN	A	192.0.2.2
+`, `
+glueless.test.	3600	IN	SOA	ns.provider. hostmaster.test. 1 7200 3600 1209600 300
+glueless.test.	3600	IN	NS	ns.provider.
+www.glueless.test.	3600	IN	A	192.0.2.3
+`, `
+halflame.test.	3600	IN	SOA	ns.sub.test. hostmaster.test. 1 7200 3600 1209600 300
+halflame.test.	3600	IN	NS	ns.sub.test.
+www.halflame.test.	3600	IN	A	192.0.2.4
+`},
+	"127.0.0.4": {`
+.	3600	IN	SOA	a.root. hostmaster.root. 1 7200 3600 1209600 300
+.	3600	IN	NS	a.root.
+test.	3600	IN	NS	ns1.test.
+`},
+}
+
+// newHierarchy starts a server for each address in hierarchy, all on the same
+// port, and returns them by address along with the port.
+func newHierarchy(t *testing.T, zones map[string][]string) (map[string]*dnstest.Server, uint16) {
+	t.Helper()
+
+	var err error
+	for try := 0; try < 10; try++ {
+		servers := make(map[string]*dnstest.Server)
+		port := 0
+		for _, addr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"} {
+			if zones[addr] == nil {
+				continue
+			}
+			var s *dnstest.Server
+			s, err = dnstest.NewServer(&dnstest.ServerConfig{Zones: zones[addr], Addr: addr, Port: port})
+			if err != nil {
+				break
+			}
+			servers[addr] = s
+			if port == 0 {
+				_, p, _ := net.SplitHostPort(s.Do53Addr)
+				port, _ = strconv.Atoi(p)
+			}
+		}
+		if err == nil {
+			t.Cleanup(func() {
+				for _, s := range servers {
+					s.Close()
+				}
+			})
+			return servers, uint16(port)
+		}
+		// the port may be taken on one of the addresses
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+	t.Fatal(err)
+	return nil, 0
+}
+
+func newIterativeResolver(port uint16, config *dnsclient.IterativeConfig) *dnsclient.IterativeResolver {
+	config.Timeout = time.Second
+	config.Port = port
+	config.RootHints = []*dnsclient.NameServer{
+		{Name: "a.root.", Addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}},
+	}
+	return dnsclient.NewIterativeResolver(config)
+}
+
+// hopRecorder collects the hops of a resolution.
+type hopRecorder struct {
+	mu   sync.Mutex
+	hops []*dnsclient.Hop
+}
+
+func (h *hopRecorder) record(hop *dnsclient.Hop) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hops = append(h.hops, hop)
+}
+
+func resolveA(t *testing.T, r *dnsclient.IterativeResolver, name string) (*dns.Msg, error) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return r.QueryContext(context.Background(), req)
+}
+
+func TestIterativeResolver(t *testing.T) {
+	_, port := newHierarchy(t, hierarchy)
+
+	tests := []struct {
+		name  string
+		qname string
+		addr  string
+	}{
+		{"authoritative", "www.test.", "192.0.2.1"},
+		{"glue", "www.sub.test.", "192.0.2.2"},
+		{"glueless", "www.glueless.test.", "192.0.2.3"},
+		{"lame server skipped", "www.halflame.test.", "192.0.2.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hops hopRecorder
+			r := newIterativeResolver(port, &dnsclient.IterativeConfig{OnHop: hops.record})
+			resp, err := resolveA(t, r, tt.qname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs := msgutil.CollectRRs[*dns.A](resp.Answer)
+			if len(addrs) != 1 || addrs[0].A.String() != tt.addr {
+				t.Errorf("unexpected answer: %v", resp.Answer)
+			}
+			if !resp.Authoritative {
+				t.Errorf("the response is not authoritative")
+			}
+			last := hops.hops[len(hops.hops)-1]
+			if last.Depth != 0 || last.Referral != "" {
+				t.Errorf("unexpected last hop: %+v", last)
+			}
+		})
+	}
+
+	t.Run("hops", func(t *testing.T) {
+		var hops hopRecorder
+		r := newIterativeResolver(port, &dnsclient.IterativeConfig{OnHop: hops.record})
+		if _, err := resolveA(t, r, "www.glueless.test."); err != nil {
+			t.Fatal(err)
+		}
+		var trace []string
+		for _, hop := range hops.hops {
+			trace = append(trace, strconv.Itoa(hop.Depth)+" "+hop.Zone+" "+hop.Question.Name+" "+hop.Referral)
+		}
+		want := []string{
+			"0 . www.glueless.test. test.",
+			"0 test. www.glueless.test. glueless.test.",
+			// ns.provider. has no glue
+			"1 . ns.provider. provider.",
+			"1 provider. ns.provider. ",
+			"0 glueless.test. www.glueless.test. ",
+		}
+		if strings.Join(trace, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got hops\n%s\nwant\n%s", strings.Join(trace, "\n"), strings.Join(want, "\n"))
+		}
+	})
+
+	t.Run("lame", func(t *testing.T) {
+		var hops hopRecorder
+		r := newIterativeResolver(port, &dnsclient.IterativeConfig{OnHop: hops.record})
+		if _, err := resolveA(t, r, "www.lame.test."); err == nil {
+			t.Fatal("resolved a name whose only server is lame")
+		}
+		last := hops.hops[len(hops.hops)-1]
+		if !last.Lame {
+			t.Errorf("the last hop is not marked lame: %+v", last)
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		r := newIterativeResolver(port, &dnsclient.IterativeConfig{})
+		_, err := resolveA(t, r, "www.loop.test.")
+		if !errors.Is(err, dnsclient.ErrResolutionLoop) {
+			t.Errorf("got error %v, want %v", err, dnsclient.ErrResolutionLoop)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		r := newIterativeResolver(port, &dnsclient.IterativeConfig{MaxQueries: 2})
+		_, err := resolveA(t, r, "www.sub.test.")
+		if !errors.Is(err, dnsclient.ErrQueryBudgetExceeded) {
+			t.Errorf("got error %v, want %v", err, dnsclient.ErrQueryBudgetExceeded)
+		}
+	})
+}
+
+func TestIterativeQNAMEMinimisation(t *testing.T) {
+	servers, port := newHierarchy(t, hierarchy)
+
+	var hops hopRecorder
+	r := newIterativeResolver(port, &dnsclient.IterativeConfig{
+		QNAMEMinimisation: true,
+		OnHop:             hops.record,
+	})
+	resp, err := resolveA(t, r, "a.b.deep.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := msgutil.CollectRRs[*dns.A](resp.Answer); len(addrs) != 1 {
+		t.Errorf("unexpected answer: %v", resp.Answer)
+	}
+
+	// the root only learns the TLD
+	for _, q := range servers["127.0.0.1"].Queries() {
+		if name := q.Question[0].Name; name != "test." {
+			t.Errorf("the root was asked about %s", name)
+		}
+	}
+
+	// 127.0.0.2 serves both test. and deep.test., so there is no
+	// referral between them, but the hops below deep.test. must be
+	// attributed to it
+	var trace []string
+	for _, hop := range hops.hops {
+		trace = append(trace, hop.Zone+" "+hop.Question.Name+" "+dns.TypeToString[hop.Question.Qtype])
+	}
+	want := []string{
+		". test. A",
+		"test. deep.test. A",
+		"deep.test. b.deep.test. A",
+		"deep.test. a.b.deep.test. A",
+	}
+	if strings.Join(trace, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got hops\n%s\nwant\n%s", strings.Join(trace, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,20 @@
+package dnsclient
+
+import (
+	"log/slog"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/logx"
+)
+
+// logger returns the config's Logger, or a logger that discards everything
+// if the Logger is unset.
+func (config *Config) logger() *slog.Logger {
+	return logx.OrDiscard(config.Logger)
+}
+
+// questionAttrs returns the log attributes that identify the question in m.
+func questionAttrs(m *dns.Msg) []any {
+	q := m.Question[0]
+	return []any{"qname", q.Name, "qtype", dns.TypeToString[q.Qtype], "id", m.Id}
+}
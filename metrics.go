@@ -0,0 +1,109 @@
+package dnsclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type Transport int
+
+const (
+	TransportDo53UDP Transport = iota
+	TransportDo53TCP
+	TransportDoT
+	TransportDoH
+)
+
+var TransportToString = map[Transport]string{
+	TransportDo53UDP: "do53-udp",
+	TransportDo53TCP: "do53-tcp",
+	TransportDoT:     "dot",
+	TransportDoH:     "doh",
+}
+
+func (t Transport) String() string {
+	s, ok := TransportToString[t]
+	if !ok {
+		return fmt.Sprintf("Transport(%d)", int(t))
+	}
+	return s
+}
+
+// QueryObservation describes one query that a client sent over the wire.
+type QueryObservation struct {
+	Transport Transport
+	Qtype     uint16
+	// Rcode is the response's RCODE, or -1 if there was no response.
+	Rcode     int
+	Latency   time.Duration
+	Err       error
+	Timeout   bool // Err is a timeout
+	Truncated bool // the response had the TC bit set
+}
+
+// Metrics receives measurements from the Do53, DoT, and DoH clients whose
+// Config.Metrics is set.  Implementations must be safe for concurrent use.
+type Metrics interface {
+	ObserveQuery(obs *QueryObservation)
+	// ObserveDial is called each time a client dials its server; err is
+	// the outcome of the dial.
+	ObserveDial(transport Transport, err error)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// observeQuery reports a query that a client sent to server to the config's
+// Metrics and Logger.
+func observeQuery(config *Config, transport Transport, server string, req, resp *dns.Msg, err error, start time.Time) {
+	rtt := time.Since(start)
+
+	logger := config.logger()
+	attrs := append(questionAttrs(req), "transport", transport.String(), "server", server, "rtt", rtt)
+	if err != nil {
+		logger.Debug("dns exchange failed", append(attrs, "err", err)...)
+	} else {
+		logger.Debug("dns exchange", append(attrs, "rcode", dns.RcodeToString[resp.Rcode],
+			"truncated", resp.Truncated)...)
+	}
+
+	if config.Metrics == nil {
+		return
+	}
+
+	obs := &QueryObservation{
+		Transport: transport,
+		Qtype:     req.Question[0].Qtype,
+		Rcode:     -1,
+		Latency:   rtt,
+		Err:       err,
+		Timeout:   isTimeout(err),
+	}
+	if resp != nil && err == nil {
+		obs.Rcode = resp.Rcode
+		obs.Truncated = resp.Truncated
+	}
+	config.Metrics.ObserveQuery(obs)
+}
+
+// observeDial reports a dial to server to the config's Metrics and Logger.
+func observeDial(config *Config, transport Transport, server string, err error) {
+	logger := config.logger()
+	if err != nil {
+		logger.Warn("failed to connect to DNS server", "transport", transport.String(),
+			"server", server, "err", err)
+	} else {
+		logger.Debug("connected to DNS server", "transport", transport.String(), "server", server)
+	}
+
+	if config.Metrics == nil {
+		return
+	}
+	config.Metrics.ObserveDial(transport, err)
+}
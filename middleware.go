@@ -0,0 +1,149 @@
+package dnsclient
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Middleware wraps a Client in order to add behavior around its queries
+// (logging, request mutation, and so on) without touching the transport.
+type Middleware func(next Client) Client
+
+// Chain wraps c in mws.  The first middleware is the outermost: it sees each
+// request first and each response last.
+func Chain(c Client, mws ...Middleware) Client {
+	for i := len(mws) - 1; i >= 0; i-- {
+		c = mws[i](c)
+	}
+	return c
+}
+
+// QueryFunc issues a raw query, as Client.Query does.
+type QueryFunc func(req *dns.Msg) (*dns.Msg, error)
+
+// Interceptor is called in place of a Client's Query method; it may inspect
+// or modify the request, pass it on by calling next (or not), and inspect or
+// modify the outcome.
+type Interceptor func(req *dns.Msg, next QueryFunc) (*dns.Msg, error)
+
+type interceptClient struct {
+	next Client
+	f    Interceptor
+}
+
+// Intercept returns a Middleware that routes each query through f.  The
+// resulting Client delegates everything else (GetConfig, Dial, Close) to the
+// Client it wraps.
+func Intercept(f Interceptor) Middleware {
+	return func(next Client) Client {
+		return &interceptClient{next: next, f: f}
+	}
+}
+
+// Unwrap returns the Client that c wraps.
+func (c *interceptClient) Unwrap() Client {
+	return c.next
+}
+
+func (c *interceptClient) GetConfig() *Config {
+	return c.next.GetConfig()
+}
+
+func (c *interceptClient) Dial() error {
+	return c.next.Dial()
+}
+
+func (c *interceptClient) Close() error {
+	return c.next.Close()
+}
+
+func (c *interceptClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.f(req, c.next.Query)
+}
+
+func (c *interceptClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return c.f(req, func(req *dns.Msg) (*dns.Msg, error) {
+		return queryContext(ctx, c.next, req)
+	})
+}
+
+// Logging returns a Middleware that logs each query and its outcome to
+// logger, at level Info (or Warn, if the query failed).
+func Logging(logger *slog.Logger) Middleware {
+	return Intercept(func(req *dns.Msg, next QueryFunc) (*dns.Msg, error) {
+		start := time.Now()
+		resp, err := next(req)
+		attrs := append(questionAttrs(req), "rtt", time.Since(start))
+		if err != nil {
+			logger.Warn("query", append(attrs, "err", err)...)
+		} else {
+			logger.Info("query", append(attrs, "rcode", dns.RcodeToString[resp.Rcode],
+				"answer", len(resp.Answer), "ns", len(resp.Ns), "extra", len(resp.Extra))...)
+		}
+		return resp, err
+	})
+}
+
+// MutateRequest returns a Middleware that calls f on a copy of each request
+// before passing the copy on; the caller's message is left untouched.
+func MutateRequest(f func(req *dns.Msg)) Middleware {
+	return Intercept(func(req *dns.Msg, next QueryFunc) (*dns.Msg, error) {
+		req = req.Copy()
+		f(req)
+		return next(req)
+	})
+}
+
+// AddEDNS0Options returns a Middleware that adds options to the OPT record
+// of each request, creating the OPT record if the request lacks one.
+func AddEDNS0Options(options ...dns.EDNS0) Middleware {
+	return MutateRequest(func(req *dns.Msg) {
+		opt := req.IsEdns0()
+		if opt == nil {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt = req.IsEdns0()
+		}
+		opt.Option = append(opt.Option, options...)
+	})
+}
+
+// InspectResponse returns a Middleware that calls f on each response that
+// the wrapped Client returns without error.  If f returns an error, the query
+// fails with that error instead.
+func InspectResponse(f func(req, resp *dns.Msg) error) Middleware {
+	return Intercept(func(req *dns.Msg, next QueryFunc) (*dns.Msg, error) {
+		resp, err := next(req)
+		if err != nil {
+			return resp, err
+		}
+		err = f(req, resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+}
+
+// Hooks are callbacks run around each query.  Either may be nil.
+type Hooks struct {
+	BeforeQuery func(req *dns.Msg)
+	AfterQuery  func(req, resp *dns.Msg, err error, rtt time.Duration)
+}
+
+// WithHooks returns a Middleware that runs h around each query.
+func WithHooks(h Hooks) Middleware {
+	return Intercept(func(req *dns.Msg, next QueryFunc) (*dns.Msg, error) {
+		if h.BeforeQuery != nil {
+			h.BeforeQuery(req)
+		}
+		start := time.Now()
+		resp, err := next(req)
+		if h.AfterQuery != nil {
+			h.AfterQuery(req, resp, err, time.Since(start))
+		}
+		return resp, err
+	})
+}
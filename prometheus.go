@@ -0,0 +1,210 @@
+package dnsclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the query
+// latency histogram buckets that PrometheusMetrics uses by default.
+var DefaultLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type queryKey struct {
+	transport Transport
+	qtype     uint16
+	rcode     int
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket; not cumulative
+	count  uint64
+	sum    float64
+}
+
+// PrometheusMetrics is a Metrics that keeps counters and latency histograms
+// in memory and renders them in the Prometheus text exposition format,
+// either through WriteTo or by serving them over HTTP.
+type PrometheusMetrics struct {
+	mu           sync.Mutex
+	buckets      []float64
+	queries      map[queryKey]uint64
+	errors       map[Transport]uint64
+	timeouts     map[Transport]uint64
+	truncated    map[Transport]uint64
+	latency      map[Transport]*histogram
+	dials        map[Transport]uint64
+	dialFailures map[Transport]uint64
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics whose latency histograms
+// use the given bucket upper bounds (in seconds, in increasing order).  If
+// buckets is nil, DefaultLatencyBuckets is used.
+func NewPrometheusMetrics(buckets []float64) *PrometheusMetrics {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	return &PrometheusMetrics{
+		buckets:      buckets,
+		queries:      make(map[queryKey]uint64),
+		errors:       make(map[Transport]uint64),
+		timeouts:     make(map[Transport]uint64),
+		truncated:    make(map[Transport]uint64),
+		latency:      make(map[Transport]*histogram),
+		dials:        make(map[Transport]uint64),
+		dialFailures: make(map[Transport]uint64),
+	}
+}
+
+func (m *PrometheusMetrics) ObserveQuery(obs *QueryObservation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queries[queryKey{obs.Transport, obs.Qtype, obs.Rcode}]++
+	if obs.Err != nil {
+		m.errors[obs.Transport]++
+	}
+	if obs.Timeout {
+		m.timeouts[obs.Transport]++
+	}
+	if obs.Truncated {
+		m.truncated[obs.Transport]++
+	}
+
+	h, ok := m.latency[obs.Transport]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[obs.Transport] = h
+	}
+	secs := obs.Latency.Seconds()
+	for i, bound := range m.buckets {
+		if secs <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (m *PrometheusMetrics) ObserveDial(transport Transport, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dials[transport]++
+	if err != nil {
+		m.dialFailures[transport]++
+	}
+}
+
+func sortedTransports[V any](m map[Transport]V) []Transport {
+	keys := make([]Transport, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func writeHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+}
+
+func writeTransportCounter(b *bytes.Buffer, name, help string, counts map[Transport]uint64) {
+	writeHeader(b, name, "counter", help)
+	for _, t := range sortedTransports(counts) {
+		fmt.Fprintf(b, "%s{transport=%q} %d\n", name, t.String(), counts[t])
+	}
+}
+
+func rcodeLabel(rcode int) string {
+	if rcode < 0 {
+		return "none"
+	}
+	s, ok := dns.RcodeToString[rcode]
+	if !ok {
+		return strconv.Itoa(rcode)
+	}
+	return s
+}
+
+func qtypeLabel(qtype uint16) string {
+	s, ok := dns.TypeToString[qtype]
+	if !ok {
+		return strconv.Itoa(int(qtype))
+	}
+	return s
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	m.mu.Lock()
+
+	name := "dnsclient_queries_total"
+	writeHeader(&b, name, "counter", "DNS queries sent, by transport, qtype, and response rcode.")
+	keys := make([]queryKey, 0, len(m.queries))
+	for k := range m.queries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].transport != keys[j].transport {
+			return keys[i].transport < keys[j].transport
+		}
+		if keys[i].qtype != keys[j].qtype {
+			return keys[i].qtype < keys[j].qtype
+		}
+		return keys[i].rcode < keys[j].rcode
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s{transport=%q,qtype=%q,rcode=%q} %d\n", name,
+			k.transport.String(), qtypeLabel(k.qtype), rcodeLabel(k.rcode), m.queries[k])
+	}
+
+	writeTransportCounter(&b, "dnsclient_query_errors_total",
+		"DNS queries that failed without a response.", m.errors)
+	writeTransportCounter(&b, "dnsclient_query_timeouts_total",
+		"DNS queries that timed out.", m.timeouts)
+	writeTransportCounter(&b, "dnsclient_truncated_responses_total",
+		"DNS responses with the TC bit set.", m.truncated)
+
+	name = "dnsclient_query_duration_seconds"
+	writeHeader(&b, name, "histogram", "DNS query latency.")
+	for _, t := range sortedTransports(m.latency) {
+		h := m.latency[t]
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{transport=%q,le=%q} %d\n", name, t.String(),
+				strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{transport=%q,le=\"+Inf\"} %d\n", name, t.String(), h.count)
+		fmt.Fprintf(&b, "%s_sum{transport=%q} %g\n", name, t.String(), h.sum)
+		fmt.Fprintf(&b, "%s_count{transport=%q} %d\n", name, t.String(), h.count)
+	}
+
+	writeTransportCounter(&b, "dnsclient_dials_total",
+		"Connections dialed to DNS servers.", m.dials)
+	writeTransportCounter(&b, "dnsclient_dial_failures_total",
+		"Connections to DNS servers that failed to dial.", m.dialFailures)
+
+	m.mu.Unlock()
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, so that a PrometheusMetrics can be
+// registered directly as a scrape endpoint.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
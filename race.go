@@ -0,0 +1,221 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RaceConfig configures a RaceClient.  The embedded Config governs how Query
+// and Lookup treat the RaceClient (e.g., MaxCNAMEs); each upstream keeps its
+// own config for the transport that it speaks.
+type RaceConfig struct {
+	Config
+	// Upstreams are the clients that each query is sent to.  They may use
+	// different transports (e.g., a Do53Client and a DoHClient).
+	Upstreams []Client
+	// Stagger delays the start of each successive upstream, in the style of
+	// Happy Eyeballs (RFC 8305).  If an upstream fails before its successor
+	// is due to start, the successor starts immediately.  A zero Stagger
+	// sends the query to all upstreams at once.
+	Stagger time.Duration
+}
+
+// RaceClient sends each query to several upstreams and returns the first
+// valid response, cancelling the queries that are still outstanding.  A
+// response is valid if it arrives without error and its RCODE is neither
+// SERVFAIL nor REFUSED.
+//
+// Like the other clients, a RaceClient is not safe for concurrent use.
+type RaceClient struct {
+	config *RaceConfig
+	dialed []bool
+	// busy[i] is set while a query to upstream i is in flight; a loser
+	// that does not support cancellation may still be running when the
+	// next race starts, in which case that upstream sits the race out.
+	busy   []atomic.Bool
+	wins   []int
+	winner int
+}
+
+func NewRaceClient(config *RaceConfig) *RaceClient {
+	n := len(config.Upstreams)
+	return &RaceClient{
+		config: config,
+		dialed: make([]bool, n),
+		busy:   make([]atomic.Bool, n),
+		wins:   make([]int, n),
+		winner: -1,
+	}
+}
+
+func (c *RaceClient) GetConfig() *Config {
+	return &c.config.Config
+}
+
+// Dial dials every upstream.  It is only an error if none of the upstreams
+// could be dialed; the upstreams that failed are left out of the races.
+func (c *RaceClient) Dial() error {
+	var errs []error
+	ok := false
+	for i, upstream := range c.config.Upstreams {
+		err := upstream.Dial()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstream %d: %w", i, err))
+			continue
+		}
+		c.dialed[i] = true
+		ok = true
+	}
+	if !ok {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (c *RaceClient) Close() error {
+	var errs []error
+	for i, upstream := range c.config.Upstreams {
+		if !c.dialed[i] {
+			continue
+		}
+		c.dialed[i] = false
+		err := upstream.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstream %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Winner returns the index (into RaceConfig.Upstreams) of the upstream that
+// answered the most recent query, or -1 if that query had no winner.
+func (c *RaceClient) Winner() int {
+	return c.winner
+}
+
+// Wins returns, for each upstream, the number of races it has won.
+func (c *RaceClient) Wins() []int {
+	wins := make([]int, len(c.wins))
+	copy(wins, c.wins)
+	return wins
+}
+
+func (c *RaceClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func isRaceWinner(resp *dns.Msg, err error) bool {
+	if err != nil {
+		return false
+	}
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+func (c *RaceClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		i    int
+		resp *dns.Msg
+		err  error
+	}
+
+	c.winner = -1
+
+	var candidates []int
+	for i := range c.config.Upstreams {
+		if c.dialed[i] && !c.busy[i].Load() {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no upstream is available to race")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered so that the losers never block after we return
+	results := make(chan result, len(candidates))
+
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	next := 0
+	pending := 0
+
+	startNext := func() {
+		i := candidates[next]
+		next++
+		pending++
+		c.busy[i].Store(true)
+		// copy req before returning: a loser may outlive this call, and
+		// the caller is free to reuse req (e.g., for the next hop of a
+		// DNAME chain)
+		q := req.Copy()
+		go func() {
+			defer c.busy[i].Store(false)
+			resp, err := queryContext(ctx, c.config.Upstreams[i], q)
+			results <- result{i: i, resp: resp, err: err}
+		}()
+
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+		if next < len(candidates) && c.config.Stagger > 0 {
+			timer = time.NewTimer(c.config.Stagger)
+			timerC = timer.C
+		}
+	}
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	startNext()
+	for c.config.Stagger <= 0 && next < len(candidates) {
+		startNext()
+	}
+
+	var errs []error
+	var lastResp *dns.Msg
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if isRaceWinner(r.resp, r.err) {
+				c.config.logger().Debug("race won", append(questionAttrs(req),
+					"upstream", r.i, "started", next)...)
+				c.winner = r.i
+				c.wins[r.i]++
+				return r.resp, nil
+			}
+			if r.err != nil {
+				errs = append(errs, fmt.Errorf("upstream %d: %w", r.i, r.err))
+			} else {
+				lastResp = r.resp
+			}
+			// don't wait out the stagger delay for an upstream that
+			// already lost
+			if next < len(candidates) {
+				startNext()
+			}
+		case <-timerC:
+			startNext()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// no valid response: prefer handing back an actual (e.g., SERVFAIL)
+	// response, so that Query can report the rcode
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,69 @@
+package dnsclient_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+)
+
+const raceZone = `
+example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300
+example.com.	3600	IN	NS	ns1.example.com.
+www.example.com.	3600	IN	A	192.0.2.1
+mail.example.com.	3600	IN	A	192.0.2.2
+`
+
+func newTestServer(t *testing.T, zones ...string) *dnstest.Server {
+	t.Helper()
+	s, err := dnstest.NewServer(&dnstest.ServerConfig{Zones: zones})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRaceClientFastestWins(t *testing.T) {
+	slow := newTestServer(t, raceZone)
+	slow.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{Delay: 300 * time.Millisecond}})
+	fast := newTestServer(t, raceZone)
+
+	c := dnsclient.NewRaceClient(&dnsclient.RaceConfig{
+		Upstreams: []dnsclient.Client{
+			dnsclient.NewDo53Client(slow.Do53Config()),
+			dnsclient.NewDo53Client(fast.Do53Config()),
+		},
+	})
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := c.QueryContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Winner() != 1 {
+		t.Errorf("winner: got %d, want 1", c.Winner())
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "www.example.com." {
+		t.Errorf("unexpected answer: %v", resp.Answer)
+	}
+
+	// the slow upstream is still running; reusing req must not change the
+	// question that it sends
+	req.SetQuestion("mail.example.com.", dns.TypeA)
+	time.Sleep(400 * time.Millisecond)
+
+	for _, q := range slow.Queries() {
+		if name := q.Question[0].Name; name != "www.example.com." {
+			t.Errorf("slow upstream was asked about %s", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/internal/logx"
+)
+
+// RecordingClient wraps a Client and appends an Entry for each query to a
+// fixture.  It is safe for concurrent use if the wrapped Client is.
+type RecordingClient struct {
+	next dnsclient.Client
+	mu   sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewRecordingClient returns a RecordingClient that sends queries to next and
+// writes the fixture to w.  Each Entry is written as soon as its query
+// completes.
+func NewRecordingClient(next dnsclient.Client, w io.Writer) *RecordingClient {
+	return &RecordingClient{next: next, enc: json.NewEncoder(w)}
+}
+
+// Unwrap returns the Client that c wraps.
+func (c *RecordingClient) Unwrap() dnsclient.Client {
+	return c.next
+}
+
+func (c *RecordingClient) GetConfig() *dnsclient.Config {
+	return c.next.GetConfig()
+}
+
+func (c *RecordingClient) Dial() error {
+	return c.next.Dial()
+}
+
+func (c *RecordingClient) Close() error {
+	return c.next.Close()
+}
+
+func (c *RecordingClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := c.next.Query(req)
+	rtt := time.Since(start)
+
+	q := req.Question[0]
+	e := &Entry{
+		Qname:  q.Name,
+		Qtype:  dns.TypeToString[q.Qtype],
+		Qclass: dns.ClassToString[q.Qclass],
+		Time:   start,
+		RTT:    rtt,
+	}
+	if u, ok := dnsclient.UpstreamOf(c.next); ok {
+		e.Transport = u.Transport().String()
+		e.Server = u.Server()
+	}
+
+	var perr error
+	e.Query, perr = req.Pack()
+	if perr != nil {
+		// a failure to record mustn't fail the query
+		logx.OrDiscard(c.GetConfig().Logger).Warn("failed to record query", "err", perr)
+		return resp, err
+	}
+	if err != nil {
+		e.Error = err.Error()
+		var timeout interface{ Timeout() bool }
+		e.Timeout = errors.As(err, &timeout) && timeout.Timeout()
+	} else {
+		e.Response, perr = resp.Pack()
+		if perr != nil {
+			logx.OrDiscard(c.GetConfig().Logger).Warn("failed to record response", "err", perr)
+			return resp, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if werr := c.enc.Encode(e); werr != nil {
+		logx.OrDiscard(c.GetConfig().Logger).Warn("failed to write fixture entry", "err", werr)
+	}
+
+	return resp, err
+}
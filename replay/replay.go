@@ -0,0 +1,232 @@
+// Package replay records the queries that a [dnsclient.Client] makes, along
+// with their responses, to a fixture file, and serves them back offline.
+// This makes code built on the dnsclient package testable without live
+// resolvers.
+//
+// A fixture is a JSON Lines file: each line is one Entry, holding the query
+// and response in wire format along with some metadata.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+)
+
+// Entry is one recorded exchange.  Qname, Qtype, and Qclass are
+// informational (they make fixtures readable and diffable); matching is done
+// on the unpacked Query.
+type Entry struct {
+	Qname     string        `json:"qname"`
+	Qtype     string        `json:"qtype"`
+	Qclass    string        `json:"qclass"`
+	Transport string        `json:"transport,omitempty"`
+	Server    string        `json:"server,omitempty"`
+	Time      time.Time     `json:"time"`
+	RTT       time.Duration `json:"rtt"`
+	Query     []byte        `json:"query"`
+	Response  []byte        `json:"response,omitempty"`
+	// Error is the error the query failed with, if any, and Timeout
+	// whether that error was a timeout.
+	Error   string `json:"error,omitempty"`
+	Timeout bool   `json:"timeout,omitempty"`
+}
+
+// ReadFixture reads the entries of a fixture from r.
+func ReadFixture(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		e := new(Entry)
+		err := json.Unmarshal([]byte(line), e)
+		if err != nil {
+			return nil, fmt.Errorf("fixture line %d: %w", lineno, err)
+		}
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LoadFixture reads the entries of the fixture file at path.
+func LoadFixture(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFixture(f)
+}
+
+// KeyFunc maps a query to the key that its recorded exchanges are looked up
+// by.  Two queries match if they have the same key.
+type KeyFunc func(req *dns.Msg) string
+
+// MatchQuestion keys a query by its question: the qname (case-insensitively),
+// qtype, and qclass.  The ID and all other fields are ignored.
+func MatchQuestion(req *dns.Msg) string {
+	q := req.Question[0]
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(dns.Fqdn(q.Name)), q.Qtype, q.Qclass)
+}
+
+// MatchQuestionAndFlags keys a query by its question, as well as by its RD
+// and CD bits and its EDNS0 DO bit.
+func MatchQuestionAndFlags(req *dns.Msg) string {
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s/rd=%t/cd=%t/do=%t", MatchQuestion(req),
+		req.RecursionDesired, req.CheckingDisabled, do)
+}
+
+// MatchWire keys a query by its entire wire format, except for the ID.
+func MatchWire(req *dns.Msg) string {
+	m := req.Copy()
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		return MatchQuestion(req)
+	}
+	return string(wire)
+}
+
+// ErrNoMatch is the error (wrapped) that a ReplayClient returns for a query
+// that has no recorded exchange.
+var ErrNoMatch = errors.New("no recorded exchange matches the query")
+
+// replayError replays a recorded query error.  It implements net.Error, and
+// matches dnsclient.ErrTimeout if it was a timeout, so that recorded timeouts
+// are still recognizable as timeouts.
+type replayError struct {
+	msg     string
+	timeout bool
+}
+
+func (e *replayError) Error() string   { return e.msg }
+func (e *replayError) Timeout() bool   { return e.timeout }
+func (e *replayError) Temporary() bool { return e.timeout }
+
+func (e *replayError) Is(target error) bool {
+	return e.timeout && target == dnsclient.ErrTimeout
+}
+
+type ReplayConfig struct {
+	dnsclient.Config
+	Entries []*Entry
+	// Key determines which recorded exchanges match a query.  If nil,
+	// MatchQuestion is used.
+	Key KeyFunc
+}
+
+// ReplayClient answers queries from recorded exchanges, without any network
+// access.  If several exchanges match a query, they are served in the order
+// they were recorded, and the last one is repeated once they run out.  A
+// ReplayClient is safe for concurrent use.
+type ReplayClient struct {
+	config *ReplayConfig
+	key    KeyFunc
+	mu     sync.Mutex
+	byKey  map[string][]*Entry
+	served map[string]int
+}
+
+// NewReplayClient indexes config.Entries.  It fails if an entry's query
+// can't be unpacked.
+func NewReplayClient(config *ReplayConfig) (*ReplayClient, error) {
+	c := &ReplayClient{
+		config: config,
+		key:    config.Key,
+		byKey:  make(map[string][]*Entry),
+		served: make(map[string]int),
+	}
+	if c.key == nil {
+		c.key = MatchQuestion
+	}
+
+	for i, e := range config.Entries {
+		m := new(dns.Msg)
+		err := m.Unpack(e.Query)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: failed to unpack query: %w", i, err)
+		}
+		if len(m.Question) == 0 {
+			return nil, fmt.Errorf("entry %d: query has no question", i)
+		}
+		k := c.key(m)
+		c.byKey[k] = append(c.byKey[k], e)
+	}
+
+	return c, nil
+}
+
+func (c *ReplayClient) GetConfig() *dnsclient.Config {
+	return &c.config.Config
+}
+
+func (c *ReplayClient) Dial() error {
+	return nil
+}
+
+func (c *ReplayClient) Close() error {
+	return nil
+}
+
+func (c *ReplayClient) next(req *dns.Msg) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := c.key(req)
+	entries := c.byKey[k]
+	if len(entries) == 0 {
+		return nil, false
+	}
+
+	i := c.served[k]
+	if i >= len(entries) {
+		i = len(entries) - 1
+	} else {
+		c.served[k]++
+	}
+	return entries[i], true
+}
+
+func (c *ReplayClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	e, ok := c.next(req)
+	if !ok {
+		q := req.Question[0]
+		return nil, fmt.Errorf("%w: %s %s", ErrNoMatch, q.Name, dns.TypeToString[q.Qtype])
+	}
+
+	if e.Error != "" {
+		return nil, &replayError{msg: e.Error, timeout: e.Timeout}
+	}
+
+	resp := new(dns.Msg)
+	err := resp.Unpack(e.Response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack recorded response: %w", err)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
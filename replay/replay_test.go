@@ -0,0 +1,147 @@
+package replay_test
+
+import (
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+	"github.com/syslab-wm/dnsclient/replay"
+)
+
+// Run with -update to record the fixtures in testdata against a dnstest
+// server.
+var update = flag.Bool("update", false, "record the fixtures in testdata")
+
+const exampleZone = `
+example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300
+example.com.	3600	IN	NS	ns1.example.com.
+example.com.	3600	IN	NS	ns2.example.com.
+ns1.example.com.	3600	IN	A	192.0.2.1
+ns1.example.com.	3600	IN	AAAA	2001:db8::1
+ns2.example.com.	3600	IN	A	192.0.2.2
+
+b._dns-sd._udp.example.com.	3600	IN	PTR	example.com.
+b._dns-sd._udp.example.com.	3600	IN	PTR	lab.example.com.
+db._dns-sd._udp.example.com.	3600	IN	PTR	example.com.
+_services._dns-sd._udp.example.com.	3600	IN	PTR	_http._tcp.example.com.
+_services._dns-sd._udp.example.com.	3600	IN	PTR	_ssh._tcp.example.com.
+_http._tcp.example.com.	3600	IN	PTR	web._http._tcp.example.com.
+_ssh._tcp.example.com.	3600	IN	PTR	shell._ssh._tcp.example.com.
+web._http._tcp.example.com.	3600	IN	SRV	0 0 80 www.example.com.
+web._http._tcp.example.com.	3600	IN	TXT	"path=/"
+shell._ssh._tcp.example.com.	3600	IN	SRV	10 5 22 shell.example.com.
+`
+
+// fixtureClient returns a client that replays the named fixture, or, with
+// -update, one that queries a dnstest server and records the fixture.
+func fixtureClient(t *testing.T, name string) dnsclient.Client {
+	t.Helper()
+	path := filepath.Join("testdata", name+".jsonl")
+
+	if !*update {
+		entries, err := replay.LoadFixture(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := replay.NewReplayClient(&replay.ReplayConfig{Entries: entries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	s, err := dnstest.NewServer(&dnstest.ServerConfig{Zones: []string{exampleZone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	c := replay.NewRecordingClient(dnsclient.NewDo53Client(s.Do53Config()), f)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestReplayGetNameServers(t *testing.T) {
+	c := fixtureClient(t, "nameservers")
+
+	nses, err := dnsclient.GetNameServers(c, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]netip.Addr)
+	for _, ns := range nses {
+		got[ns.Name] = ns.Addrs
+	}
+	want := map[string][]netip.Addr{
+		"ns1.example.com.": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+		"ns2.example.com.": {netip.MustParseAddr("192.0.2.2")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReplayServiceDiscovery(t *testing.T) {
+	c := fixtureClient(t, "dns-sd")
+
+	domains, err := dnsclient.GetAllServiceBrowserDomains(c, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(domains)
+	if want := []string{"example.com.", "lab.example.com."}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("browser domains: got %v, want %v", domains, want)
+	}
+
+	services, err := dnsclient.GetServices(c, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*dnsclient.ServiceInstanceInfo{
+		"web._http._tcp.example.com.": {
+			Port:   80,
+			Target: "www.example.com.",
+			Txt:    []string{"path=/"},
+		},
+		"shell._ssh._tcp.example.com.": {
+			Priority: 10,
+			Weight:   5,
+			Port:     22,
+			Target:   "shell.example.com.",
+		},
+	}
+
+	got := make(map[string]*dnsclient.ServiceInstanceInfo)
+	for _, service := range services {
+		instances, err := dnsclient.GetServiceInstances(c, service)
+		if err != nil {
+			t.Fatalf("%s: %v", service, err)
+		}
+		for _, instance := range instances {
+			info, err := dnsclient.GetServiceInstanceInfo(c, instance)
+			if err != nil {
+				t.Fatalf("%s: %v", instance, err)
+			}
+			got[instance] = info
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,395 @@
+package dnsclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultResolvConfPath is the system's stub resolver configuration.
+const DefaultResolvConfPath = "/etc/resolv.conf"
+
+// The defaults and limits that glibc applies to resolv.conf (see
+// resolv.conf(5)).
+const (
+	resolvMaxNameservers  = 3
+	resolvDefaultNdots    = 1
+	resolvMaxNdots        = 15
+	resolvDefaultTimeout  = 5 * time.Second
+	resolvMaxTimeout      = 30 * time.Second
+	resolvDefaultAttempts = 2
+	resolvMaxAttempts     = 5
+)
+
+// ResolvConf is the parsed form of a resolv.conf file.
+type ResolvConf struct {
+	Nameservers []string // host:port
+	Search      []string // fully-qualified
+	Ndots       int
+	Timeout     time.Duration // per query, to a single nameserver
+	Attempts    int           // passes over the nameservers
+	Rotate      bool          // spread queries over the nameservers
+	UseTCP      bool          // the use-vc option
+}
+
+// ReadResolvConf reads and parses the resolv.conf file at path.
+func ReadResolvConf(path string) (*ResolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseResolvConf(f)
+}
+
+// ParseResolvConf parses a resolv.conf file the way glibc does: only the
+// first three nameservers are used; of the domain and search lines, the last
+// one wins; unknown keywords and options are ignored; and the option values
+// are capped at glibc's limits.  If there are no nameservers, the local host
+// (127.0.0.1) is used, and if there is no search list, the domain part of the
+// host's name (if any) is.
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	conf := &ResolvConf{
+		Ndots:    resolvDefaultNdots,
+		Timeout:  resolvDefaultTimeout,
+		Attempts: resolvDefaultAttempts,
+	}
+	searchSet := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || len(conf.Nameservers) == resolvMaxNameservers {
+				continue
+			}
+			// the address may have an IPv6 zone, which net.ParseIP
+			// doesn't accept
+			addr, _, _ := strings.Cut(fields[1], "%")
+			if net.ParseIP(addr) == nil {
+				continue
+			}
+			conf.Nameservers = append(conf.Nameservers, net.JoinHostPort(fields[1], "53"))
+		case "domain":
+			if len(fields) < 2 {
+				continue
+			}
+			conf.Search = []string{dns.Fqdn(fields[1])}
+			searchSet = true
+		case "search":
+			conf.Search = nil
+			for _, domain := range fields[1:] {
+				conf.Search = append(conf.Search, dns.Fqdn(domain))
+			}
+			searchSet = true
+		case "options":
+			for _, option := range fields[1:] {
+				conf.setOption(option)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = []string{"127.0.0.1:53"}
+	}
+	if !searchSet {
+		hostname, err := os.Hostname()
+		if err == nil {
+			_, domain, ok := strings.Cut(hostname, ".")
+			if ok && domain != "" {
+				conf.Search = []string{dns.Fqdn(domain)}
+			}
+		}
+	}
+	return conf, nil
+}
+
+func (conf *ResolvConf) setOption(option string) {
+	name, value, _ := strings.Cut(option, ":")
+	n, err := strconv.Atoi(value)
+	hasNum := err == nil && n >= 0
+
+	switch name {
+	case "ndots":
+		if hasNum {
+			conf.Ndots = min(n, resolvMaxNdots)
+		}
+	case "timeout":
+		if hasNum {
+			conf.Timeout = min(time.Duration(max(n, 1))*time.Second, resolvMaxTimeout)
+		}
+	case "attempts":
+		if hasNum {
+			conf.Attempts = min(max(n, 1), resolvMaxAttempts)
+		}
+	case "rotate":
+		conf.Rotate = true
+	case "use-vc":
+		conf.UseTCP = true
+	}
+}
+
+// SearchNames returns the names to try, in order, when looking up name:
+// a name that ends with a dot is only tried as is; otherwise, a name with at
+// least Ndots dots is tried as is before the search list is applied, and a
+// name with fewer dots is tried as is after the search list.
+func (conf *ResolvConf) SearchNames(name string) []string {
+	if dns.IsFqdn(name) {
+		return []string{name}
+	}
+
+	var names []string
+	asIs := strings.Count(name, ".") >= conf.Ndots
+	if asIs {
+		names = append(names, dns.Fqdn(name))
+	}
+	for _, domain := range conf.Search {
+		candidate := name + "." + domain
+		if domain == "." {
+			candidate = name + "."
+		}
+		if _, ok := dns.IsDomainName(candidate); !ok || len(candidate) > 255 {
+			continue
+		}
+		names = append(names, candidate)
+	}
+	if !asIs {
+		names = append(names, dns.Fqdn(name))
+	}
+	return names
+}
+
+// Searcher is implemented by clients that expand names with a search list,
+// as a stub resolver does.  Lookup, LookupResult and LookupRRs try each of
+// the names in turn (see ResolvConfClient); Query and the other functions
+// that take a message don't.
+type Searcher interface {
+	SearchNames(name string) []string
+}
+
+// searcherOf returns the Searcher of c, looking through any wrappers (as
+// UpstreamOf does).
+func searcherOf(c Client) (Searcher, bool) {
+	for {
+		if s, ok := c.(Searcher); ok {
+			return s, true
+		}
+		w, ok := c.(interface{ Unwrap() Client })
+		if !ok {
+			return nil, false
+		}
+		c = w.Unwrap()
+	}
+}
+
+// lookup issues a query for name (or, if c is a Searcher, for each of the
+// names from its search list, until one is answered), and returns the
+// request that was answered along with the outcome.  As with glibc, the
+// search moves on to the next name if the previous one doesn't exist, has no
+// records of the type, or got a SERVFAIL; if every name fails, a NODATA
+// error takes precedence over the others.
+func lookup(c Client, name string, qtype uint16) (*dns.Msg, *dns.Msg, []*Alias, error) {
+	s, ok := searcherOf(c)
+	if !ok {
+		req := NewMsg(c.GetConfig(), name, qtype)
+		resp, aliases, err := QueryAliases(c, req)
+		return req, resp, aliases, err
+	}
+
+	var req *dns.Msg
+	var noData, last error
+	for _, candidate := range s.SearchNames(name) {
+		req = NewMsg(c.GetConfig(), candidate, qtype)
+		resp, aliases, err := QueryAliases(c, req)
+		if err == nil {
+			return req, resp, aliases, nil
+		}
+		last = err
+		if errors.Is(err, ErrNoData) && noData == nil {
+			noData = err
+		}
+		if !errors.Is(err, ErrNXDomain) && !errors.Is(err, ErrNoData) &&
+			!errors.Is(err, ErrServFail) {
+			break
+		}
+	}
+	if noData != nil {
+		return req, nil, nil, noData
+	}
+	if last == nil {
+		last = fmt.Errorf("dnsclient: %q has no names to search", name)
+	}
+	return req, nil, nil, last
+}
+
+type ResolvConfConfig struct {
+	Config
+	// Path is the resolv.conf file.  If empty, DefaultResolvConfPath is
+	// used.
+	Path string
+	// UseTCP queries the nameservers over TCP, as does the use-vc option.
+	UseTCP bool
+	// NewClient creates the client for a single nameserver.  If nil,
+	// NewDo53Client is used.
+	NewClient func(config *Do53Config) Client
+}
+
+// ResolvConfClient queries the nameservers in a resolv.conf file, and
+// expands names with its search list, the way that the system's stub
+// resolver does.  Each query tries the nameservers in order (or, with the
+// rotate option, starting with the next one each time) until one of them
+// answers with something other than SERVFAIL, REFUSED or NOTIMP; the
+// attempts option sets how many times this is done (the Retry policy), and
+// the timeout option bounds each try.  A non-zero Timeout or
+// Retry.MaxAttempts in the config overrides the file.  As with the system's
+// resolver, a truncated UDP response is retried over TCP.
+//
+// Like the Do53Client, a ResolvConfClient is not safe for concurrent use.
+type ResolvConfClient struct {
+	config  *ResolvConfConfig
+	conf    *ResolvConf
+	servers []Client
+	dialed  []bool
+	next    int // for the rotate option
+}
+
+func NewResolvConfClient(config *ResolvConfConfig) (*ResolvConfClient, error) {
+	path := config.Path
+	if path == "" {
+		path = DefaultResolvConfPath
+	}
+	conf, err := ReadResolvConf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't modify the caller's config when filling in from the file
+	cfg := *config
+	if cfg.Timeout == 0 {
+		cfg.Timeout = conf.Timeout
+	}
+	if cfg.Retry.MaxAttempts == 0 {
+		cfg.Retry.MaxAttempts = conf.Attempts
+	}
+	cfg.UseTCP = cfg.UseTCP || conf.UseTCP
+
+	c := &ResolvConfClient{config: &cfg, conf: conf}
+	for _, server := range conf.Nameservers {
+		serverConfig := &Do53Config{
+			Config:       cfg.Config,
+			UseTCP:       cfg.UseTCP,
+			RetryWithTCP: !cfg.UseTCP,
+			Server:       server,
+		}
+		// the retries are made across the servers, by this client
+		serverConfig.Retry = RetryPolicy{}
+		if cfg.NewClient != nil {
+			c.servers = append(c.servers, cfg.NewClient(serverConfig))
+		} else {
+			c.servers = append(c.servers, NewDo53Client(serverConfig))
+		}
+	}
+	c.dialed = make([]bool, len(c.servers))
+	return c, nil
+}
+
+func (c *ResolvConfClient) GetConfig() *Config {
+	return &c.config.Config
+}
+
+// ResolvConf returns the parsed resolv.conf file.
+func (c *ResolvConfClient) ResolvConf() *ResolvConf {
+	return c.conf
+}
+
+func (c *ResolvConfClient) SearchNames(name string) []string {
+	return c.conf.SearchNames(name)
+}
+
+// Dial dials every nameserver.  It is only an error if none of them could be
+// dialed; the ones that failed are skipped.
+func (c *ResolvConfClient) Dial() error {
+	var errs []error
+	for i, server := range c.servers {
+		err := server.Dial()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.dialed[i] = true
+	}
+	if len(errs) == len(c.servers) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (c *ResolvConfClient) Close() error {
+	var errs []error
+	for i, server := range c.servers {
+		if !c.dialed[i] {
+			continue
+		}
+		c.dialed[i] = false
+		if err := server.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *ResolvConfClient) Query(req *dns.Msg) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), req)
+}
+
+func (c *ResolvConfClient) QueryContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	n := len(c.servers)
+	start := 0
+	if c.conf.Rotate {
+		start = c.next
+		c.next = (c.next + 1) % n
+	}
+
+	var resp *dns.Msg
+	err := errors.New("no nameserver is available")
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		if !c.dialed[i] {
+			continue
+		}
+		resp, err = queryContext(ctx, c.servers[i], req)
+		if err == nil {
+			switch resp.Rcode {
+			case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented:
+			default:
+				return resp, nil
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return resp, err
+}
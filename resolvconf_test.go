@@ -0,0 +1,244 @@
+package dnsclient_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want dnsclient.ResolvConf
+	}{
+		{name: "defaults",
+			file: "search example.",
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"127.0.0.1:53"},
+				Search:      []string{"example."},
+				Ndots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			}},
+		{name: "only three nameservers",
+			file: `
+nameserver 192.0.2.1
+nameserver not-an-address
+nameserver 2001:db8::1
+nameserver fe80::1%eth0
+nameserver 192.0.2.4
+search example.`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"192.0.2.1:53", "[2001:db8::1]:53", "[fe80::1%eth0]:53"},
+				Search:      []string{"example."},
+				Ndots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			}},
+		{name: "last search wins",
+			file: `
+domain first.example
+search a.example b.example.
+nameserver 192.0.2.1`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"192.0.2.1:53"},
+				Search:      []string{"a.example.", "b.example."},
+				Ndots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			}},
+		{name: "last domain wins",
+			file: `
+search a.example b.example
+domain last.example ; a comment
+# domain commented.example
+nameserver 192.0.2.1`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"192.0.2.1:53"},
+				Search:      []string{"last.example."},
+				Ndots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			}},
+		{name: "options",
+			file: `
+search example.
+options ndots:3 timeout:2 attempts:4 rotate use-vc unknown:1`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"127.0.0.1:53"},
+				Search:      []string{"example."},
+				Ndots:       3,
+				Timeout:     2 * time.Second,
+				Attempts:    4,
+				Rotate:      true,
+				UseTCP:      true,
+			}},
+		{name: "options over the limits",
+			file: `
+search example.
+options ndots:20 timeout:60 attempts:9`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"127.0.0.1:53"},
+				Search:      []string{"example."},
+				Ndots:       15,
+				Timeout:     30 * time.Second,
+				Attempts:    5,
+			}},
+		{name: "options under the limits",
+			file: `
+search example.
+options ndots:0 timeout:0 attempts:0`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"127.0.0.1:53"},
+				Search:      []string{"example."},
+				Ndots:       0,
+				Timeout:     time.Second,
+				Attempts:    1,
+			}},
+		{name: "invalid options",
+			file: `
+search example.
+options ndots:-1 timeout:x attempts:`,
+			want: dnsclient.ResolvConf{
+				Nameservers: []string{"127.0.0.1:53"},
+				Search:      []string{"example."},
+				Ndots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := dnsclient.ParseResolvConf(strings.NewReader(tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*conf, tt.want) {
+				t.Errorf("got %+v, want %+v", *conf, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvConfSearchNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		ndots  int
+		search []string
+		want   []string
+	}{
+		{name: "www", ndots: 1, search: []string{"a.example.", "b.example."},
+			want: []string{"www.a.example.", "www.b.example.", "www."}},
+		{name: "www.sub", ndots: 1, search: []string{"a.example."},
+			want: []string{"www.sub.", "www.sub.a.example."}},
+		{name: "www.sub", ndots: 2, search: []string{"a.example."},
+			want: []string{"www.sub.a.example.", "www.sub."}},
+		{name: "www.example.", ndots: 1, search: []string{"a.example."},
+			want: []string{"www.example."}},
+		{name: "www.example.", ndots: 0, search: []string{"a.example."},
+			want: []string{"www.example."}},
+		{name: "www", ndots: 1, search: []string{strings.Repeat("a.", 126)},
+			want: []string{"www."}},
+		{name: "www", ndots: 1,
+			want: []string{"www."}},
+	}
+	for _, tt := range tests {
+		conf := &dnsclient.ResolvConf{Ndots: tt.ndots, Search: tt.search}
+		got := conf.SearchNames(tt.name)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchNames(%q) with ndots %d and search %v: got %v, want %v",
+				tt.name, tt.ndots, tt.search, got, tt.want)
+		}
+	}
+}
+
+const searchZones = `
+.	3600	IN	SOA	ns.root. hostmaster.root. 1 7200 3600 1209600 300
+a.test.	3600	IN	SOA	ns1.a.test. hostmaster.a.test. 1 7200 3600 1209600 300
+a.test.	3600	IN	NS	ns1.a.test.
+mail.a.test.	3600	IN	MX	10 mx.a.test.
+b.test.	3600	IN	SOA	ns1.b.test. hostmaster.b.test. 1 7200 3600 1209600 300
+b.test.	3600	IN	NS	ns1.b.test.
+host.b.test.	3600	IN	A	192.0.2.1
+`
+
+func TestResolvConfLookup(t *testing.T) {
+	s := newTestServer(t, searchZones)
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	err := os.WriteFile(path, []byte("nameserver 192.0.2.53\nsearch a.test b.test\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := dnsclient.NewResolvConfClient(&dnsclient.ResolvConfConfig{
+		Config: dnsclient.Config{RecursionDesired: true},
+		Path:   path,
+		NewClient: func(config *dnsclient.Do53Config) dnsclient.Client {
+			if config.Server != "192.0.2.53:53" || !config.RetryWithTCP {
+				t.Errorf("unexpected nameserver config %+v", config)
+			}
+			config.Server = s.Do53Config().Server
+			return dnsclient.NewDo53Client(config)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	tests := []struct {
+		name    string
+		qname   string // that answered
+		err     error
+		queries []string
+	}{
+		{name: "host", qname: "host.b.test.",
+			queries: []string{"host.a.test.", "host.b.test."}},
+		{name: "host.b.test", qname: "host.b.test.",
+			queries: []string{"host.b.test."}},
+		{name: "host.b.test.", qname: "host.b.test.",
+			queries: []string{"host.b.test."}},
+		// mail.a.test. has no A records, which is reported over the
+		// NXDOMAIN for the other names
+		{name: "mail", err: dnsclient.ErrNoData,
+			queries: []string{"mail.a.test.", "mail.b.test.", "mail."}},
+		{name: "none", err: dnsclient.ErrNXDomain,
+			queries: []string{"none.a.test.", "none.b.test.", "none."}},
+		{name: "none.", err: dnsclient.ErrNXDomain,
+			queries: []string{"none."}},
+	}
+	seen := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := dnsclient.LookupResult(rc, tt.name, dns.TypeA)
+			switch {
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("got error %v, want %v", err, tt.err)
+			case tt.err == nil && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.err == nil && result.Qname != tt.qname:
+				t.Errorf("got an answer for %s, want %s", result.Qname, tt.qname)
+			}
+
+			var queries []string
+			for _, q := range s.Queries()[seen:] {
+				queries = append(queries, q.Question[0].Name)
+			}
+			seen = len(s.Queries())
+			if !reflect.DeepEqual(queries, tt.queries) {
+				t.Errorf("got queries %v, want %v", queries, tt.queries)
+			}
+		})
+	}
+}
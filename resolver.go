@@ -0,0 +1,303 @@
+package dnsclient
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type ResolverConfig struct {
+	// Concurrent says that the Client is safe for concurrent use (as are,
+	// e.g., DoHClient and BalanceClient).  Otherwise, the queries that the
+	// resolver makes at once (such as its A and AAAA queries for a name)
+	// are serialized.
+	Concurrent bool
+}
+
+// resolverClient issues the queries for the Conns of a Resolver.
+type resolverClient struct {
+	c      Client
+	config *ResolverConfig
+	mu     sync.Mutex
+}
+
+func (r *resolverClient) query(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if !r.config.Concurrent {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	}
+	resp, err := queryContext(ctx, r.c, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != req.Id {
+		// e.g., DoH may use an ID of 0
+		resp = resp.Copy()
+		resp.Id = req.Id
+	}
+	return resp, nil
+}
+
+// NewResolver returns a net.Resolver that sends its queries through c, by way
+// of Go's built-in resolver: the standard library still reads the system's
+// configuration (/etc/hosts, and the search list and options in
+// /etc/resolv.conf), but the nameserver addresses are ignored, and each query
+// goes to c instead.  Use NewDialer to have, e.g., an http.Transport resolve
+// names with c.
+//
+// c must already be dialed, and the Resolver doesn't close it.  A nil config
+// is the same as an empty one.
+func NewResolver(c Client, config *ResolverConfig) *net.Resolver {
+	if config == nil {
+		config = &ResolverConfig{}
+	}
+	r := &resolverClient{c: c, config: config}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := newResolverConn(ctx, r, !strings.HasPrefix(network, "udp"))
+			if conn.stream {
+				return conn, nil
+			}
+			// Go's resolver exchanges whole messages over a Conn that
+			// is also a PacketConn, as it would over UDP
+			return &resolverPacketConn{conn}, nil
+		},
+	}
+}
+
+// NewDialer returns a net.Dialer that resolves names with c (see
+// NewResolver); e.g., an http.Transport with the Dialer's DialContext as its
+// DialContext looks up the hosts of URLs with c.
+func NewDialer(c Client, config *ResolverConfig) *net.Dialer {
+	return &net.Dialer{Resolver: NewResolver(c, config)}
+}
+
+// resolverAddr is the (fake) address of both ends of a resolverConn.
+type resolverAddr struct{}
+
+func (resolverAddr) Network() string { return "dnsclient" }
+func (resolverAddr) String() string  { return "dnsclient" }
+
+type resolverResult struct {
+	resp *dns.Msg
+	err  error
+}
+
+// resolverConn is an in-memory net.Conn for Go's resolver: each DNS message
+// that is written to it is issued as a query, and the response is then
+// available to read.  If stream is set, the messages are framed as over TCP
+// (with a two-byte length prefix); otherwise, each Write and Read is a whole
+// message (see resolverPacketConn).
+type resolverConn struct {
+	r      *resolverClient
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream bool
+
+	results chan resolverResult
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+	in       []byte // stream: the partial request
+	out      []byte // stream: the unread part of the response
+}
+
+func newResolverConn(ctx context.Context, r *resolverClient, stream bool) *resolverConn {
+	// the dial's context carries the deadline of the whole lookup
+	ctx, cancel := context.WithCancel(ctx)
+	return &resolverConn{
+		r:       r,
+		ctx:     ctx,
+		cancel:  cancel,
+		stream:  stream,
+		results: make(chan resolverResult, 8),
+		closed:  make(chan struct{}),
+	}
+}
+
+// start issues the query in msg.
+func (c *resolverConn) start(msg []byte) error {
+	req := new(dns.Msg)
+	if err := req.Unpack(msg); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	ctx, cancel := c.ctx, context.CancelFunc(func() {})
+	if !c.deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+	}
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		resp, err := c.r.query(ctx, req)
+		select {
+		case c.results <- resolverResult{resp, err}:
+		case <-c.closed:
+		}
+	}()
+	return nil
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if !c.stream {
+		if err := c.start(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	c.mu.Lock()
+	c.in = append(c.in, b...)
+	var msgs [][]byte
+	for len(c.in) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.in))
+		if len(c.in) < 2+n {
+			break
+		}
+		msgs = append(msgs, c.in[2:2+n])
+		c.in = c.in[2+n:]
+	}
+	c.mu.Unlock()
+
+	for _, msg := range msgs {
+		if err := c.start(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// next waits for the next response.
+func (c *resolverConn) next() (*dns.Msg, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case res := <-c.results:
+		return res.resp, res.err
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// packTruncated packs resp, truncating it (and setting the TC bit) if it is
+// longer than size.
+func packTruncated(resp *dns.Msg, size int) ([]byte, error) {
+	if resp.Len() > size {
+		resp = resp.Copy()
+		resp.Truncate(size)
+	}
+	return resp.Pack()
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	if !c.stream {
+		resp, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		msg, err := packTruncated(resp, len(b))
+		if err != nil {
+			return 0, err
+		}
+		return copy(b, msg), nil
+	}
+
+	c.mu.Lock()
+	buffered := len(c.out) > 0
+	c.mu.Unlock()
+	if !buffered {
+		resp, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		msg, err := packTruncated(resp, dns.MaxMsgSize)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.out = binary.BigEndian.AppendUint16(c.out, uint16(len(msg)))
+		c.out = append(c.out, msg...)
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *resolverConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *resolverConn) LocalAddr() net.Addr  { return resolverAddr{} }
+func (c *resolverConn) RemoteAddr() net.Addr { return resolverAddr{} }
+
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *resolverConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *resolverConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// resolverPacketConn is a resolverConn that exchanges whole messages.  Go's
+// resolver tells the two kinds of Conn apart by whether they implement
+// net.PacketConn.
+type resolverPacketConn struct {
+	*resolverConn
+}
+
+func (c *resolverPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, resolverAddr{}, err
+}
+
+func (c *resolverPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+var (
+	_ net.Conn       = (*resolverConn)(nil)
+	_ net.PacketConn = (*resolverPacketConn)(nil)
+)
@@ -0,0 +1,138 @@
+package dnsclient_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+)
+
+// bigZone has a name with 100 A records, which don't fit in the 1232-byte
+// buffer that Go's resolver reads UDP responses into.
+func bigZone() string {
+	var b strings.Builder
+	b.WriteString(raceZone)
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&b, "big.example.com.\t3600\tIN\tA\t198.51.100.%d\n", i)
+	}
+	return b.String()
+}
+
+// newTestResolver returns a Resolver that sends its queries to s, and the
+// networks of the Conns that Go's resolver dials.
+func newTestResolver(t *testing.T, zone string) (*net.Resolver, func() []string) {
+	t.Helper()
+	s := newTestServer(t, zone)
+	c := dnsclient.NewDoHClient(s.DoHConfig())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	r := dnsclient.NewResolver(c, &dnsclient.ResolverConfig{Concurrent: true})
+	var mu sync.Mutex
+	var networks []string
+	dial := r.Dial
+	r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		networks = append(networks, network)
+		mu.Unlock()
+		return dial(ctx, network, address)
+	}
+	return r, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(networks)
+	}
+}
+
+func TestResolverLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		host  string
+		addrs int
+		tcp   bool // whether the lookup falls back to TCP
+	}{
+		{"small", "www.example.com.", 1, false},
+		{"truncated", "big.example.com.", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, networks := newTestResolver(t, bigZone())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			addrs, err := r.LookupHost(ctx, tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != tt.addrs {
+				t.Errorf("got %d addresses, want %d", len(addrs), tt.addrs)
+			}
+			tcp := slices.ContainsFunc(networks(), func(network string) bool {
+				return strings.HasPrefix(network, "tcp")
+			})
+			if tcp != tt.tcp {
+				t.Errorf("dialed %v, want a TCP fallback: %v", networks(), tt.tcp)
+			}
+		})
+	}
+}
+
+func TestResolverConn(t *testing.T) {
+	tests := []struct {
+		network   string
+		udpSize   uint16 // the read buffer for a packet Conn
+		host      string
+		truncated bool
+		answers   int // if not truncated
+	}{
+		{"udp", 512, "www.example.com.", false, 1},
+		{"udp", 512, "big.example.com.", true, 0},
+		{"udp", dns.MaxMsgSize, "big.example.com.", false, 100},
+		{"tcp", 0, "www.example.com.", false, 1},
+		{"tcp", 0, "big.example.com.", false, 100},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s %d %s", tt.network, tt.udpSize, tt.host)
+		t.Run(name, func(t *testing.T) {
+			r, _ := newTestResolver(t, bigZone())
+			conn, err := r.Dial(context.Background(), tt.network, "192.0.2.53:53")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, ok := conn.(net.PacketConn); ok != (tt.network == "udp") {
+				t.Fatalf("a %s Conn is a PacketConn: %v", tt.network, ok)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// dns.Conn frames the messages for a stream, but not for a
+			// PacketConn
+			co := &dns.Conn{Conn: conn, UDPSize: tt.udpSize}
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, dns.TypeA)
+			if err := co.WriteMsg(req); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := co.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Id != req.Id || resp.Truncated != tt.truncated {
+				t.Errorf("got ID %d (want %d), truncated %v (want %v)",
+					resp.Id, req.Id, resp.Truncated, tt.truncated)
+			}
+			if !tt.truncated && len(resp.Answer) != tt.answers {
+				t.Errorf("got %d answers, want %d", len(resp.Answer), tt.answers)
+			}
+		})
+	}
+}
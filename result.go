@@ -0,0 +1,131 @@
+package dnsclient
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient/internal/msgutil"
+)
+
+// Result is the outcome of a query that was answered, in a form that spares
+// the caller from sifting through the response message.
+type Result struct {
+	Qname string
+	Qtype uint16
+	// CanonicalName is the name that the answer is for: the end of the
+	// alias chain, or Qname if there are no aliases.
+	CanonicalName string
+	Aliases       []*Alias
+	// Answer holds the records of type Qtype owned by CanonicalName.
+	Answer []dns.RR
+	// TTL is the minimum TTL of the answer records and the aliases; that
+	// is, how long the result may be cached.
+	TTL uint32
+	// Authenticated reports whether the (final) response had the AD bit
+	// set; see ValidatingClient.
+	Authenticated bool
+	Rcode         int
+	// ExtendedErrors are the Extended DNS Errors in the (final) response;
+	// a successful response may have them too, e.g., for a stale or
+	// filtered answer.
+	ExtendedErrors []*ExtendedError
+	Msg            *dns.Msg
+}
+
+func newResult(q dns.Question, resp *dns.Msg, aliases []*Alias) *Result {
+	r := &Result{
+		Qname:          q.Name,
+		Qtype:          q.Qtype,
+		CanonicalName:  q.Name,
+		Aliases:        aliases,
+		Authenticated:  resp.AuthenticatedData,
+		Rcode:          resp.Rcode,
+		ExtendedErrors: ExtendedErrors(resp),
+		Msg:            resp,
+	}
+	if len(aliases) > 0 {
+		r.CanonicalName = aliases[len(aliases)-1].Target
+	}
+
+	first := true
+	minTTL := func(ttl uint32) {
+		if first || ttl < r.TTL {
+			r.TTL = ttl
+		}
+		first = false
+	}
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		if h.Rrtype == q.Qtype && equalNames(h.Name, r.CanonicalName) {
+			r.Answer = append(r.Answer, rr)
+			minTTL(h.Ttl)
+		}
+	}
+	for _, a := range aliases {
+		minTTL(a.TTL)
+	}
+	return r
+}
+
+// QueryResult is like Query, but returns the answer as a Result.
+func QueryResult(c Client, req *dns.Msg) (*Result, error) {
+	resp, aliases, err := QueryAliases(c, req)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(req.Question[0], resp, aliases), nil
+}
+
+// LookupResult is like Lookup, but returns the answer as a Result.  With a
+// search list, the Result's Qname is the name that was answered.
+func LookupResult(c Client, name string, qtype uint16) (*Result, error) {
+	req, resp, aliases, err := lookup(c, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(req.Question[0], resp, aliases), nil
+}
+
+// rrTypes maps the Go type of each kind of record in dns.TypeToRR to its RR
+// type.
+var rrTypes = sync.OnceValue(func() map[reflect.Type]uint16 {
+	m := make(map[reflect.Type]uint16)
+	for t, newRR := range dns.TypeToRR {
+		goType := reflect.TypeOf(newRR())
+		if prev, ok := m[goType]; !ok || t < prev {
+			m[goType] = t
+		}
+	}
+	return m
+})
+
+// rrType returns the RR type whose records are of Go type T, which must be
+// a concrete type (not, e.g., dns.RR itself).
+func rrType[T dns.RR]() (uint16, bool) {
+	t, ok := rrTypes()[reflect.TypeOf((*T)(nil)).Elem()]
+	return t, ok
+}
+
+// ResultRRs returns the answer records of r that are of type T.
+func ResultRRs[T dns.RR](r *Result) []T {
+	return msgutil.CollectRRs[T](r.Answer)
+}
+
+// LookupRRs looks up the records of type T (e.g., *dns.MX) for name.  As with
+// Lookup, a nil error means that there is at least one record.  For example:
+//
+//	mxs, err := dnsclient.LookupRRs[*dns.MX](c, "example.com")
+func LookupRRs[T dns.RR](c Client, name string) ([]T, error) {
+	qtype, ok := rrType[T]()
+	if !ok {
+		var zero T
+		return nil, fmt.Errorf("dnsclient: %T is not a known RR type", zero)
+	}
+	r, err := LookupResult(c, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return ResultRRs[T](r), nil
+}
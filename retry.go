@@ -0,0 +1,127 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RetryClassifier reports whether a failed attempt is worth retrying.  If the
+// attempt failed at the transport level, resp is nil and err holds the
+// transport error; otherwise, err is nil and resp is the (unsuccessful)
+// response.
+type RetryClassifier func(resp *dns.Msg, err error) bool
+
+// RetryPolicy controls how Query re-issues a request that failed.  The zero
+// value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values <= 1 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the second attempt.  Each further delay
+	// doubles, up to MaxBackoff (if MaxBackoff is non-zero).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to +/- Jitter of its value, and
+	// should be in [0, 1].
+	Jitter float64
+	// Classify decides which failures to retry.  If nil,
+	// DefaultRetryClassifier is used.  Regardless of Classify, an
+	// NXDOMAIN response is never retried.
+	Classify RetryClassifier
+}
+
+// DefaultRetryClassifier retries timeouts and SERVFAIL and REFUSED
+// responses.
+func DefaultRetryClassifier(resp *dns.Msg, err error) bool {
+	if err != nil {
+		return isTimeout(err) || errors.Is(err, ErrTimeout)
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *RetryPolicy) shouldRetry(resp *dns.Msg, err error) bool {
+	if err == nil && resp.Rcode == dns.RcodeNameError {
+		return false
+	}
+	classify := p.Classify
+	if classify == nil {
+		classify = DefaultRetryClassifier
+	}
+	return classify(resp, err)
+}
+
+// delay returns how long to wait before making attempt number attempt+1.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// queryWithRetry issues req on c according to c's retry policy.  It returns
+// the outcome of the last attempt, along with the number of attempts made.
+// A response with a non-success rcode is not an error at this level.  Once
+// ctx is done, no further attempts are made, and ctx.Err() is returned.
+func queryWithRetry(ctx context.Context, c Client, req *dns.Msg) (*dns.Msg, int, error) {
+	config := c.GetConfig()
+	policy := &config.Retry
+
+	attempt := 1
+	for {
+		resp, err := queryContext(ctx, c, req)
+		if err == nil && resp.Rcode == dns.RcodeSuccess {
+			return resp, attempt, nil
+		}
+		if attempt >= policy.MaxAttempts || !policy.shouldRetry(resp, err) {
+			return resp, attempt, err
+		}
+
+		delay := policy.delay(attempt)
+		attrs := append(questionAttrs(req), "attempt", attempt, "delay", delay)
+		if err != nil {
+			attrs = append(attrs, "err", err)
+		} else {
+			attrs = append(attrs, "rcode", dns.RcodeToString[resp.Rcode])
+		}
+		config.logger().Info("retrying dns query", attrs...)
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, attempt, err
+		}
+		attempt++
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is done, in which case it returns
+// ctx.Err().
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
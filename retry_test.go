@@ -0,0 +1,93 @@
+package dnsclient_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/dnsclient"
+	"github.com/syslab-wm/dnsclient/dnstest"
+)
+
+func TestRetryBackoffHonorsContext(t *testing.T) {
+	s := newTestServer(t, raceZone)
+	s.AddRule(dnstest.Rule{Behavior: dnstest.Behavior{ServFail: true}})
+
+	config := s.Do53Config()
+	config.Retry = dnsclient.RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Second}
+	c := dnsclient.NewDo53Client(config)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	req := dnsclient.NewMsg(c.GetConfig(), "www.example.com", dns.TypeA)
+	_, err := dnsclient.QueryContext(ctx, c, req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the backoff ran on for %v after the context expired", elapsed)
+	}
+}
+
+func TestRedialAfterStreamTimeout(t *testing.T) {
+	s := newTestServer(t, raceZone)
+
+	tests := []struct {
+		name      string
+		transport dnsclient.Transport
+		client    func() dnsclient.Client
+	}{
+		{"tcp", dnsclient.TransportDo53TCP, func() dnsclient.Client {
+			config := s.Do53Config()
+			config.UseTCP = true
+			config.Timeout = 200 * time.Millisecond
+			return dnsclient.NewDo53Client(config)
+		}},
+		{"tls", dnsclient.TransportDoT, func() dnsclient.Client {
+			config := s.DoTConfig()
+			config.Timeout = 200 * time.Millisecond
+			return dnsclient.NewDoTClient(config)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the late response to the first query must not be taken
+			// for the second one's
+			s.AddRule(dnstest.Rule{
+				Transports: []dnsclient.Transport{tt.transport},
+				Count:      1,
+				Behavior:   dnstest.Behavior{Delay: 300 * time.Millisecond},
+			})
+
+			c := tt.client()
+			if err := c.Dial(); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			req := dnsclient.NewMsg(c.GetConfig(), "www.example.com", dns.TypeA)
+			if _, err := dnsclient.Query(c, req); !errors.Is(err, dnsclient.ErrTimeout) {
+				t.Fatalf("got error %v, want %v", err, dnsclient.ErrTimeout)
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			req = dnsclient.NewMsg(c.GetConfig(), "mail.example.com", dns.TypeA)
+			resp, err := dnsclient.Query(c, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := resp.Question[0].Name; name != "mail.example.com." {
+				t.Errorf("got the response for %s", name)
+			}
+		})
+	}
+}